@@ -0,0 +1,142 @@
+package butanex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// ASTVersion is the version of the document produced by MergeToAST. It is
+// incremented whenever a field is removed or changes meaning, so a consumer
+// can reject documents it does not understand. Fields may be added without
+// a new version.
+const ASTVersion = 1
+
+// AST is the document produced by MergeToAST: the merged config as a tree of
+// nodes, each carrying where it came from.
+type AST struct {
+	Version int      `json:"version"`
+	Root    *ASTNode `json:"root"`
+	// Warnings are the warnings MergeFilesResult would return, as strings.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ASTNode is a single value of the merged config.
+type ASTNode struct {
+	// Path is the context path of the value. The elements of a sequence
+	// share the path of the sequence, as in every pattern.
+	Path string `json:"path"`
+	// Key is the key of a mapping's value, and empty for the root and for
+	// the elements of a sequence.
+	Key string `json:"key,omitempty"`
+	// Kind is "mapping", "sequence", "scalar" or "null".
+	Kind string `json:"kind"`
+	// Value is the value of a scalar. It is absent for every other kind.
+	Value any `json:"value,omitempty"`
+	// File is the input file that set the value.
+	File string `json:"file,omitempty"`
+	// Mode is the merge mode the policy gives the key, "append", "prepend"
+	// or "overwrite", and Pattern the pattern that decided it, if any. Both
+	// are absent for the root and for the elements of a sequence. They are
+	// those of the global policy, not those of any FileSpec.
+	Mode    string `json:"mode,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	// Resolution is how Options.OnConflict last resolved a conflict at the
+	// key: "keep-dst", "take-src" or "append".
+	Resolution string `json:"resolution,omitempty"`
+	// Children are the values of a mapping, ordered by key, or the elements
+	// of a sequence, in order.
+	Children []*ASTNode `json:"children,omitempty"`
+}
+
+var resolutionNames = map[Resolution]string{
+	ResolveKeepDst: "keep-dst",
+	ResolveTakeSrc: "take-src",
+	ResolveAppend:  "append",
+}
+
+// MergeToAST merges the files like MergeFiles and returns the merged config
+// as an AST encoded as JSON, for tools that show how the files combine.
+func MergeToAST(options *Options, path ...string) ([]byte, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	m, err := newMerge(options, nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.sources == nil {
+		m.sources = map[string]string{}
+	}
+	m.resolutions = map[string]Resolution{}
+	specs := make([]FileSpec, len(path))
+	for i, p := range path {
+		specs[i] = FileSpec{Path: p}
+	}
+	if err := m.mergeSpecs(context.Background(), specs); err != nil {
+		return nil, err
+	}
+	if m.blobs != nil {
+		m.blobs.restoreValues(m.root)
+	}
+	ast := AST{Version: ASTVersion, Root: m.astNode(m.root, "$", "", "", true)}
+	for _, w := range m.warnings {
+		ast.Warnings = append(ast.Warnings, w.String())
+	}
+	d, err := json.MarshalIndent(ast, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding json: %w", err)
+	}
+	return append(d, '\n'), nil
+}
+
+// astNode returns the node of v, which is at ctxpath and was set by file. If
+// tracked is true the merge recorded the file of each key within v that a
+// later file set; the keys within sequence elements are never recorded, as
+// they share the context path of every other element.
+func (m *merge) astNode(v any, ctxpath, key, file string, tracked bool) *ASTNode {
+	n := &ASTNode{Path: ctxpath, Key: key, File: file}
+	switch v := v.(type) {
+	case nil:
+		n.Kind = "null"
+	case map[string]any:
+		n.Kind = kindMapping.String()
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			cpath := joinPath(ctxpath, k)
+			source, ok := m.sources[cpath]
+			if !ok || !tracked {
+				source = file
+			}
+			c := m.astNode(v[k], cpath, k, source, tracked)
+			if mode, entry, ok := m.policy.resolve(cpath); ok {
+				c.Mode, c.Pattern = modeNames[mode], entry.pattern
+			} else {
+				c.Mode = modeNames[m.policy.mode(cpath)]
+			}
+			if r, ok := m.resolutions[cpath]; ok {
+				c.Resolution = resolutionNames[r]
+			}
+			n.Children = append(n.Children, c)
+		}
+	case []any:
+		n.Kind = kindSequence.String()
+		files := m.elementFiles[ctxpath]
+		for i, e := range v {
+			source := file
+			if i < len(files) && files[i] != "" {
+				source = files[i]
+			}
+			n.Children = append(n.Children, m.astNode(e, ctxpath, "", source, false))
+		}
+	default:
+		n.Kind = kindScalar.String()
+		n.Value = v
+	}
+	return n
+}
@@ -0,0 +1,64 @@
+package butanex
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeToAST(t *testing.T) {
+	options := &Options{
+		FilesDir: "./ast",
+		Prepend:  []string{"$.storage.files"},
+		OnConflict: func(ctx ConflictContext) (Resolution, error) {
+			return ResolveTakeSrc, nil
+		},
+	}
+	got, err := MergeToAST(options, "input1.yaml", "input2.yaml")
+	if err != nil {
+		t.Fatalf("MergeToAST() got err: %s", err)
+	}
+	want, err := os.ReadFile(filepath.Join("ast", "want.json"))
+	if err != nil {
+		t.Fatalf("error reading want file: %s", err)
+	}
+	if diff := cmp.Diff(string(want), string(got)); diff != "" {
+		t.Errorf("MergeToAST() got diff: -want/+got: %s", diff)
+	}
+}
+
+// TestASTSchema checks that the fixture, which consumers may rely on, holds
+// only the fields and kinds of the current version.
+func TestASTSchema(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("ast", "want.json"))
+	if err != nil {
+		t.Fatalf("error reading want file: %s", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var ast AST
+	if err := dec.Decode(&ast); err != nil {
+		t.Fatalf("Decode() got err: %s", err)
+	}
+	if ast.Version != ASTVersion {
+		t.Errorf("Version got %d wanted %d", ast.Version, ASTVersion)
+	}
+	var check func(n *ASTNode)
+	check = func(n *ASTNode) {
+		switch n.Kind {
+		case "mapping", "sequence", "scalar", "null":
+		default:
+			t.Errorf("node[%s] got kind %q", n.Path, n.Kind)
+		}
+		if (n.Value != nil) != (n.Kind == "scalar") {
+			t.Errorf("node[%s] of kind %s got value %v", n.Path, n.Kind, n.Value)
+		}
+		for _, c := range n.Children {
+			check(c)
+		}
+	}
+	check(ast.Root)
+}
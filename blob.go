@@ -0,0 +1,151 @@
+package butanex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// blobs holds large multiline strings, such as inline scripts, that are
+// replaced by short tokens while merging so that they are never compared or
+// encoded. Each token is emitted as a literal block scalar and restore then
+// writes the original string in its place, exactly as the YAML encoder would.
+type blobs struct {
+	minSize int
+	// prefix starts every token. It is random so that a token does not
+	// appear in any real config.
+	prefix string
+	values []string
+	tokens map[string]string
+}
+
+func newBlobs(minSize int) *blobs {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return &blobs{
+		minSize: minSize,
+		prefix:  "butanex-blob-" + hex.EncodeToString(nonce) + "-",
+		tokens:  map[string]string{},
+	}
+}
+
+// extract replaces each large string in config with a token. The same string
+// is always replaced by the same token, so equal values still compare equal.
+func (b *blobs) extract(config map[string]any, policy *mergePolicy) {
+	w := &walker{visit: func(ctxpath string, v any) (any, bool, error) {
+		s, ok := v.(string)
+		if !ok || len(s) < b.minSize || !literalSafe(s) {
+			return nil, false, nil
+		}
+		if quote, ok := policy.quoteStyle(ctxpath); ok && quote {
+			return nil, false, nil
+		}
+		token, ok := b.tokens[s]
+		if !ok {
+			token = b.prefix + strconv.Itoa(len(b.values)) + "\n"
+			b.tokens[s] = token
+			b.values = append(b.values, s)
+		}
+		return token, true, nil
+	}, scope: policy.scope}
+	// visit never returns an error.
+	_ = w.mapping(config, "$")
+}
+
+// restoreValues replaces each token in root with its string.
+func (b *blobs) restoreValues(root map[string]any) {
+	w := &walker{visit: func(ctxpath string, v any) (any, bool, error) {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false, nil
+		}
+		value, ok := b.value(strings.TrimSuffix(s, "\n"))
+		return value, ok, nil
+	}}
+	// visit never returns an error.
+	_ = w.mapping(root, "$")
+}
+
+// restoreValue returns the string s stands for if it is a token, and s
+// otherwise, such as for a string to be changed rather than restored whole.
+func (b *blobs) restoreValue(s string) string {
+	if b == nil {
+		return s
+	}
+	if value, ok := b.value(strings.TrimSuffix(s, "\n")); ok {
+		return value
+	}
+	return s
+}
+
+// value returns the string a token stands for.
+func (b *blobs) value(token string) (string, bool) {
+	id, ok := strings.CutPrefix(token, b.prefix)
+	if !ok {
+		return "", false
+	}
+	i, err := strconv.Atoi(id)
+	if err != nil || i < 0 || i >= len(b.values) {
+		return "", false
+	}
+	return b.values[i], true
+}
+
+// restore replaces each token line of the YAML output with the lines of its
+// string, at the same indentation.
+func (b *blobs) restore(out []byte) []byte {
+	if len(b.values) == 0 {
+		return out
+	}
+	var buf bytes.Buffer
+	for len(out) > 0 {
+		line, rest, _ := bytes.Cut(out, []byte("\n"))
+		out = rest
+		text := bytes.TrimLeft(line, " ")
+		value, ok := b.value(string(text))
+		if !ok {
+			buf.Write(line)
+			buf.WriteByte('\n')
+			continue
+		}
+		indent := line[:len(line)-len(text)]
+		for _, l := range strings.SplitAfter(strings.TrimSuffix(value, "\n"), "\n") {
+			if l != "\n" {
+				buf.Write(indent)
+			}
+			buf.WriteString(l)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// literalSafe returns whether s is written by the YAML encoder as a literal
+// block scalar that keeps a single trailing newline and needs no indentation
+// indicator, so that restore can write it the same way.
+func literalSafe(s string) bool {
+	if !strings.HasSuffix(s, "\n") || strings.HasSuffix(s, "\n\n") {
+		return false
+	}
+	if s[0] == ' ' || s[0] == '\n' || strings.Contains(s, " \n") {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r == '\n' || r == '\t':
+		case r == utf8.RuneError, r == '\u2028', r == '\u2029':
+			return false
+		case r >= 0x20 && r <= 0x7e:
+		case r >= 0xa0 && r <= 0xd7ff:
+		case r >= 0xe000 && r <= 0xfffd && r != 0xfeff:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package butanex
+
+import (
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlobSize(t *testing.T) {
+	script := "#!/bin/bash\nset -euo pipefail\n\n\tindented() {\n    echo \"héllo: world\" # not a comment\n}\n\n\nindented\n"
+	dir := writeFiles(t, map[string]string{
+		"input1.yaml": "banner: " + quoteYAML(script) + "\nstorage:\n  files:\n    - path: /usr/local/bin/run\n      contents:\n        inline: " + quoteYAML(script) + "\n",
+		"input2.yaml": "banner: " + quoteYAML(script) + "\nstorage:\n  files:\n    - path: /usr/local/bin/run\n      contents:\n        inline: " + quoteYAML(script) + "\n" +
+			"    - path: /etc/trailing\n      contents:\n        inline: \"trailing space \\nline\\n\"\n" +
+			"kernel_arguments:\n  should_exist:\n    - " + quoteYAML(strings.Repeat("arg\n", 20)) + "\n",
+	})
+	for _, format := range []Format{FormatYAML, FormatJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			options := &Options{FilesDir: dir, OutputFormat: format}
+			want, err := MergeFiles(options, "input1.yaml", "input2.yaml")
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			options.BlobSize = 16
+			got, err := MergeFiles(options, "input1.yaml", "input2.yaml")
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(string(want), string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+			if strings.Contains(string(got), "butanex-blob") {
+				t.Errorf("MergeFiles() got unrestored blob: %s", got)
+			}
+			if banner := mustUnmarshal(t, got)["banner"]; banner != script {
+				t.Errorf("MergeFiles() got banner %q, want %q", banner, script)
+			}
+		})
+	}
+}
+
+// quoteYAML returns s as a double quoted YAML scalar.
+func quoteYAML(s string) string {
+	return fmt.Sprintf("%q", s)
+}
+
+func writeBlobFile(b *testing.B, size int) string {
+	b.Helper()
+	var script strings.Builder
+	for i := 0; script.Len() < size; i++ {
+		fmt.Fprintf(&script, "        echo \"line %d of a large inline script\"\n", i)
+	}
+	var config strings.Builder
+	config.WriteString("variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n    - path: /usr/local/bin/large\n      contents:\n        inline: |\n")
+	for _, line := range strings.SplitAfter(script.String(), "\n") {
+		if line != "" {
+			config.WriteString("          " + line)
+		}
+	}
+	dir := b.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "large.yaml"), []byte(config.String()), 0o644); err != nil {
+		b.Fatalf("error writing file: %s", err)
+	}
+	return dir
+}
+
+func BenchmarkMergeLargeInline(b *testing.B) {
+	dir := writeBlobFile(b, 1<<20)
+	for _, blobSize := range []int{0, 4096} {
+		b.Run(fmt.Sprintf("BlobSize=%d", blobSize), func(b *testing.B) {
+			mg := NewMerger(&Options{FilesDir: dir, BlobSize: blobSize})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := mg.MergeFiles("large.yaml"); err != nil {
+					b.Fatalf("MergeFiles() got err: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestBlobSizeConcatInline(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml": "storage:\n  files:\n    - path: /etc/profile.d/env.sh\n      contents:\n        inline: |\n          export A=1\n",
+		"b.yaml": "storage:\n  files:\n    - path: /etc/profile.d/env.sh\n      contents:\n        inline: |\n          export B=2\n",
+	})
+	options := &Options{
+		FilesDir:     dir,
+		MergeBy:      map[string]string{"$.storage.files": "path"},
+		ConcatInline: []string{".contents.inline"},
+		BlobSize:     8,
+		OutputFormat: FormatJSON,
+	}
+	got, err := MergeFiles(options, "a.yaml", "b.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	want := "storage:\n  files:\n    - path: /etc/profile.d/env.sh\n      contents:\n        inline: |\n          export A=1\n          export B=2\n"
+	if diff := cmp.Diff(mustUnmarshal(t, []byte(want)), mustUnmarshal(t, got)); diff != "" {
+		t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+	}
+
+	// The hash is that of the config without BlobSize, whose tokens differ
+	// from merge to merge.
+	wantHash, err := MergeHash(&Options{FilesDir: dir, MergeBy: options.MergeBy, ConcatInline: options.ConcatInline}, "a.yaml", "b.yaml")
+	if err != nil {
+		t.Fatalf("MergeHash() got err: %s", err)
+	}
+	for range 2 {
+		hash, err := MergeHash(options, "a.yaml", "b.yaml")
+		if err != nil {
+			t.Fatalf("MergeHash() got err: %s", err)
+		}
+		if hash != wantHash {
+			t.Errorf("MergeHash() got %s wanted %s", hash, wantHash)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package butanex
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// Merger merges files like MergeFiles, but keeps each parsed file in memory so
+// that later merges sharing the same files do not read and parse them again.
+// The policy of the options is built once, by the first merge, and shared by
+// every later merge.
+//
+// A cached file is reused as long as its modification time and size are
+// unchanged. A Merger is safe for concurrent use, including concurrent calls
+// to MergeFiles.
+type Merger struct {
+	options *Options
+	cache   *parseCache
+
+	once   sync.Once
+	policy *mergePolicy
+	err    error
+}
+
+// NewMerger returns a Merger that merges files using options. The options
+// must not be modified afterwards.
+func NewMerger(options *Options) *Merger {
+	if options == nil {
+		options = &Options{}
+	}
+	return &Merger{
+		options: options,
+		cache:   &parseCache{files: map[string]cachedFile{}},
+	}
+}
+
+// MergeFiles merges the files like the package level MergeFiles.
+func (mg *Merger) MergeFiles(path ...string) ([]byte, error) {
+	specs := make([]FileSpec, len(path))
+	for i, p := range path {
+		specs[i] = FileSpec{Path: p}
+	}
+	m, err := mg.newMerge()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.mergeSpecs(context.Background(), specs); err != nil {
+		return nil, err
+	}
+	return m.output(mg.options.OutputFormat)
+}
+
+// newMerge returns the state of a single merge, with a fresh root and a clone
+// of the shared policy.
+func (mg *Merger) newMerge() (*merge, error) {
+	mg.once.Do(func() {
+		var m *merge
+		if m, mg.err = newMerge(mg.options, nil); mg.err == nil {
+			mg.policy = m.policy
+		}
+	})
+	if mg.err != nil {
+		return nil, mg.err
+	}
+	m, err := newMerge(mg.options, mg.policy.clone())
+	if err != nil {
+		return nil, err
+	}
+	m.cache = mg.cache
+	return m, nil
+}
+
+// parseCache holds parsed files keyed by file name.
+type parseCache struct {
+	mu    sync.Mutex
+	files map[string]cachedFile
+}
+
+type cachedFile struct {
+	modTime time.Time
+	size    int64
+	config  map[string]any
+	tags    map[string]mergeMode
+}
+
+// get returns the cached config and merge tags for file if the file is
+// unchanged. Both are shared and must not be modified.
+func (c *parseCache) get(file string, info os.FileInfo) (map[string]any, map[string]mergeMode, bool) {
+	c.mu.Lock()
+	cf, ok := c.files[file]
+	c.mu.Unlock()
+	if !ok || !cf.modTime.Equal(info.ModTime()) || cf.size != info.Size() {
+		return nil, nil, false
+	}
+	return cf.config, cf.tags, true
+}
+
+// put caches config and its merge tags for file. Neither may be modified
+// afterwards.
+func (c *parseCache) put(file string, info os.FileInfo, config map[string]any, tags map[string]mergeMode) {
+	cf := cachedFile{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		config:  config,
+		tags:    tags,
+	}
+	c.mu.Lock()
+	c.files[file] = cf
+	c.mu.Unlock()
+}
@@ -0,0 +1,158 @@
+package butanex
+
+import (
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMergerCache(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml": `
+passwd:
+  users:
+    - name: base
+`,
+		"host.yaml": `
+passwd:
+  users:
+    - name: host
+`,
+	})
+	mg := NewMerger(&Options{FilesDir: dir})
+	want := mustUnmarshal(t, []byte(`
+passwd:
+  users:
+    - name: base
+    - name: host
+`))
+	// Merging repeatedly must not modify the cached files.
+	for i := 0; i < 3; i++ {
+		got, err := mg.MergeFiles("base.yaml", "host.yaml")
+		if err != nil {
+			t.Fatalf("MergeFiles() got err: %s", err)
+		}
+		if diff := cmp.Diff(want, mustUnmarshal(t, got)); diff != "" {
+			t.Errorf("MergeFiles() #%d got diff: -want/+got: %s", i, diff)
+		}
+	}
+
+	base := filepath.Join(dir, "base.yaml")
+	if err := os.WriteFile(base, []byte("passwd:\n  users:\n    - name: changed\n"), 0o644); err != nil {
+		t.Fatalf("error writing file: %s", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(base, later, later); err != nil {
+		t.Fatalf("error setting file times: %s", err)
+	}
+	got, err := mg.MergeFiles("base.yaml", "host.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	want = mustUnmarshal(t, []byte(`
+passwd:
+  users:
+    - name: changed
+    - name: host
+`))
+	if diff := cmp.Diff(want, mustUnmarshal(t, got)); diff != "" {
+		t.Errorf("MergeFiles() after change got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestMergerConcurrent(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml": "storage:\n  files:\n    - path: /etc/motd\n      mode: 420\n    - path: /etc/hosts\n      mode: 420\n",
+		"host.yaml": "storage:\n  files:\n    - path: /etc/issue\n      mode: 384\n",
+	})
+	options := &Options{
+		FilesDir:   dir,
+		Prepend:    []string{"$.storage.files"},
+		ForceQuote: []string{`jsonpath:$.storage.files[?(@.path=="/etc/hosts")].mode`},
+	}
+	want, err := MergeFiles(options, "base.yaml", "host.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	mg := NewMerger(options)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				got, err := mg.MergeFiles("base.yaml", "host.yaml")
+				if err != nil {
+					errs <- err
+					return
+				}
+				if diff := cmp.Diff(string(want), string(got)); diff != "" {
+					errs <- fmt.Errorf("got diff: -want/+got: %s", diff)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("MergeFiles() got err: %s", err)
+	}
+	// Each merge uses a clone, so the shared policy is never modified.
+	if len(mg.policy.used) != 0 {
+		t.Errorf("Merger policy got used patterns %v", mg.policy.used)
+	}
+}
+
+// writeBenchFiles writes a base file of roughly 2000 lines and one overlay per
+// host.
+func writeBenchFiles(b *testing.B, hosts int) (string, []string) {
+	b.Helper()
+	dir := b.TempDir()
+	var base strings.Builder
+	base.WriteString("variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n")
+	for i := 0; i < 400; i++ {
+		fmt.Fprintf(&base, "    - path: /etc/file%d\n      mode: 420\n      contents:\n        inline: content %d\n", i, i)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "base.yaml"), []byte(base.String()), 0o644); err != nil {
+		b.Fatalf("error writing file: %s", err)
+	}
+	var overlays []string
+	for i := 0; i < hosts; i++ {
+		name := fmt.Sprintf("host%d.yaml", i)
+		overlay := fmt.Sprintf("storage:\n  files:\n    - path: /etc/hostname\n      contents:\n        inline: host%d\n", i)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(overlay), 0o644); err != nil {
+			b.Fatalf("error writing file: %s", err)
+		}
+		overlays = append(overlays, name)
+	}
+	return dir, overlays
+}
+
+func BenchmarkMergeFiles(b *testing.B) {
+	dir, overlays := writeBenchFiles(b, 500)
+	options := &Options{FilesDir: dir}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MergeFiles(options, "base.yaml", overlays[i%len(overlays)]); err != nil {
+			b.Fatalf("MergeFiles() got err: %s", err)
+		}
+	}
+}
+
+func BenchmarkMergerMergeFiles(b *testing.B) {
+	dir, overlays := writeBenchFiles(b, 500)
+	mg := NewMerger(&Options{FilesDir: dir})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := mg.MergeFiles("base.yaml", overlays[i%len(overlays)]); err != nil {
+			b.Fatalf("MergeFiles() got err: %s", err)
+		}
+	}
+}
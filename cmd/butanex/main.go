@@ -0,0 +1,186 @@
+// Command butanex merges Butane config fragments into a single config.
+//
+// Usage:
+//
+//	butanex [flags] file...
+//
+// The merged config is written to standard output, or to the file named by
+// -o. With -check, the files are merged and compared with the existing file
+// named by -o instead, and butanex exits with status 1 and prints the
+// differences if it is out of date, so that a generated config committed
+// alongside its fragments can be checked in CI.
+//
+// With -watch, butanex merges the files again whenever one of them, or a
+// template they name, changes, until interrupted. An error merging is printed
+// and the files are still watched, so that a fragment can be fixed in place.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/nveeser/butanex"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command with args and returns its exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("butanex", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	policy := flags.String("policy", "", "merge policy, such as `overwrite=$.storage.files;append=.ssh_authorized_keys`")
+	dir := flags.String("dir", "", "directory the files are relative to")
+	format := flags.String("format", string(butanex.FormatYAML), "output format, yaml or json")
+	output := flags.String("o", "", "file to write the merged config to")
+	check := flags.Bool("check", false, "check that the file named by -o is up to date instead of writing it")
+	watch := flags.Bool("watch", false, "merge the files again whenever one changes, until interrupted")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: butanex [flags] file...\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if *check && *output == "" {
+		fmt.Fprintf(stderr, "butanex: -check requires -o\n")
+		return 2
+	}
+	if *check && *watch {
+		fmt.Fprintf(stderr, "butanex: -check and -watch are exclusive\n")
+		return 2
+	}
+
+	options, err := butanex.ParsePolicySpec(*policy)
+	if err != nil {
+		fmt.Fprintf(stderr, "butanex: %s\n", err)
+		return 2
+	}
+	options.FilesDir = *dir
+	options.OutputFormat = butanex.Format(*format)
+
+	if *check {
+		diff, err := butanex.Check(options, *output, flags.Args()...)
+		if err != nil {
+			fmt.Fprintf(stderr, "butanex: %s\n", err)
+			return 1
+		}
+		if diff != "" {
+			fmt.Fprintf(stdout, "%s\n%s", *output, diff)
+			return 1
+		}
+		return 0
+	}
+
+	merge := func() ([]string, error) {
+		result, err := butanex.MergeFilesResult(options, flags.Args()...)
+		if err != nil {
+			return nil, err
+		}
+		if *output == "" {
+			stdout.Write(result.Output)
+			return result.Files, nil
+		}
+		return result.Files, os.WriteFile(*output, result.Output, 0o644)
+	}
+	if *watch {
+		files := make([]string, flags.NArg())
+		for i, f := range flags.Args() {
+			if !filepath.IsAbs(f) {
+				f = filepath.Join(*dir, f)
+			}
+			files[i] = f
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := watchFiles(ctx, files, merge, stderr); err != nil {
+			fmt.Fprintf(stderr, "butanex: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+	if _, err := merge(); err != nil {
+		fmt.Fprintf(stderr, "butanex: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// debounce is how long watchFiles waits after a change for more changes
+// before merging, as an editor saving a file often changes it several times.
+var debounce = 100 * time.Millisecond
+
+// watchFiles calls merge, and again whenever one of files or of the files
+// merge returns changes, until ctx is done. merge returns the files it read.
+// An error from merge is printed to stderr and the files are still watched.
+//
+// The directory of each file is watched rather than the file, so that a file
+// replaced by renaming another over it, as many editors save, is still seen.
+func watchFiles(ctx context.Context, files []string, merge func() ([]string, error), stderr io.Writer) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	watched := map[string]bool{}
+	dirs := map[string]bool{}
+	track := func(files []string) {
+		for _, f := range files {
+			f = filepath.Clean(f)
+			watched[f] = true
+			dir := filepath.Dir(f)
+			if dirs[dir] {
+				continue
+			}
+			if err := w.Add(dir); err != nil {
+				fmt.Fprintf(stderr, "butanex: %s\n", err)
+				continue
+			}
+			dirs[dir] = true
+		}
+	}
+	remerge := func() {
+		read, err := merge()
+		if err != nil {
+			fmt.Fprintf(stderr, "butanex: %s\n", err)
+			return
+		}
+		track(read)
+	}
+
+	track(files)
+	remerge()
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op != fsnotify.Chmod && watched[filepath.Clean(event.Name)] {
+				timer = time.After(debounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(stderr, "butanex: %s\n", err)
+		case <-timer:
+			timer = nil
+			remerge()
+		}
+	}
+}
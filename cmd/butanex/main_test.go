@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	current := filepath.Join(dir, "current.yaml")
+	stale := filepath.Join(dir, "stale.yaml")
+	if err := os.WriteFile(stale, []byte("variant: fcos\nversion: 1.5.0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"-dir", "../../simple", "input1.yaml", "input2.yaml"}
+	cases := []struct {
+		name       string
+		args       []string
+		wantStatus int
+		wantOut    string
+	}{
+		{
+			name:       "write",
+			args:       append([]string{"-o", current}, files...),
+			wantStatus: 0,
+		},
+		{
+			name:       "check-up-to-date",
+			args:       append([]string{"-check", "-o", current}, files...),
+			wantStatus: 0,
+		},
+		{
+			name:       "check-stale",
+			args:       append([]string{"-check", "-o", stale}, files...),
+			wantStatus: 1,
+			wantOut: stale + "\n" +
+				`+ $.passwd: {"users":[{"name":"user1","ssh_authorized_keys":["key1"]}]}` + "\n" +
+				`+ $.storage: {"files":[{"contents":{"inline":"Hello, world!"},"path":"/opt/file"}]}` + "\n",
+		},
+		{
+			name:       "check-without-output",
+			args:       append([]string{"-check"}, files...),
+			wantStatus: 2,
+		},
+		{
+			name:       "no-files",
+			args:       nil,
+			wantStatus: 2,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if got := run(tc.args, &stdout, &stderr); got != tc.wantStatus {
+				t.Errorf("run() got status %d, want %d: %s", got, tc.wantStatus, stderr.String())
+			}
+			if diff := cmp.Diff(tc.wantOut, stdout.String()); diff != "" {
+				t.Errorf("run() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.yaml")
+	tmpl := filepath.Join(dir, "motd.tmpl")
+	other := filepath.Join(dir, "other.yaml")
+	for _, f := range []string{input, tmpl, other} {
+		if err := os.WriteFile(f, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	merged := make(chan struct{}, 10)
+	fail := true
+	merge := func() ([]string, error) {
+		merged <- struct{}{}
+		if fail {
+			fail = false
+			return nil, errors.New("bad fragment")
+		}
+		return []string{input, tmpl}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var stderr bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- watchFiles(ctx, []string{input}, merge, &stderr)
+	}()
+
+	wait := func(want bool) {
+		t.Helper()
+		select {
+		case <-merged:
+			if !want {
+				t.Fatalf("watchFiles() merged without a change to a watched file")
+			}
+		case <-time.After(10 * debounce):
+			if want {
+				t.Fatalf("watchFiles() did not merge")
+			}
+		}
+	}
+	write := func(f string) {
+		t.Helper()
+		if err := os.WriteFile(f, []byte("variant: fcos\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first merge fails, and the input is still watched.
+	wait(true)
+	write(input)
+	wait(true)
+	// The template read by the second merge is now watched, and changes in
+	// quick succession merge once.
+	write(tmpl)
+	write(tmpl)
+	wait(true)
+	wait(false)
+	write(other)
+	wait(false)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("watchFiles() got err: %s", err)
+	}
+	if want := "butanex: bad fragment\n"; stderr.String() != want {
+		t.Errorf("watchFiles() got stderr %q, want %q", stderr.String(), want)
+	}
+}
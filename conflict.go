@@ -0,0 +1,266 @@
+package butanex
+
+import (
+	"context"
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"strings"
+)
+
+// MergeConflictError reports a key for which a file has a value that conflicts
+// with the value merged from the files before it.
+type MergeConflictError struct {
+	// Path is the context path of the key.
+	Path string
+	// File is the file with the conflicting value.
+	File string
+	// Existing is the merged value and Incoming the value from File.
+	Existing, Incoming any
+	// ExistingPos and IncomingPos are where the values were set, when
+	// Options.TrackPositions is set.
+	ExistingPos, IncomingPos Position
+}
+
+func (e MergeConflictError) Error() string {
+	var msg string
+	existing, _ := kindOf(e.Existing)
+	incoming, _ := kindOf(e.Incoming)
+	if existing != incoming {
+		msg = fmt.Sprintf("key[%s] mismatch: src(%T) vs dst(%T)", e.Path, e.Incoming, e.Existing)
+	} else {
+		msg = fmt.Sprintf("duplicate Keys(overrwrite=false): %s", e.Path)
+	}
+	if e.IncomingPos.IsValid() {
+		msg = e.IncomingPos.String() + ": " + msg
+	}
+	if e.ExistingPos.IsValid() {
+		msg += " (previously set at " + e.ExistingPos.String() + ")"
+	}
+	return msg
+}
+
+// conflict reports that src conflicts with dst at ctxpath. The conflict is
+// returned as an error unless conflicts are being collected.
+func (m *merge) conflict(ctxpath string, dst, src any) error {
+	err := MergeConflictError{Path: ctxpath, File: m.file, Existing: dst, Incoming: src}
+	if m.positions != nil {
+		err.ExistingPos = m.positions.lookup(m.sourceOf(ctxpath), ctxpath)
+		err.IncomingPos = m.positions.lookup(m.file, ctxpath)
+	}
+	if m.conflicts == nil {
+		return err
+	}
+	*m.conflicts = append(*m.conflicts, err)
+	return nil
+}
+
+// markNode marks each conflict collected at a key within n, which is at
+// ctxpath, like a git merge conflict: the merged value is preceded by a
+// comment naming the file that set it, and followed by the conflicting value
+// of each later file as comments.
+func (m *merge) markNode(n *yaml.Node, ctxpath string) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			if err := m.markNode(c, ctxpath); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		// Only the elements merged by key can have conflicts within them.
+		field, keyed := m.policy.mergeByField(ctxpath)
+		if !keyed {
+			field, keyed = m.schema.mergeByField(ctxpath)
+		}
+		for _, c := range n.Content {
+			if value, ok := nodeKey(c, field); keyed && ok {
+				if err := m.markNode(c, elementPath(ctxpath, field, value)); err != nil {
+					return err
+				}
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			cpath := joinPath(ctxpath, key.Value)
+			var foot []string
+			for _, c := range *m.conflicts {
+				if c.Path != cpath {
+					continue
+				}
+				d, err := yaml.Marshal(map[string]any{key.Value: c.Incoming})
+				if err != nil {
+					return fmt.Errorf("error encoding yaml: %w", err)
+				}
+				foot = append(foot, "=======", strings.TrimSuffix(string(d), "\n"), ">>>>>>> "+c.File)
+			}
+			if foot != nil {
+				key.HeadComment = strings.TrimSpace("<<<<<<< " + m.sourceOf(cpath))
+				key.FootComment = strings.Join(foot, "\n")
+			}
+			if err := m.markNode(n.Content[i+1], cpath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nodeKey returns the value of field of the mapping node n, if n is a mapping
+// and the value is a scalar.
+func nodeKey(n *yaml.Node, field string) (string, bool) {
+	if n.Kind != yaml.MappingNode {
+		return "", false
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == field && n.Content[i+1].Kind == yaml.ScalarNode {
+			return n.Content[i+1].Value, true
+		}
+	}
+	return "", false
+}
+
+// ConflictContext describes a conflict for Options.OnConflict to decide.
+type ConflictContext struct {
+	// Path is the context path of the key.
+	Path string
+	// Dst is the merged value and Src the value from the file being merged.
+	Dst, Src any
+	// DstFile is the file that last set Dst and SrcFile the file being
+	// merged.
+	DstFile, SrcFile string
+	// Kind is the kind of Src: "scalar", "mapping" or "sequence". Dst is of
+	// a different kind unless both are scalars.
+	Kind string
+}
+
+// Resolution is the decision of Options.OnConflict for a conflict.
+type Resolution int
+
+const (
+	// ResolveError fails the merge with a MergeConflictError, as without a
+	// callback.
+	ResolveError Resolution = iota
+	// ResolveKeepDst keeps the merged value.
+	ResolveKeepDst
+	// ResolveTakeSrc replaces the merged value with the value being merged.
+	ResolveTakeSrc
+	// ResolveAppend replaces the merged value with a sequence of both
+	// values, with the elements of either value that is a sequence.
+	ResolveAppend
+)
+
+// resolveConflict handles the conflict between dv, the value of key in dst,
+// and sv, which is at ctxpath and depth. The conflict is decided by the
+// OnConflict callback if set, and otherwise reported by conflict.
+func (m *merge) resolveConflict(dst map[string]any, key, ctxpath string, depth int, dv, sv any) error {
+	resolution := ResolveError
+	if m.onConflict != nil {
+		kind, _ := kindOf(sv)
+		var err error
+		resolution, err = m.onConflict(ConflictContext{
+			Path:    ctxpath,
+			Dst:     dv,
+			Src:     sv,
+			DstFile: m.sourceOf(ctxpath),
+			SrcFile: m.file,
+			Kind:    kind.String(),
+		})
+		if err != nil {
+			return fmt.Errorf("key[%s]: %w", ctxpath, err)
+		}
+		if m.resolutions != nil && resolution != ResolveError {
+			m.resolutions[ctxpath] = resolution
+		}
+	}
+	switch resolution {
+	case ResolveKeepDst:
+		return nil
+	case ResolveTakeSrc:
+		m.setSource(ctxpath)
+		m.touch(ctxpath, sv)
+		switch sv := sv.(type) {
+		case map[string]any:
+			dv := make(map[string]any)
+			dst[key] = dv
+			return m.mergeMapping(dv, sv, ctxpath, depth+1)
+		case []any:
+			dst[key] = sv
+			m.elementFiles[ctxpath] = m.repeatFile(len(sv))
+			return m.checkUnique(ctxpath, sv)
+		}
+		dst[key] = sv
+		return nil
+	case ResolveAppend:
+		var seq []any
+		var files []string
+		if dvv, ok := dv.([]any); ok {
+			seq, files = dvv, m.elementFiles[ctxpath]
+		} else {
+			seq, files = []any{dv}, []string{m.sources[ctxpath]}
+		}
+		if svv, ok := sv.([]any); ok {
+			seq = append(seq, svv...)
+			files = append(files, m.repeatFile(len(svv))...)
+		} else {
+			seq = append(seq, sv)
+			files = append(files, m.file)
+		}
+		dst[key] = seq
+		m.elementFiles[ctxpath] = files
+		m.touch(ctxpath, sv)
+		return m.checkUnique(ctxpath, seq)
+	case ResolveError:
+		return m.conflict(ctxpath, dv, sv)
+	}
+	return fmt.Errorf("key[%s]: unknown resolution %d", ctxpath, resolution)
+}
+
+// sourceOf returns the file that last set the key at ctxpath, or the nearest
+// enclosing key that was set, such as the sequence element a key was added
+// with.
+func (m *merge) sourceOf(ctxpath string) string {
+	for {
+		if source, ok := m.sources[ctxpath]; ok {
+			return source
+		}
+		segments := splitPath(ctxpath)
+		if len(segments) == 1 {
+			return ""
+		}
+		last := segments[len(segments)-1]
+		if plain, ok := stripSelectors(last); ok {
+			// The element's sequence is next.
+			ctxpath = ctxpath[:len(ctxpath)-len(last)] + plain
+			continue
+		}
+		ctxpath = ctxpath[:len(ctxpath)-len(last)-1]
+	}
+}
+
+// CanMerge reports whether the files merge without conflicts under options,
+// and every conflict if not. The merge continues past each conflict keeping
+// the existing value, so later conflicts are reported too. No output is
+// produced and the files are only read.
+//
+// CanMerge also returns false if the files cannot be merged for any other
+// reason, such as a missing file, in which case MergeFiles reports the error.
+func CanMerge(options *Options, path ...string) (bool, []MergeConflictError) {
+	if options == nil {
+		options = &Options{}
+	}
+	m, err := newMerge(options, nil)
+	if err != nil {
+		return false, nil
+	}
+	var conflicts []MergeConflictError
+	m.conflicts = &conflicts
+	specs := make([]FileSpec, len(path))
+	for i, p := range path {
+		specs[i] = FileSpec{Path: p}
+	}
+	if err := m.mergeSpecs(context.Background(), specs); err != nil {
+		return false, conflicts
+	}
+	return len(conflicts) == 0, conflicts
+}
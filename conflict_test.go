@@ -0,0 +1,245 @@
+package butanex
+
+import (
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"strings"
+	"testing"
+)
+
+func TestCanMerge(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "variant: fcos\nversion: 1.5.0\nignition: none\nkernel_arguments:\n  should_exist: [quiet]\n",
+		"overlay.yaml": "version: 1.4.0\nignition:\n  config: {}\nkernel_arguments:\n  should_exist: [debug]\n",
+		"clean.yaml":   "variant: fcos\nkernel_arguments:\n  should_exist: [debug]\n",
+	})
+	cases := []struct {
+		name    string
+		options *Options
+		files   []string
+		wantOK  bool
+		want    []MergeConflictError
+	}{
+		{
+			name:    "clean",
+			options: &Options{FilesDir: dir},
+			files:   []string{"base.yaml", "clean.yaml"},
+			wantOK:  true,
+		},
+		{
+			name:    "conflicts",
+			options: &Options{FilesDir: dir},
+			files:   []string{"base.yaml", "overlay.yaml"},
+			want: []MergeConflictError{
+				{Path: "$.ignition", File: "overlay.yaml", Existing: "none", Incoming: map[string]any{"config": map[string]any{}}},
+				{Path: "$.version", File: "overlay.yaml", Existing: "1.5.0", Incoming: "1.4.0"},
+			},
+		},
+		{
+			name:    "overwrite",
+			options: &Options{FilesDir: dir, DefaultOverWrite: true},
+			files:   []string{"base.yaml", "overlay.yaml"},
+			wantOK:  true,
+		},
+		{
+			name:    "missing-file",
+			options: &Options{FilesDir: dir},
+			files:   []string{"base.yaml", "missing.yaml"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, got := CanMerge(tc.options, tc.files...)
+			if ok != tc.wantOK {
+				t.Errorf("CanMerge() got %t, want %t", ok, tc.wantOK)
+			}
+			sortConflicts := cmpopts.SortSlices(func(a, b MergeConflictError) bool { return a.Path < b.Path })
+			if diff := cmp.Diff(tc.want, got, sortConflicts); diff != "" {
+				t.Errorf("CanMerge() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+
+	_, err := MergeFiles(&Options{FilesDir: dir}, "base.yaml", "overlay.yaml")
+	var conflict MergeConflictError
+	if !errors.As(err, &conflict) || conflict.File != "overlay.yaml" {
+		t.Errorf("MergeFiles() got err %v, want a MergeConflictError", err)
+	}
+}
+
+func TestOnConflict(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "variant: fcos\nversion: 1.5.0\nignition: none\nkernel_arguments:\n  should_exist: quiet\n",
+		"overlay.yaml": "version: 1.4.0\nignition:\n  config: {}\nkernel_arguments:\n  should_exist: [debug]\n",
+	})
+	cases := []struct {
+		name    string
+		decide  func(ctx ConflictContext) (Resolution, error)
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "keep-dst",
+			decide: func(ConflictContext) (Resolution, error) { return ResolveKeepDst, nil },
+			want:   "ignition: none\nkernel_arguments:\n    should_exist: quiet\nvariant: fcos\nversion: 1.5.0\n",
+		},
+		{
+			name:   "take-src",
+			decide: func(ConflictContext) (Resolution, error) { return ResolveTakeSrc, nil },
+			want:   "ignition:\n    config: {}\nkernel_arguments:\n    should_exist:\n        - debug\nvariant: fcos\nversion: 1.4.0\n",
+		},
+		{
+			name: "append",
+			decide: func(ctx ConflictContext) (Resolution, error) {
+				if ctx.Kind == "sequence" {
+					return ResolveAppend, nil
+				}
+				return ResolveKeepDst, nil
+			},
+			want: "ignition: none\nkernel_arguments:\n    should_exist:\n        - quiet\n        - debug\nvariant: fcos\nversion: 1.5.0\n",
+		},
+		{
+			name: "by-path",
+			decide: func(ctx ConflictContext) (Resolution, error) {
+				if ctx.Path == "$.version" {
+					return ResolveError, nil
+				}
+				return ResolveKeepDst, nil
+			},
+			wantErr: "duplicate Keys(overrwrite=false): $.version",
+		},
+		{
+			name: "callback-error",
+			decide: func(ctx ConflictContext) (Resolution, error) {
+				return 0, errors.New("no decision")
+			},
+			wantErr: "no decision",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MergeFiles(&Options{FilesDir: dir, OnConflict: tc.decide}, "base.yaml", "overlay.yaml")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestOnConflictContext(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "version: 1.5.0\n",
+		"overlay.yaml": "version: 1.4.0\n",
+	})
+	var got []ConflictContext
+	_, err := MergeFiles(&Options{
+		FilesDir: dir,
+		OnConflict: func(ctx ConflictContext) (Resolution, error) {
+			got = append(got, ctx)
+			return ResolveKeepDst, nil
+		},
+	}, "base.yaml", "overlay.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	want := []ConflictContext{{
+		Path:    "$.version",
+		Dst:     "1.5.0",
+		Src:     "1.4.0",
+		DstFile: "base.yaml",
+		SrcFile: "overlay.yaml",
+		Kind:    "scalar",
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("OnConflict got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestEmitConflictMarkers(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "variant: fcos\nversion: 1.5.0\nkernel_arguments:\n  should_exist: [quiet]\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 420\n",
+		"overlay.yaml": "version: 1.4.0\nkernel_arguments:\n  should_exist: debug\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 384\n",
+		"host.yaml":    "version: 1.6.0\n",
+		"clean.yaml":   "kernel_arguments:\n  should_exist: [debug]\n",
+	})
+	cases := []struct {
+		name    string
+		options Options
+		files   []string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "conflicts",
+			options: Options{MergeBy: map[string]string{"$.storage.files": "path"}},
+			files:   []string{"base.yaml", "overlay.yaml", "host.yaml"},
+			want: `kernel_arguments:
+    # <<<<<<< base.yaml
+    should_exist:
+        - quiet
+    # =======
+    # should_exist: debug
+    # >>>>>>> overlay.yaml
+storage:
+    files:
+        - # <<<<<<< base.yaml
+          mode: 420
+          # =======
+          # mode: 384
+          # >>>>>>> overlay.yaml
+
+          path: /etc/motd
+variant: fcos
+# <<<<<<< base.yaml
+version: 1.5.0
+# =======
+# version: 1.4.0
+# >>>>>>> overlay.yaml
+# =======
+# version: 1.6.0
+# >>>>>>> host.yaml
+`,
+		},
+		{
+			name:  "clean",
+			files: []string{"base.yaml", "clean.yaml"},
+			want:  "kernel_arguments:\n    should_exist:\n        - quiet\n        - debug\nstorage:\n    files:\n        - mode: 420\n          path: /etc/motd\nvariant: fcos\nversion: 1.5.0\n",
+		},
+		{
+			name:    "json",
+			options: Options{OutputFormat: FormatJSON},
+			files:   []string{"base.yaml", "clean.yaml"},
+			wantErr: "EmitConflictMarkers requires YAML output",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			tc.options.EmitConflictMarkers = true
+			got, err := MergeFiles(&tc.options, tc.files...)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+			mustUnmarshal(t, got)
+		})
+	}
+}
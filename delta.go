@@ -0,0 +1,179 @@
+package butanex
+
+import (
+	"context"
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// MergeDelta merges the files like MergeFiles but returns only what the files
+// after the first contributed, as a YAML file that merged after the first
+// file with the same options gives the config merging every file does. This
+// makes a compact overlay of a fully expanded config.
+//
+// A sequence the later files added elements to holds only those elements. A
+// value the merge would not replace, such as a changed scalar or a sequence
+// whose elements changed, carries the merge tag `!overwrite`. A deleted key is
+// null, which must delete it: a key deleted where neither NullDeletes nor
+// DeleteIfNull applies is an error. Values are as merged, so the paths
+// resolved by ResolvePath are resolved already.
+func MergeDelta(options *Options, path ...string) ([]byte, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("no files to take the delta of")
+	}
+	base, err := newMerge(options, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := base.mergeSpecs(context.Background(), []FileSpec{{Path: path[0]}}); err != nil {
+		return nil, err
+	}
+	m, err := newMerge(options, nil)
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]FileSpec, len(path))
+	for i, p := range path {
+		specs[i] = FileSpec{Path: p}
+	}
+	if err := m.mergeSpecs(context.Background(), specs); err != nil {
+		return nil, err
+	}
+	for _, r := range []*merge{base, m} {
+		if r.blobs != nil {
+			r.blobs.restoreValues(r.root)
+		}
+	}
+	// The delta is merged by the global policy, with no markers.
+	m.mergePolicy = m.policy
+	m.strategies = nil
+	overwrite := map[string]bool{}
+	delta, err := m.delta(base.root, m.root, "$", overwrite)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := encodeNode(delta, m.policy, nil)
+	if err != nil {
+		return nil, err
+	}
+	tagOverwrite(doc, "$", overwrite)
+	return yaml.Marshal(doc)
+}
+
+// delta returns the keys of merged, which is at ctxpath, that a file merged
+// into base must hold to give merged. The context path of each key whose
+// value must be tagged to replace that of base is added to overwrite.
+func (m *merge) delta(base, merged map[string]any, ctxpath string, overwrite map[string]bool) (map[string]any, error) {
+	d := map[string]any{}
+	for _, k := range slices.Sorted(maps.Keys(base)) {
+		if _, ok := merged[k]; ok || base[k] == nil {
+			continue
+		}
+		cpath := joinPath(ctxpath, k)
+		if !m.isNullDelete(cpath) {
+			return nil, fmt.Errorf("key[%s] is deleted, but a null would not delete it", cpath)
+		}
+		d[k] = nil
+	}
+	for k, mv := range merged {
+		cpath := joinPath(ctxpath, k)
+		bv := base[k]
+		switch {
+		case reflect.DeepEqual(bv, mv):
+			continue
+		case bv == nil || m.isReplaceSubtree(cpath):
+			d[k] = mv
+			continue
+		}
+		bm, baseMap := bv.(map[string]any)
+		mm, mergedMap := mv.(map[string]any)
+		if baseMap && mergedMap && !m.schema.isSingular(cpath) {
+			sub, err := m.delta(bm, mm, cpath, overwrite)
+			if err != nil {
+				return nil, err
+			}
+			d[k] = sub
+			continue
+		}
+		bs, baseSeq := bv.([]any)
+		ms, mergedSeq := mv.([]any)
+		if baseSeq && mergedSeq {
+			if added, ok := m.addedElements(bs, ms, cpath); ok {
+				d[k] = added
+				continue
+			}
+			if mode, ok := m.sequenceMode(cpath); !ok || mode != modeOverwrite {
+				overwrite[cpath] = true
+			}
+			d[k] = mv
+			continue
+		}
+		if !m.isOverwrite(cpath) {
+			overwrite[cpath] = true
+		}
+		d[k] = mv
+	}
+	return d, nil
+}
+
+// addedElements returns the elements that, merged into the sequence base at
+// ctxpath, give merged, if merged only adds elements to base.
+func (m *merge) addedElements(base, merged []any, ctxpath string) ([]any, bool) {
+	mode, ok := m.sequenceMode(ctxpath)
+	if !ok || len(merged) <= len(base) {
+		return nil, false
+	}
+	var added []any
+	switch n := len(merged) - len(base); {
+	case mode == modeAppend && reflect.DeepEqual(merged[:len(base)], base):
+		added = merged[len(base):]
+	case mode == modePrepend && reflect.DeepEqual(merged[n:], base):
+		added = merged[:n]
+	default:
+		return nil, false
+	}
+	// An element with the key of one in base would be merged into it.
+	field, ok := m.mergeByField(ctxpath)
+	if !ok {
+		field, ok = m.schema.mergeByField(ctxpath)
+	}
+	if ok {
+		for _, a := range added {
+			key, ok := elementKey(a, field)
+			if !ok {
+				continue
+			}
+			for _, b := range base {
+				if v, ok := elementKey(b, field); ok && v == key {
+					return nil, false
+				}
+			}
+		}
+	}
+	return added, true
+}
+
+// tagOverwrite tags the value of each key within n, which is at ctxpath, whose
+// context path is in paths as `!overwrite`.
+func tagOverwrite(n *yaml.Node, ctxpath string, paths map[string]bool) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			tagOverwrite(c, ctxpath, paths)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			cpath := joinPath(ctxpath, n.Content[i].Value)
+			if paths[cpath] {
+				n.Content[i+1].Tag = "!overwrite"
+			}
+			tagOverwrite(n.Content[i+1], cpath, paths)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeDelta(t *testing.T) {
+	base := `variant: fcos
+version: 1.5.0
+passwd:
+  users:
+    - name: core
+      ssh_authorized_keys: [key1]
+storage:
+  files:
+    - path: /etc/motd
+      mode: 420
+  links:
+    - path: /etc/a
+      target: /a
+`
+	cases := []struct {
+		name     string
+		options  Options
+		overlays []string
+		want     string
+	}{
+		{
+			name:     "append",
+			overlays: []string{"passwd:\n  users:\n    - name: admin\n", "storage:\n  files:\n    - path: /etc/hosts\n  directories:\n    - path: /var/a\n"},
+			want:     "passwd:\n    users:\n        - name: admin\nstorage:\n    directories:\n        - path: /var/a\n    files:\n        - path: /etc/hosts\n",
+		},
+		{
+			name:     "prepend",
+			options:  Options{Prepend: []string{"$.storage.files"}},
+			overlays: []string{"storage:\n  files:\n    - path: /etc/hosts\n"},
+			want:     "storage:\n    files:\n        - path: /etc/hosts\n",
+		},
+		{
+			// The policy already overwrites the version.
+			name:     "overwrite-policy",
+			options:  Options{Overwrite: []string{"$.version"}},
+			overlays: []string{"version: 1.6.0\n"},
+			want:     "version: 1.6.0\n",
+		},
+		{
+			name:     "overwrite-tag",
+			overlays: []string{"version: !overwrite 1.6.0\nstorage:\n  links: !overwrite\n    - path: /etc/b\n      target: /b\n"},
+			want:     "storage:\n    links: !overwrite\n        - path: /etc/b\n          target: /b\nversion: !overwrite 1.6.0\n",
+		},
+		{
+			// An element merged by key replaces the whole sequence.
+			name:     "merge-by",
+			options:  Options{MergeBy: map[string]string{"$.passwd.users": "name"}},
+			overlays: []string{"passwd:\n  users:\n    - name: core\n      ssh_authorized_keys: [key2]\n"},
+			want:     "passwd:\n    users: !overwrite\n        - name: core\n          ssh_authorized_keys:\n            - key1\n            - key2\n",
+		},
+		{
+			name:     "delete",
+			options:  Options{NullDeletes: true},
+			overlays: []string{"storage:\n  links: ~\n"},
+			want:     "storage:\n    links: null\n",
+		},
+		{
+			name:     "unchanged",
+			overlays: []string{"variant: fcos\n"},
+			want:     "{}\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string]string{"base.yaml": base}
+			paths := []string{"base.yaml"}
+			for i, overlay := range tc.overlays {
+				name := filepath.Join("overlay", string(rune('a'+i))+".yaml")
+				files[name] = overlay
+				paths = append(paths, name)
+			}
+			dir := writeFiles(t, files)
+			tc.options.FilesDir = dir
+			got, err := MergeDelta(&tc.options, paths...)
+			if err != nil {
+				t.Fatalf("MergeDelta() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MergeDelta() got diff: -want/+got: %s", diff)
+			}
+
+			// The delta merged into the base gives the full merge.
+			if err := os.WriteFile(filepath.Join(dir, "delta.yaml"), got, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			want, err := MergeFiles(&tc.options, paths...)
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			reapplied, err := MergeFiles(&tc.options, "base.yaml", "delta.yaml")
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, want), mustUnmarshal(t, reapplied)); diff != "" {
+				t.Errorf("MergeFiles() of the delta got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestMergeDeltaErrors(t *testing.T) {
+	// The key a is deleted by replacing the mapping with a scalar and then
+	// with another mapping, which no single file can do.
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "metadata:\n  a: 1\n",
+		"scalar.yaml":  "metadata: !overwrite 5\n",
+		"mapping.yaml": "metadata: !overwrite\n  b: 2\n",
+	})
+	options := &Options{FilesDir: dir}
+	_, err := MergeDelta(options, "base.yaml", "scalar.yaml", "mapping.yaml")
+	wantErr := "key[$.metadata.a] is deleted, but a null would not delete it"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("MergeDelta() got err %v wanted %q", err, wantErr)
+	}
+	options.DeleteIfNull = []string{"$.metadata.a"}
+	if _, err := MergeDelta(options, "base.yaml", "scalar.yaml", "mapping.yaml"); err != nil {
+		t.Errorf("MergeDelta() got err: %s", err)
+	}
+	if _, err := MergeDelta(options); err == nil {
+		t.Errorf("MergeDelta() got nil error without files")
+	}
+}
@@ -0,0 +1,123 @@
+package butanex
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	yaml "gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Diff merges the old and new sets of files with the same options and returns
+// a description of how the merged config changed. See DiffConfigs for the
+// format.
+func Diff(options *Options, old, new []string) (string, error) {
+	oldData, err := MergeFiles(options, old...)
+	if err != nil {
+		return "", fmt.Errorf("old: %w", err)
+	}
+	newData, err := MergeFiles(options, new...)
+	if err != nil {
+		return "", fmt.Errorf("new: %w", err)
+	}
+	return DiffConfigs(oldData, newData)
+}
+
+// Check merges the files and compares the result with the existing merged
+// config in the file output, which is read as is rather than relative to
+// FilesDir. It returns the differences in the format of DiffConfigs, which is
+// empty when output is up to date. The comparison is of the parsed configs, so
+// differences in formatting, key order or comments are ignored.
+func Check(options *Options, output string, path ...string) (string, error) {
+	merged, err := MergeFiles(options, path...)
+	if err != nil {
+		return "", err
+	}
+	existing, err := os.ReadFile(output)
+	if err != nil {
+		return "", fmt.Errorf("file[%s]: error reading file: %w", output, err)
+	}
+	return DiffConfigs(existing, merged)
+}
+
+// DiffConfigs compares two YAML configs and returns one line per difference,
+// ordered by path. Each line starts with `+` for an added key or sequence
+// element, `-` for a removed one, or `~` for a changed value, followed by the
+// context path of the value. Sequence elements are identified by index, for
+// example `$.storage.files[1]`. An empty string means the configs are equal.
+func DiffConfigs(old, new []byte) (string, error) {
+	oldConfig, newConfig := map[string]any{}, map[string]any{}
+	if err := yaml.Unmarshal(old, &oldConfig); err != nil {
+		return "", fmt.Errorf("old: error reading yaml: %w", err)
+	}
+	if err := yaml.Unmarshal(new, &newConfig); err != nil {
+		return "", fmt.Errorf("new: error reading yaml: %w", err)
+	}
+	var r diffReporter
+	cmp.Equal(oldConfig, newConfig, cmp.Reporter(&r))
+	return r.String(), nil
+}
+
+// diffReporter is a cmp.Reporter recording each difference by context path.
+type diffReporter struct {
+	path  cmp.Path
+	lines []string
+}
+
+func (r *diffReporter) PushStep(ps cmp.PathStep) {
+	r.path = append(r.path, ps)
+}
+
+func (r *diffReporter) PopStep() {
+	r.path = r.path[:len(r.path)-1]
+}
+
+func (r *diffReporter) Report(rs cmp.Result) {
+	if rs.Equal() {
+		return
+	}
+	vx, vy := r.path.Last().Values()
+	switch {
+	case !vx.IsValid():
+		r.lines = append(r.lines, fmt.Sprintf("+ %s: %s", r.contextPath(), formatValue(vy)))
+	case !vy.IsValid():
+		r.lines = append(r.lines, fmt.Sprintf("- %s: %s", r.contextPath(), formatValue(vx)))
+	default:
+		r.lines = append(r.lines, fmt.Sprintf("~ %s: %s -> %s", r.contextPath(), formatValue(vx), formatValue(vy)))
+	}
+}
+
+func (r *diffReporter) contextPath() string {
+	ctxpath := "$"
+	for _, ps := range r.path {
+		switch ps := ps.(type) {
+		case cmp.MapIndex:
+			ctxpath = joinPath(ctxpath, fmt.Sprint(ps.Key()))
+		case cmp.SliceIndex:
+			i, _ := ps.SplitKeys()
+			if i < 0 {
+				_, i = ps.SplitKeys()
+			}
+			ctxpath += fmt.Sprintf("[%d]", i)
+		}
+	}
+	return ctxpath
+}
+
+func (r *diffReporter) String() string {
+	if len(r.lines) == 0 {
+		return ""
+	}
+	return strings.Join(r.lines, "\n") + "\n"
+}
+
+// formatValue renders v on a single line.
+func formatValue(v reflect.Value) string {
+	d, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprintf("%v", v.Interface())
+	}
+	return string(d)
+}
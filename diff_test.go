@@ -0,0 +1,110 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	cases := []struct {
+		name    string
+		options *Options
+		old     []string
+		new     []string
+		want    string
+	}{
+		{
+			name:    "equal",
+			options: &Options{FilesDir: "./simple"},
+			old:     []string{"input1.yaml", "input2.yaml"},
+			new:     []string{"input1.yaml", "input2.yaml"},
+			want:    "",
+		},
+		{
+			name:    "added-key",
+			options: &Options{FilesDir: "./simple"},
+			old:     []string{"input1.yaml"},
+			new:     []string{"input1.yaml", "input2.yaml"},
+			want:    `+ $.storage: {"files":[{"contents":{"inline":"Hello, world!"},"path":"/opt/file"}]}` + "\n",
+		},
+		{
+			name:    "removed-key",
+			options: &Options{FilesDir: "./simple"},
+			old:     []string{"input1.yaml", "input2.yaml"},
+			new:     []string{"input1.yaml"},
+			want:    `- $.storage: {"files":[{"contents":{"inline":"Hello, world!"},"path":"/opt/file"}]}` + "\n",
+		},
+		{
+			name:    "changed-scalar",
+			options: &Options{FilesDir: "./overwrite", DefaultOverWrite: true},
+			old:     []string{"input1.yaml"},
+			new:     []string{"input1.yaml", "input2.yaml"},
+			want:    `~ $.storage.files[0].contents.inline: "Hello, world!" -> "Not Hello World"` + "\n",
+		},
+		{
+			name:    "appended-element",
+			options: &Options{FilesDir: "./overwrite"},
+			old:     []string{"input1.yaml"},
+			new:     []string{"input1.yaml", "input2.yaml"},
+			want:    `+ $.storage.files[1]: {"contents":{"inline":"Not Hello World"},"path":"/opt/file"}` + "\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Diff(tc.options, tc.old, tc.new)
+			if err != nil {
+				t.Fatalf("Diff() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Diff() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	reordered := filepath.Join(dir, "reordered.yaml")
+	stale := filepath.Join(dir, "stale.json")
+	if err := os.WriteFile(reordered, []byte("# generated\nstorage: {files: [{path: /opt/file, contents: {inline: 'Hello, world!'}}]}\nversion: 1.5.0\nvariant: fcos\npasswd:\n  users:\n  - name: user1\n    ssh_authorized_keys: [key1]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte(`{"variant": "fcos", "version": "1.5.0", "passwd": {"users": [{"name": "user1", "ssh_authorized_keys": ["key1"]}]}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		output  string
+		want    string
+		wantErr string
+	}{
+		{name: "up-to-date", output: "simple/want.yaml"},
+		{name: "formatting-differs", output: reordered},
+		{
+			name:   "stale",
+			output: stale,
+			want:   `+ $.storage: {"files":[{"contents":{"inline":"Hello, world!"},"path":"/opt/file"}]}` + "\n",
+		},
+		{name: "missing", output: filepath.Join(dir, "missing.yaml"), wantErr: "missing.yaml"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Check(&Options{FilesDir: "./simple"}, tc.output, "input1.yaml", "input2.yaml")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("Check() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Check() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Check() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
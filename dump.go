@@ -0,0 +1,115 @@
+package butanex
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// DumpPolicy returns the policy built from options as text, for debugging
+// patterns that do not apply as expected. Each table lists its patterns as
+// normalized, such as `storage.files` made absolute as `$.storage.files`, with
+// the kind of each pattern. In a table listing a policy for each pattern, the
+// patterns are in the order they are tried, and the first that matches a key
+// decides its policy: a query comes before an absolute pattern, which comes
+// before a relative pattern, which comes before a pattern with descent. The
+// other tables apply to a key any of their patterns matches, and keep the
+// order given. Tables without patterns are left out.
+func DumpPolicy(options *Options) (string, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	expanded, err := expandAliases(options)
+	if err != nil {
+		return "", err
+	}
+	if err := checkQueries(expanded); err != nil {
+		return "", err
+	}
+	return buildPolicy(expanded).String(), nil
+}
+
+// String returns the policy as text, as described by DumpPolicy.
+func (p *mergePolicy) String() string {
+	var b strings.Builder
+	defaultSequence := p.defaultSequence
+	if defaultSequence == "" {
+		defaultSequence = "(DefaultOverWrite)"
+	}
+	fmt.Fprintf(&b, "DefaultOverWrite: %t\n", p.defaultOverwrite)
+	fmt.Fprintf(&b, "DefaultSequencePolicy: %s\n", defaultSequence)
+	fmt.Fprintf(&b, "NullDeletes: %t\n", p.nullDeletes)
+	if p.sealDepth > 0 {
+		fmt.Fprintf(&b, "SealDepth: %d\n", p.sealDepth)
+	}
+	dumpTable(&b, "Overwrite, Append, Prepend", p.modes, func(mode mergeMode) string { return modeNames[mode] })
+	dumpTable(&b, "UniqueBy", p.uniqueBy, strconv.Quote)
+	dumpTable(&b, "MergeBy", p.mergeBy, strconv.Quote)
+	dumpTable(&b, "RenameKeys", p.renameKeys, strconv.Quote)
+	dumpTable(&b, "MaxSequenceLen", p.maxSequenceLen, strconv.Itoa)
+	dumpTable(&b, "ForceQuote, ForceUnquote", p.quote, func(quote bool) string {
+		if quote {
+			return "quote"
+		}
+		return "unquote"
+	})
+	for _, table := range []struct {
+		name    string
+		entries []policyEntry[bool]
+	}{
+		{"DeleteIfNull", p.deleteIfNull},
+		{"AllowedNewKeys", p.allowedNewKeys},
+		{"ResolvePath", p.resolvePaths},
+		{"Ignore", p.ignore},
+		{"ReplaceSubtree", p.replaceSubtree},
+		{"CoerceScalarToSequence", p.coerceToSequence},
+		{"ListFields", p.listFields},
+		{"ConcatInline", p.concatInline},
+		{"LiteralStyle", p.literalStyle},
+		{"KeepEmpty", p.keepEmpty},
+		{"SortSequences", p.sortSequences},
+		{"StringFields", p.stringFields},
+	} {
+		dumpTable(&b, table.name, table.entries, nil)
+	}
+	return b.String()
+}
+
+// dumpTable writes the entries of the table named name to b, each with its
+// policy as given by format, if not nil.
+func dumpTable[T comparable](b *strings.Builder, name string, entries []policyEntry[T], format func(T) string) {
+	if len(entries) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "%s:\n", name)
+	w := tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
+	for i, e := range entries {
+		fmt.Fprintf(w, "  %d\t%s\t", i+1, e.pattern)
+		if format != nil {
+			fmt.Fprintf(w, "%s\t", format(e.policy))
+		}
+		fmt.Fprintf(w, "%s\n", e.kind())
+	}
+	w.Flush()
+}
+
+// kind returns the kind of the entry's pattern: "query", "descent",
+// "relative" or "absolute", and whether it ignores case.
+func (e policyEntry[T]) kind() string {
+	var kind string
+	switch {
+	case e.query != nil:
+		kind = "query"
+	case e.descent:
+		kind = "descent"
+	case e.isRelative:
+		kind = "relative"
+	default:
+		kind = "absolute"
+	}
+	if e.foldCase {
+		kind += ", ignoring case"
+	}
+	return kind
+}
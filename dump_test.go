@@ -0,0 +1,55 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"strings"
+	"testing"
+)
+
+func TestDumpPolicy(t *testing.T) {
+	options := &Options{
+		Overwrite:      []string{".mode", "storage.files", "$..user", `jsonpath:$.systemd.units[?(@.name=="a.service")].enabled`},
+		Append:         []string{"$.passwd.users", "@keys"},
+		PatternAliases: map[string]string{"@keys": ".ssh_authorized_keys"},
+		MergeBy:        map[string]string{"$.storage.files": "path"},
+		MaxSequenceLen: map[string]int{".ssh_authorized_keys": 10},
+		ForceQuote:     []string{".version"},
+		ForceUnquote:   []string{".mode"},
+		ResolvePath:    []string{".local", "$.storage.files.contents.source"},
+		NullDeletes:    true,
+	}
+	got, err := DumpPolicy(options)
+	if err != nil {
+		t.Fatalf("DumpPolicy() got err: %s", err)
+	}
+	want := `DefaultOverWrite: false
+DefaultSequencePolicy: (DefaultOverWrite)
+NullDeletes: true
+Overwrite, Append, Prepend:
+  1  jsonpath:$.systemd.units[?(@.name=="a.service")].enabled  overwrite  query
+  2  $.storage.files                                           overwrite  absolute
+  3  $.passwd.users                                            append     absolute
+  4  .mode                                                     overwrite  relative
+  5  .ssh_authorized_keys                                      append     relative
+  6  $..user                                                   overwrite  descent
+MergeBy:
+  1  $.storage.files  "path"  absolute
+MaxSequenceLen:
+  1  .ssh_authorized_keys  10  relative
+ForceQuote, ForceUnquote:
+  1  .version  quote    relative
+  2  .mode     unquote  relative
+ResolvePath:
+  1  .local                           relative
+  2  $.storage.files.contents.source  absolute
+`
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("DumpPolicy() got diff: -want/+got: %s", diff)
+	}
+
+	_, err = DumpPolicy(&Options{Append: []string{"@undefined"}})
+	wantErr := "pattern \"@undefined\" uses the undefined alias @undefined"
+	if err == nil || !strings.Contains(err.Error(), wantErr) {
+		t.Errorf("DumpPolicy() got err %v wanted %q", err, wantErr)
+	}
+}
@@ -0,0 +1,77 @@
+package butanex
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// MergeGlob merges every file matching pattern, which is interpreted relative
+// to Options.FilesDir.
+//
+// Matches are merged in lexical order unless Options.GlobOrder is set. As with
+// MergeFiles, order matters: when keys are overwritten, later files win. A
+// pattern matching more than Options.MaxFiles files is an error.
+func MergeGlob(options *Options, pattern string) ([]byte, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	matches, err := filepath.Glob(filepath.Join(options.FilesDir, pattern))
+	if err != nil {
+		return nil, fmt.Errorf("glob[%s]: %w", pattern, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("glob[%s]: no files matched", pattern)
+	}
+	if options.MaxFiles > 0 && len(matches) > options.MaxFiles {
+		return nil, fmt.Errorf("glob[%s]: %d files matched, more than MaxFiles of %d", pattern, len(matches), options.MaxFiles)
+	}
+	for i, match := range matches {
+		if matches[i], err = filepath.Rel(options.FilesDir, match); err != nil {
+			return nil, fmt.Errorf("glob[%s]: %w", pattern, err)
+		}
+	}
+	if options.GlobOrder != nil {
+		slices.SortStableFunc(matches, options.GlobOrder)
+	} else {
+		slices.Sort(matches)
+	}
+	return MergeFiles(options, matches...)
+}
+
+// MergeEnv merges the file base and then its overlay for the environment env,
+// if there is one. The overlay is named like base with env inserted before the
+// extension, so the overlay of `base.bu` for `prod` is `base.prod.bu`. Both
+// are interpreted relative to Options.FilesDir.
+//
+// A missing overlay is skipped, and a missing base is an error unless
+// Options.IgnoreMissing is set. Either way one of them must exist.
+func MergeEnv(options *Options, base, env string) ([]byte, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	ext := filepath.Ext(base)
+	overlay := strings.TrimSuffix(base, ext) + "." + env + ext
+	var files []string
+	for _, path := range []string{base, overlay} {
+		local := path
+		if !filepath.IsAbs(local) {
+			local = filepath.Join(options.FilesDir, local)
+		}
+		_, err := os.Stat(local)
+		switch {
+		case err == nil:
+			files = append(files, path)
+		case !errors.Is(err, fs.ErrNotExist) || path == base && !options.IgnoreMissing:
+			return nil, fmt.Errorf("file[%s]: error reading file: %w", path, err)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("env[%s]: neither %s nor %s exists", env, base, overlay)
+	}
+	return MergeFiles(options, files...)
+}
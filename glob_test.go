@@ -0,0 +1,143 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeGlob(t *testing.T) {
+	cases := []struct {
+		name    string
+		options *Options
+		pattern string
+		want    string
+	}{
+		{
+			name: "lexical",
+			options: &Options{
+				FilesDir:         "./overwrite",
+				DefaultOverWrite: true,
+			},
+			pattern: "input*.yaml",
+			want:    "overwrite/want.yaml",
+		},
+		{
+			name: "reverse",
+			options: &Options{
+				FilesDir:         "./overwrite",
+				DefaultOverWrite: true,
+				GlobOrder: func(a, b string) int {
+					return strings.Compare(b, a)
+				},
+			},
+			pattern: "input*.yaml",
+			want:    "overwrite/input1.yaml",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			want, err := os.ReadFile(filepath.FromSlash(tc.want))
+			if err != nil {
+				t.Fatalf("error reading want file: %s", err)
+			}
+			got, err := MergeGlob(tc.options, tc.pattern)
+			if err != nil {
+				t.Fatalf("MergeGlob() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, want), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeGlob() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestMergeGlobNoMatch(t *testing.T) {
+	if _, err := MergeGlob(&Options{FilesDir: "./simple"}, "*.json"); err == nil {
+		t.Errorf("MergeGlob() got nil error for pattern matching no files")
+	}
+}
+
+func TestMergeGlobMaxFiles(t *testing.T) {
+	_, err := MergeGlob(&Options{FilesDir: "./overwrite", MaxFiles: 1}, "input*.yaml")
+	want := "glob[input*.yaml]: 2 files matched, more than MaxFiles of 1"
+	if err == nil || err.Error() != want {
+		t.Errorf("MergeGlob() got err %v wanted %q", err, want)
+	}
+	if _, err := MergeGlob(&Options{FilesDir: "./overwrite", DefaultOverWrite: true, MaxFiles: 2}, "input*.yaml"); err != nil {
+		t.Errorf("MergeGlob() got err: %s", err)
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.bu":         "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n",
+		"base.prod.bu":    "passwd:\n  users:\n    - name: ops\n",
+		"staging.test.bu": "storage:\n  files:\n    - path: /etc/staging\n",
+	})
+	cases := []struct {
+		name    string
+		options *Options
+		base    string
+		env     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "overlay",
+			base: "base.bu",
+			env:  "prod",
+			want: "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n    - name: ops\n",
+		},
+		{
+			name: "no-overlay",
+			base: "base.bu",
+			env:  "staging",
+			want: "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n",
+		},
+		{
+			name:    "no-base",
+			base:    "staging.bu",
+			env:     "test",
+			wantErr: "file[staging.bu]: error reading file: ",
+		},
+		{
+			name:    "no-base-ignore-missing",
+			options: &Options{IgnoreMissing: true},
+			base:    "staging.bu",
+			env:     "test",
+			want:    "storage:\n  files:\n    - path: /etc/staging\n",
+		},
+		{
+			name:    "neither",
+			options: &Options{IgnoreMissing: true},
+			base:    "staging.bu",
+			env:     "prod",
+			wantErr: "env[prod]: neither staging.bu nor staging.prod.bu exists",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := &Options{}
+			if tc.options != nil {
+				options = tc.options
+			}
+			options.FilesDir = dir
+			got, err := MergeEnv(options, tc.base, tc.env)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Errorf("MergeEnv() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeEnv() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeEnv() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package butanex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"slices"
+)
+
+// MergeGroups merges each named group of files independently and returns the
+// results as a single multi-document YAML stream, one document per group.
+//
+// Documents are ordered by group name and each is preceded by a comment naming
+// its group. Every group is merged with the same options, and an error in any
+// group fails the whole call. Only YAML output is supported, so a Marshaler
+// is rejected.
+func MergeGroups(options *Options, groups map[string][]string) ([]byte, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	if options.OutputFormat != "" && options.OutputFormat != FormatYAML {
+		return nil, fmt.Errorf("unsupported output format for groups: %q", options.OutputFormat)
+	}
+	if options.Marshaler != nil {
+		return nil, fmt.Errorf("a Marshaler is not supported for groups")
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	var held []*blobs
+	for _, name := range names {
+		specs := make([]FileSpec, len(groups[name]))
+		for i, p := range groups[name] {
+			specs[i] = FileSpec{Path: p}
+		}
+		m, err := newMerge(options, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.mergeSpecs(context.Background(), specs); err != nil {
+			return nil, fmt.Errorf("group[%s]: %w", name, err)
+		}
+		doc, err := encodeNode(m.root, m.policy, m.annotations())
+		if err != nil {
+			return nil, fmt.Errorf("group[%s]: %w", name, err)
+		}
+		if m.markConflicts {
+			if err := m.markNode(doc, "$"); err != nil {
+				return nil, fmt.Errorf("group[%s]: %w", name, err)
+			}
+		}
+		if m.blobs != nil {
+			held = append(held, m.blobs)
+		}
+		doc.HeadComment = name
+		if err := enc.Encode(doc); err != nil {
+			return nil, fmt.Errorf("group[%s]: error encoding yaml: %w", name, err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("error encoding yaml: %w", err)
+	}
+	out := buf.Bytes()
+	for _, b := range held {
+		out = b.restore(out)
+	}
+	return out, nil
+}
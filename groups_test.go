@@ -0,0 +1,58 @@
+package butanex
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	yaml "gopkg.in/yaml.v3"
+	"io"
+	"testing"
+)
+
+func TestMergeGroups(t *testing.T) {
+	got, err := MergeGroups(&Options{FilesDir: "."}, map[string][]string{
+		"host-b": {"overwrite/input1.yaml"},
+		"host-a": {"simple/input1.yaml", "simple/input2.yaml"},
+	})
+	if err != nil {
+		t.Fatalf("MergeGroups() got err: %s", err)
+	}
+
+	var docs []map[string]any
+	dec := yaml.NewDecoder(bytes.NewReader(got))
+	for {
+		doc := map[string]any{}
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Decode() got err: %s", err)
+		}
+		docs = append(docs, doc)
+	}
+	want := []map[string]any{
+		mustUnmarshal(t, mustReadFile(t, "simple/want.yaml")),
+		mustUnmarshal(t, mustReadFile(t, "overwrite/input1.yaml")),
+	}
+	if diff := cmp.Diff(want, docs); diff != "" {
+		t.Errorf("MergeGroups() got diff: -want/+got: %s", diff)
+	}
+	if !bytes.HasPrefix(got, []byte("# host-a\n")) {
+		t.Errorf("MergeGroups() got first document without group comment")
+	}
+}
+
+func TestMergeGroupsMarshaler(t *testing.T) {
+	options := &Options{
+		FilesDir:  ".",
+		Marshaler: func(root map[string]any) ([]byte, error) { return nil, nil },
+	}
+	_, err := MergeGroups(options, map[string][]string{
+		"host-a": {"simple/input1.yaml"},
+	})
+	wantErr := "a Marshaler is not supported for groups"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("MergeGroups() got err %v wanted %q", err, wantErr)
+	}
+}
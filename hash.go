@@ -0,0 +1,43 @@
+package butanex
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// MergeHash merges the files like MergeFiles and returns the SHA-256 of the
+// merged config, in hex, for caching what is built from it. The hash is of
+// the config rather than of its serialization, so files that differ only in
+// the order of keys, in comments, in quoting or in how a number is written
+// merge to the same hash, as do YAML and JSON files holding the same config.
+// The order of sequence elements is part of the config. Options that only
+// affect the output, such as OutputFormat and LiteralStyle, do not count.
+func MergeHash(options *Options, path ...string) (string, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	m, err := newMerge(options, nil)
+	if err != nil {
+		return "", err
+	}
+	specs := make([]FileSpec, len(path))
+	for i, p := range path {
+		specs[i] = FileSpec{Path: p}
+	}
+	if err := m.mergeSpecs(context.Background(), specs); err != nil {
+		return "", err
+	}
+	if m.blobs != nil {
+		m.blobs.restoreValues(m.root)
+	}
+	// Encoding JSON sorts the keys of mappings.
+	d, err := json.Marshal(m.root)
+	if err != nil {
+		return "", fmt.Errorf("error hashing config: %w", err)
+	}
+	sum := sha256.Sum256(d)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,54 @@
+package butanex
+
+import (
+	"testing"
+)
+
+func TestMergeHash(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":      "variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 0644\n",
+		"overlay.yaml":   "passwd:\n  users:\n    - name: core\n      groups: [wheel]\n",
+		"reordered.yaml": "# The same base.\nstorage:\n  files:\n    - mode: 420\n      path: \"/etc/motd\"\nversion: '1.5.0'\nvariant: fcos\n",
+		"overlay.json":   `{"passwd": {"users": [{"groups": ["wheel"], "name": "core"}]}}`,
+		"changed.yaml":   "passwd:\n  users:\n    - name: core\n      groups: [docker]\n",
+		"swapped.yaml":   "passwd:\n  users:\n    - name: admin\n",
+	})
+	options := &Options{FilesDir: dir}
+	hash := func(path ...string) string {
+		t.Helper()
+		h, err := MergeHash(options, path...)
+		if err != nil {
+			t.Fatalf("MergeHash() got err: %s", err)
+		}
+		return h
+	}
+	want := hash("base.yaml", "overlay.yaml")
+	if len(want) != 64 {
+		t.Errorf("MergeHash() got %q, want a hex SHA-256", want)
+	}
+	for _, files := range [][]string{
+		{"reordered.yaml", "overlay.yaml"},
+		{"base.yaml", "overlay.json"},
+		{"reordered.yaml", "overlay.json"},
+	} {
+		if got := hash(files...); got != want {
+			t.Errorf("MergeHash(%v) got %s, want %s", files, got, want)
+		}
+	}
+	for _, files := range [][]string{
+		{"base.yaml", "changed.yaml"},
+		{"base.yaml", "overlay.yaml", "swapped.yaml"},
+		{"base.yaml", "swapped.yaml", "overlay.yaml"},
+	} {
+		if got := hash(files...); got == want {
+			t.Errorf("MergeHash(%v) got the hash of base.yaml and overlay.yaml", files)
+		}
+	}
+	if a, b := hash("base.yaml", "overlay.yaml", "swapped.yaml"), hash("base.yaml", "swapped.yaml", "overlay.yaml"); a == b {
+		t.Errorf("MergeHash() got the same hash for sequences in a different order")
+	}
+	options.OutputFormat = FormatJSON
+	if got := hash("base.yaml", "overlay.yaml"); got != want {
+		t.Errorf("MergeHash() with OutputFormat got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package butanex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity is how serious a LintFinding is.
+type Severity int
+
+const (
+	// SeverityWarning is a finding that is only reported.
+	SeverityWarning Severity = iota
+	// SeverityError is a finding that fails the merge when
+	// Options.FailOnLintError is set.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// LintFinding is a problem an Options.LintRules rule found in the merged
+// config.
+type LintFinding struct {
+	// Path is the context path of the value the finding is about, such as
+	// `$.storage.files[path=/etc/motd].mode`.
+	Path     string
+	Severity Severity
+	Message  string
+}
+
+func (f LintFinding) String() string {
+	return fmt.Sprintf("key[%s] %s: %s", f.Path, f.Severity, f.Message)
+}
+
+// LintError reports the findings of SeverityError that failed a merge, in the
+// order they were found.
+type LintError struct {
+	Findings []LintFinding
+}
+
+func (e LintError) Error() string {
+	lines := make([]string, len(e.Findings))
+	for i, f := range e.Findings {
+		lines[i] = f.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lint runs the lint rules on the merged config, recording their findings. It
+// returns a LintError if failing on errors and any finding is an error.
+func (m *merge) lint() error {
+	var errs []LintFinding
+	for _, rule := range m.lintRules {
+		// A rule sees the values as written, and may not change the merge.
+		root := deepCopy(m.root).(map[string]any)
+		if m.blobs != nil {
+			m.blobs.restoreValues(root)
+		}
+		for _, f := range rule(root) {
+			m.findings = append(m.findings, f)
+			if f.Severity == SeverityError {
+				errs = append(errs, f)
+			}
+		}
+	}
+	if m.failOnLint && len(errs) > 0 {
+		return LintError{Findings: errs}
+	}
+	return nil
+}
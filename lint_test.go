@@ -0,0 +1,103 @@
+package butanex
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+// worldWritable flags each file whose mode lets anyone write it, and warns of
+// each file without a mode.
+func worldWritable(root map[string]any) []LintFinding {
+	storage, _ := root["storage"].(map[string]any)
+	files, _ := storage["files"].([]any)
+	var findings []LintFinding
+	for _, f := range files {
+		f, _ := f.(map[string]any)
+		path := elementPath("$.storage.files", "path", f["path"])
+		switch mode, ok := f["mode"].(int); {
+		case !ok:
+			findings = append(findings, LintFinding{Path: path, Severity: SeverityWarning, Message: "has no mode"})
+		case mode&0o002 != 0:
+			findings = append(findings, LintFinding{Path: joinPath(path, "mode"), Severity: SeverityError, Message: fmt.Sprintf("%#o is world-writable", mode)})
+		}
+		// Changes are not merged.
+		delete(f, "mode")
+	}
+	return findings
+}
+
+func TestLintRules(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":     "storage:\n  files:\n    - path: /etc/motd\n      mode: 0644\n",
+		"nomode.yaml":   "storage:\n  files:\n    - path: /etc/issue\n",
+		"writable.yaml": "storage:\n  files:\n    - path: /etc/hosts\n      mode: 0666\n",
+	})
+	cases := []struct {
+		name     string
+		fail     bool
+		files    []string
+		want     []LintFinding
+		wantErrs []LintFinding
+	}{
+		{
+			name:  "clean",
+			files: []string{"base.yaml"},
+		},
+		{
+			name:  "warning",
+			fail:  true,
+			files: []string{"base.yaml", "nomode.yaml"},
+			want:  []LintFinding{{Path: "$.storage.files[path=/etc/issue]", Severity: SeverityWarning, Message: "has no mode"}},
+		},
+		{
+			name:  "error",
+			files: []string{"base.yaml", "nomode.yaml", "writable.yaml"},
+			want: []LintFinding{
+				{Path: "$.storage.files[path=/etc/issue]", Severity: SeverityWarning, Message: "has no mode"},
+				{Path: "$.storage.files[path=/etc/hosts].mode", Severity: SeverityError, Message: "0666 is world-writable"},
+			},
+		},
+		{
+			name:     "fail-on-error",
+			fail:     true,
+			files:    []string{"base.yaml", "nomode.yaml", "writable.yaml"},
+			wantErrs: []LintFinding{{Path: "$.storage.files[path=/etc/hosts].mode", Severity: SeverityError, Message: "0666 is world-writable"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := &Options{
+				FilesDir:        dir,
+				LintRules:       []func(map[string]any) []LintFinding{worldWritable},
+				FailOnLintError: tc.fail,
+			}
+			got, err := MergeFilesResult(options, tc.files...)
+			if tc.wantErrs != nil {
+				var lintErr LintError
+				if !errors.As(err, &lintErr) {
+					t.Fatalf("MergeFilesResult() got err %v, want a LintError", err)
+				}
+				if diff := cmp.Diff(tc.wantErrs, lintErr.Findings); diff != "" {
+					t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFilesResult() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got.Findings); diff != "" {
+				t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+			}
+			if _, ok := mustUnmarshal(t, got.Output)["storage"].(map[string]any)["files"].([]any)[0].(map[string]any)["mode"]; !ok {
+				t.Errorf("MergeFilesResult() got output without the mode a rule deleted: %s", got.Output)
+			}
+		})
+	}
+
+	_, err := MergeFiles(&Options{FilesDir: dir, LintRules: []func(map[string]any) []LintFinding{worldWritable}, FailOnLintError: true}, "writable.yaml")
+	if want := "key[$.storage.files[path=/etc/hosts].mode] error: 0666 is world-writable"; err == nil || err.Error() != want {
+		t.Errorf("MergeFiles() got err %v wanted %q", err, want)
+	}
+}
@@ -7,130 +7,1943 @@
 package butanex
 
 import (
+	"bytes"
 	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	yaml "gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
 	"os"
 	"path/filepath"
 	"reflect"
 	"slices"
 	"strings"
+	"time"
 )
 
+// DefaultMaxDepth is the maximum nesting of an input file when
+// Options.MaxDepth is not set. It is far deeper than any real config.
+const DefaultMaxDepth = 100
+
 // Options configure merge behavior for a given key within a YAML mapping node
 // (ie a struct field).
 //
-// Each of the slice fields (ResolvePath, Overwrite, Append) should contain 0 or
-// more patterns to apply this behavior to specific keys in a given YAML object.
+// Each of the slice fields (ResolvePath, Overwrite, Append, Prepend) should
+// contain 0 or more patterns to apply this behavior to specific keys in a given YAML object.
 // Each pattern is a string that matches a context path for example
 // `$.storage.files.path`. A pattern can be relative or absolute. A relative
 // pattern matches any context path with the same suffix. An absolute pattern
-// matches the whole context key. Precedence for patterns is absolute, then
-// relative then default.
+// matches the whole context key. Within a pattern, `..` matches any number of
+// keys, so `$..mode` matches the key mode at any depth but not the key
+// automode, and `$.storage..mode` matches it anywhere under storage.
+// Precedence for patterns is absolute, then relative, then patterns with `..`
+// and then default. A dot or backslash that is part of a key is escaped
+// with a backslash, so the key `example.com/owner` under `metadata` has the
+// context path `$.metadata.example\.com/owner`.
+//
+// A pattern with the prefix `jsonpath:` is instead a JSONPath query, which can
+// select sequence elements by index or by the value of a field, such as
+// `jsonpath:$.storage.files[?(@.path=="/etc/hosts")].mode`. Queries take
+// precedence over absolute patterns. A query is made of key, `..`, `*`, index,
+// slice and filter steps, as in JSONPath.
+//
+// A null value (`key:` or `key: null`) in the merged config is treated as if
+// the key were missing, so any later value for the key replaces it. A null
+// value in the file being merged is a scalar like any other by default: it
+// conflicts with an existing value unless the key is overwritten, in which
+// case the key is set to null. When NullDeletes is set, a null value instead
+// deletes the key from the merged config, and is a no-op for a missing key.
+// DeleteIfNull scopes the same behavior to the keys matching its patterns.
+//
+// Overwrite, Append and Prepend share a single table of patterns and the same
+// precedence: for a given context path the first matching pattern decides, and
+// the same pattern may not appear in more than one of them. Between matching
+// patterns of the same precedence the most specific decides, the one naming
+// the most keys and selectors, so `.contents.local` wins over `.local`,
+// `$.storage.files[path=/etc/motd].mode` over `$.storage.files.mode` and
+// `$.storage..mode` over `$..mode`. Between patterns equally specific, and
+// between queries, the first declared decides: those of Overwrite, then
+// Append, then Prepend, each in order. Patterns given as the keys of a map,
+// as in MergeBy, are declared in the order of the keys. Append merges a
+// sequence by adding the incoming elements after the existing ones, Prepend
+// adds them before. For scalars Append and Prepend are equivalent: a
+// conflicting value is an error. A value of a different kind than the existing
+// one, such as a mapping replacing a scalar, is an error unless the key is
+// overwritten, in which case the new value replaces the old one wholesale.
+//
+// A pattern of Overwrite, Append or Prepend matches the context path of the
+// key it applies to, such as `$.storage.files` for the files of storage.
+// Earlier versions matched the path of the mapping holding the key instead,
+// such as `$.storage`, so a pattern written that way no longer applies to the
+// keys of the mapping, and must name the keys themselves.
+//
+// StrategyKey names an optional marker key that may appear in any mapping of an
+// input file, for example `x-merge: append`. Its value ("append", "prepend" or
+// "overwrite") overrides the configured policy for the keys of that mapping
+// while merging that file, and the marker is removed from the output.
+//
+// A value in a YAML input file may also carry a merge tag, `!append`,
+// `!prepend` or `!overwrite`, as in `units: !overwrite [...]`. The tag
+// overrides the policy and any marker for that value alone. A tag on a mapping
+// applies to the mapping and to each of its keys, as a marker would. Tags
+// within sequences are removed without effect, and no tag reaches the output.
 type Options struct {
 	FilesDir    string
 	ResolvePath []string
 
+	NullDeletes  bool
+	DeleteIfNull []string
+
 	DefaultOverWrite bool
 	Overwrite        []string
 	Append           []string
+	Prepend          []string
+
+	// DefaultSequencePolicy is the policy of a sequence no pattern matches,
+	// in place of DefaultOverWrite, so that for example sequences accumulate
+	// while conflicting scalars are still an error. SequenceError makes
+	// such a sequence conflict with an existing sequence, unless they are
+	// equal. If empty, DefaultOverWrite decides for sequences too.
+	DefaultSequencePolicy SequencePolicy
+
+	// WarnOnOverwrite adds a warning to MergeResult for each scalar or
+	// sequence a later file replaces with a different value, naming both
+	// values and the files that set them, so that an overwrite the policy
+	// allows is still visible.
+	WarnOnOverwrite bool
+
+	// ReplaceSubtree lists patterns of keys whose value is replaced wholesale
+	// by a later file instead of being merged into. By default mappings are
+	// patched: only the keys a later file mentions are merged, and the others
+	// are kept. A replaced subtree keeps nothing from earlier files, and may
+	// change the kind of the value.
+	ReplaceSubtree []string
+
+	// CoerceScalarToSequence lists patterns of keys where a scalar meets a
+	// sequence, in either order. The scalar is promoted to a sequence of one
+	// element, which is then merged like any other sequence instead of being
+	// a mismatch.
+	CoerceScalarToSequence []string
+
+	// ListFields lists patterns of keys whose value is always a sequence,
+	// such as `kernel_arguments.should_exist`. A scalar at such a key is
+	// promoted to a sequence of one element before it is merged, whether or
+	// not an earlier file set the key, so it is appended to the sequence like
+	// any other instead of being a mismatch. Unlike CoerceScalarToSequence, a
+	// lone scalar becomes a sequence too.
+	ListFields []string
+
+	// ConcatInline lists patterns of string keys, such as `.contents.inline`,
+	// whose value a later file appends to rather than conflicting with or
+	// overwriting, separated by a newline unless the earlier value ends with
+	// one. This builds a file such as `authorized_keys` from fragments, as
+	// long as the fragments' files are merged by key, with MergeBy or the
+	// schema, so that their contents meet.
+	ConcatInline []string
+
+	// Ignore lists patterns of keys that are dropped from every input before it
+	// is merged, such as local bookkeeping metadata that should never reach
+	// Butane. Unlike a policy, an ignored key is never copied into the output.
+	Ignore []string
+
+	// OnlySections, if set, lists the only top-level keys, such as `storage`,
+	// that are merged from each input; its other top-level keys are dropped.
+	// SkipSections lists top-level keys that are dropped from each input.
+	// Both are most useful scoped to a single file with FileSpec, to merge
+	// only part of an overlay without editing it.
+	OnlySections []string
+	SkipSections []string
+
+	// CaseInsensitivePatterns makes every pattern match context paths without
+	// regard to case, so that `$.storage.files` also matches the key `Storage`.
+	// It affects only pattern matching: keys that differ in case are still
+	// distinct keys, and are output as they were written.
+	CaseInsensitivePatterns bool
+
+	// SealDepth, when positive, makes it an error for any file but the first
+	// to add a key that is not already present at a depth of up to SealDepth,
+	// where the top-level keys have a depth of 1. Keys matching an
+	// AllowedNewKeys pattern may always be added. This lets a base file
+	// govern which sections overlays may contribute to.
+	SealDepth      int
+	AllowedNewKeys []string
+
+	// UniqueBy maps patterns of sequences of mappings to a field that must be
+	// unique among the elements of the merged sequence, for example
+	// `$.storage.files` to `path`. A duplicate is reported as an error naming
+	// the files that contributed both elements, rather than left for Butane to
+	// reject.
+	UniqueBy map[string]string
+
+	// MaxSequenceLen maps patterns of sequences to the most elements each
+	// may hold once merged, for example `$.storage.files` to 500. A longer
+	// sequence is an error naming its path and length, as a guardrail
+	// against a runaway append by generated fragments.
+	MaxSequenceLen map[string]int
+
+	// MergeBy maps patterns of sequences of mappings to a key field, for
+	// example `$.storage.files` to `path`. When a sequence is appended or
+	// prepended, an element with the same value of the field as an element
+	// already merged is merged into that element key by key, like a
+	// mapping, instead of being added; the other elements are added as
+	// usual. Keys of a merged element have context paths such as
+	// `$.storage.files[path=/etc/foo].mode`, which match patterns with or
+	// without the selector, so a conflict within the element is decided by
+	// the same policies as elsewhere.
+	MergeBy map[string]string
+
+	// RenameKeys maps patterns of keys to the name each key is renamed to
+	// before a file is merged, for fields renamed between spec versions, for
+	// example `$.storage.files.contents.local` to `file`. Fragments using the
+	// old and new names then merge into the new name. A mapping holding both
+	// names keeps the value of the new name, with a warning if the values
+	// differ.
+	RenameKeys map[string]string
+
+	// PatternAliases maps names starting with `@` to the patterns they stand
+	// for, to shorten long lists of patterns sharing a prefix. A pattern
+	// starting with the name of an alias, such as `@files.contents.local`
+	// with `@files` standing for `$.storage.files`, starts with its pattern
+	// instead. A pattern starting with `@` that names no alias is an error.
+	// A FileSpec with Options has only the aliases of those Options.
+	PatternAliases map[string]string
+
+	// TemplateData is the data used to render templates. A `template` key
+	// within any `contents` mapping, such as `storage.files.contents`, names a
+	// Go text/template file relative to the directory of the input file. The
+	// template is rendered with TemplateData and the result replaces the key
+	// as `inline` contents.
+	TemplateData any
+
+	// StrictResolve makes it an error for a ResolvePath pattern to match a
+	// value that is not a string, such as a mapping, rather than leaving the
+	// value unchanged. It applies to every file regardless of FileSpec.
+	StrictResolve bool
+
+	// VerifyResolvedPaths makes it an error for a string resolved by a
+	// ResolvePath pattern to name a file that does not exist, relative to
+	// FilesDir, so a broken local reference is found when merging rather
+	// than by Butane.
+	VerifyResolvedPaths bool
+
+	StrategyKey string
+
+	// Variant and Version select an embedded schema of a Butane spec version,
+	// for example "fcos" and "1.5.0". When set, the kind of each merged value
+	// (scalar, mapping or sequence) is checked against the schema so that a
+	// fragment using the wrong kind for a known field is reported clearly.
+	// Values nested within sequences are not checked.
+	//
+	// A schema also brings the merge semantics of the spec's own merging
+	// fields: the child configs of `ignition.config.merge` are merged by
+	// `source`, and the units of `systemd.units` and the dropins of each unit
+	// by `name`, unless a MergeBy pattern applies, and
+	// `ignition.config.replace` names a single config, so a different one in a
+	// later file is a conflict unless the key is overwritten, in which case it
+	// replaces the earlier one whole.
+	Variant string
+	Version string
+
+	// DefaultVariant and DefaultVersion are set as the `variant` and
+	// `version` of the merged config where no file sets them, so that
+	// snippets without a header, merged on their own, still make a config
+	// Butane accepts. If any of Variant, Version, DefaultVariant and
+	// DefaultVersion is set, MergeResult warns of a header key that is still
+	// missing.
+	DefaultVariant string
+	DefaultVersion string
+
+	// StrictKeys makes it an error for an input file to have a key that is
+	// not a field of the schema selected by Variant and Version, such as the
+	// typo `storag`. The error names the closest field. Unlike the kind check,
+	// it covers values nested within sequences, and is made before any
+	// policy applies.
+	StrictKeys bool
+
+	// StrictUnmarshal reads every input file strictly, to catch a malformed
+	// fragment when it is read rather than by its effect on the merge. A YAML
+	// file may hold only one document, besides any front matter holding the
+	// MetaKey, and a JSON file only one value, where otherwise the rest is
+	// ignored. With a schema selected by Variant and Version it also implies
+	// StrictKeys, so a key that is not a field of the spec is an error.
+	StrictUnmarshal bool
+
+	// ErrorOnDuplicateKeys makes a key repeated within a mapping of a single
+	// input file an error naming the key and where it repeats. A JSON file
+	// otherwise keeps the last value of the key, silently dropping the
+	// others; a YAML file is always an error, but one without the context
+	// path of the key.
+	ErrorOnDuplicateKeys bool
+
+	// OutputFormat selects the format of the merged output. The default is
+	// FormatYAML.
+	OutputFormat Format
+
+	// Marshaler, if set, serializes the merged config in place of
+	// OutputFormat, for output in a house style, such as that of a
+	// yaml.Encoder with its own indentation. The options that style the
+	// output, such as LiteralStyle, ForceQuote and AnnotateSource, then do
+	// not apply, and EmitConflictMarkers may not be set. The root must not be
+	// retained.
+	Marshaler func(root map[string]any) ([]byte, error)
+
+	// LiteralStyle lists patterns of string values that are always emitted as
+	// literal block scalars (`|`), such as `.contents.inline`. Strings
+	// containing newlines are emitted as literal block scalars wherever
+	// possible regardless.
+	LiteralStyle []string
+
+	// ForceQuote and ForceUnquote list patterns of scalar values that are
+	// always or never quoted in YAML output, overriding the default of quoting
+	// only when needed to keep a string a string. A value matched by
+	// ForceQuote is emitted as a double quoted string even if it was parsed as
+	// a number, and a string matched by ForceUnquote is emitted plain even if
+	// it will then be parsed as a number. A pattern may not be in both lists.
+	ForceQuote   []string
+	ForceUnquote []string
+
+	// StringFields lists patterns of fields whose plain YAML scalars are
+	// always read as strings, so that a value such as `0644`, `1.0` or
+	// `true` keeps its text rather than becoming a number or bool, and is
+	// emitted as that same string. Nulls are left alone, and JSON values,
+	// whose types are explicit, are unaffected. It applies to every file
+	// regardless of FileSpec.
+	StringFields []string
+
+	// NormalizeModes rewrites the mode of every file and directory of the
+	// merged config, however written, to the same integer, emitted in YAML
+	// output in octal such as `0644`. A string holding an octal number, such
+	// as "0644" or "0o644", becomes that number, as Butane reads a mode only
+	// as an integer. A value whose meaning is unclear is left as it is, with
+	// a warning: a string of digits without a leading zero, or an integer
+	// whose decimal digits look octal but which sets the setuid, setgid or
+	// sticky bits, such as 644 where 0644 was meant.
+	NormalizeModes bool
+
+	// AnnotateSource adds a comment to each key of the YAML output whose
+	// source file differs from that of its parent, naming the file that last
+	// set it. Top-level keys are always annotated. The comments are purely
+	// informational and are not written to JSON output.
+	AnnotateSource bool
+
+	// EmitConflictMarkers keeps the merged value at a conflict instead of
+	// failing the merge, and marks the conflict in the YAML output like a git
+	// merge conflict, for resolving by hand:
+	//
+	//	# <<<<<<< base.yaml
+	//	key: merged value
+	//	# =======
+	//	# key: conflicting value
+	//	# >>>>>>> overlay.yaml
+	//
+	// Each later conflicting value of the key adds another section. The
+	// markers are comments, so the output still parses. It may not be
+	// combined with JSON output, which has no comments.
+	EmitConflictMarkers bool
+
+	// Phases is the pipeline each input file goes through before it is
+	// merged. If nil, DefaultPhases are run. The built-in phases may be
+	// reordered or left out, and custom phases added anywhere.
+	Phases []Phase
+
+	// MaxDepth is the deepest nesting of mappings and sequences allowed in an
+	// input file, the top-level mapping being at depth 1. Deeper input is an
+	// error. If zero, DefaultMaxDepth is used.
+	MaxDepth int
+
+	// MaxFiles and MaxTotalBytes, if positive, limit the number of input files
+	// and their total size, for inputs such as globs whose extent the caller
+	// does not control. A merge exceeding either limit fails before reading
+	// any more of the input. The size of a compressed file is its size
+	// decompressed.
+	MaxFiles      int
+	MaxTotalBytes int64
+
+	// MetaKey names a top-level key holding metadata about an input file
+	// rather than config, for example `x-meta`. The metadata may be given
+	// inline or, in a YAML file, as a leading front-matter document holding
+	// MetaKey that is separated from the config by `---`. It is removed before
+	// merging. If the metadata has an integer `priority`, files are merged in
+	// order of increasing priority, files without one having priority 0, and
+	// in the order given otherwise. If it has `after`, a list of input files
+	// as named to the merge, the file must be merged after each of them.
+	MetaKey string
+
+	// PriorityKey names a top-level key, for example `x-priority`, by which an
+	// input file may declare its integer priority without any other metadata.
+	// It is removed before merging, and files are ordered by it as for a
+	// priority in MetaKey. A file may not declare both.
+	PriorityKey string
+
+	// AfterKey names a top-level key, for example `x-after`, by which an
+	// input file may declare the input files it must be merged after, as for
+	// `after` in MetaKey. It is removed before merging. The order the files
+	// are merged in, after sorting by priority, is only checked: it is an
+	// error for a file to come before one it names, or to name a file that
+	// is not an input.
+	AfterKey string
+
+	// BlobSize, if positive, is the size in bytes from which a multiline
+	// string, such as a large inline script, is held aside while merging and
+	// written to the output verbatim instead of being encoded again. Equal
+	// strings still compare equal. Strings the YAML encoder would not write as
+	// a plain literal block are merged as usual.
+	BlobSize int
+
+	// TrackPositions records the line and column of every key of the input
+	// files, so that a conflict reports where both conflicting values were
+	// set. It costs a second read of each file.
+	TrackPositions bool
+
+	// ExplainPolicy records, for each context path merged, the policy that
+	// decided how it merged and why, as returned by MergeFilesResult.
+	ExplainPolicy bool
+
+	// OnConflict, if set, decides each conflict that would otherwise fail the
+	// merge: a key set to a different scalar by two files, or set to values
+	// of different kinds, where no Overwrite pattern applies. It is taken
+	// from the global Options only.
+	OnConflict func(ctx ConflictContext) (Resolution, error)
+
+	// Seed, if set, is the config the merge starts from, so that every input
+	// file merges onto it as if it were an earlier file, such as defaults
+	// computed at runtime. It is copied, never modified. No patterns are
+	// applied to it, so its paths are used as they are, and it does not count
+	// as the first file for SealDepth.
+	Seed map[string]any
+
+	// Set maps absolute context paths, such as `$.storage.files`, to a value
+	// set at the path once every file is merged, replacing any merged value
+	// and creating mappings for any missing keys along the path. SetFunc does
+	// the same with the value returned by a function called after the merge,
+	// for computed values such as a hash or a timestamp. A path may not be in
+	// both. Values are set in order of path, so a path within another is set
+	// after it.
+	Set     map[string]any
+	SetFunc map[string]func() (any, error)
+
+	// LintRules are called in order once every file is merged and every value
+	// set, each with a copy of the merged config to inspect, such as rules
+	// requiring every SSH key to be ed25519. Their findings are returned by
+	// MergeFilesResult. With FailOnLintError, any finding of SeverityError
+	// fails the merge with a LintError instead.
+	LintRules       []func(root map[string]any) []LintFinding
+	FailOnLintError bool
+
+	// PruneEmpty removes, once every file is merged, each key whose value is an
+	// empty mapping or sequence, such as a `storage: {}` left behind after its
+	// only child was deleted. Keys emptied by pruning are pruned in turn.
+	// Elements of a sequence are never removed, as an empty element such as a
+	// partition with every field defaulted is still an element.
+	PruneEmpty bool
+
+	// KeepEmpty lists patterns of keys that PruneEmpty keeps even when empty,
+	// for fields where an empty value means something other than no value.
+	KeepEmpty []string
+
+	// SortSequences lists patterns of sequences that are sorted once merged,
+	// for deterministic output whatever the order of the files, such as
+	// `.ssh_authorized_keys`. Scalars sort by their string form, and mappings
+	// by the value of their key field, from MergeBy, UniqueBy or the schema.
+	// A sequence holding a mapping without a key field, or a sequence, is
+	// left in order with a warning. Only list sequences whose order does not
+	// matter: the order of `kernel_arguments`, for one, can.
+	SortSequences []string
+
+	// IgnoreMissing treats an input file that does not exist as an empty
+	// file, which is skipped, for optional overlays. Any other error reading
+	// a file is still returned.
+	IgnoreMissing bool
+
+	// SkipDuplicateInputs skips an input file whose content, once read and
+	// preprocessed, is the same as that of a file already merged, such as a
+	// fragment included twice, with a warning. Paths resolved by ResolvePath
+	// are part of the content, so the same fragment copied to two
+	// directories is not a duplicate. The Options of a FileSpec do not count.
+	SkipDuplicateInputs bool
+
+	// Resolver turns the name of each input file into a local path to read it
+	// from. If nil, names are local paths relative to FilesDir. The paths in a
+	// file are resolved relative to the directory of its local path.
+	Resolver SourceResolver
+
+	// ReadTimeout, if positive, limits the time spent resolving and reading
+	// each input file, so a hung source, such as a URL or a file on a network
+	// filesystem, fails the merge with an error naming it rather than
+	// blocking it. The timeout applies on top of the context of the merge,
+	// and its error wraps context.DeadlineExceeded.
+	ReadTimeout time.Duration
+
+	// GlobOrder orders the files matched by MergeGlob. The default is lexical
+	// order.
+	GlobOrder func(a, b string) int
+
+	// Logger receives a line for each path resolved by ResolvePath. If nil,
+	// the standard logger of the log package is used.
+	Logger *log.Logger
+}
+
+// SequencePolicy is the default policy for merging sequences.
+type SequencePolicy string
+
+const (
+	SequenceAppend    SequencePolicy = "append"
+	SequencePrepend   SequencePolicy = "prepend"
+	SequenceOverwrite SequencePolicy = "overwrite"
+	SequenceError     SequencePolicy = "error"
+)
+
+// check returns an error if p is not a known policy.
+func (p SequencePolicy) check() error {
+	switch p {
+	case "", SequenceAppend, SequencePrepend, SequenceOverwrite, SequenceError:
+		return nil
+	}
+	return fmt.Errorf("unknown DefaultSequencePolicy: %q", p)
+}
+
+// FileSpec names a single input file to merge along with an optional set of
+// Options scoped to that file.
+//
+// When Options is non-nil its pattern lists, DefaultOverWrite,
+// DefaultSequencePolicy, NullDeletes, OnlySections and SkipSections replace
+// the global policy while this file is merged; the policies are not combined.
+// FilesDir and settings that affect the output, such as LiteralStyle and
+// OutputFormat, are always taken from the global Options. This allows, for
+// example, a trusted base file to overwrite freely while overlay files may
+// only append.
+//
+// Root, if set, is the directory relative to FilesDir that the file's
+// ResolvePath values and templates are relative to, in place of the directory
+// of Path. This allows fragments that were copied or symlinked away from their
+// logical location to resolve as if they were still there.
+type FileSpec struct {
+	Path    string
+	Root    string
+	Options *Options
+}
+
+// MergeFiles will merge each of the YAML files specified into single
+// array of bytes of yaml intended to be passed directly to Butane transformation.
+//
+// Files with a `.json` extension are parsed as JSON and may be mixed freely
+// with YAML files. An empty file, or one holding only comments, is skipped.
+// A gzip-compressed file is decompressed first, and parsed according to its
+// extension without any `.gz`.
+//
+// MergeFiles and the other merge functions are safe for concurrent use, also
+// with the same Options, provided the Options are not modified meanwhile. The
+// input files, Seed and TemplateData are only read. Options that hold code,
+// such as OnConflict, Phases, Resolver, Logger and LintRules, are called from
+// each merge and must be safe for concurrent use themselves; a RemoteResolver
+// is not.
+func MergeFiles(options *Options, path ...string) ([]byte, error) {
+	return MergeFilesContext(context.Background(), options, path...)
+}
+
+// MergeFilesContext is like MergeFiles but stops with the context's error once
+// ctx is done. The context is checked before each file is merged.
+func MergeFilesContext(ctx context.Context, options *Options, path ...string) ([]byte, error) {
+	specs := make([]FileSpec, len(path))
+	for i, p := range path {
+		specs[i] = FileSpec{Path: p}
+	}
+	return MergeFileSpecsContext(ctx, options, specs...)
+}
+
+// MergeFileSpecs is like MergeFiles but each file may carry its own merge
+// policy. See FileSpec.
+func MergeFileSpecs(options *Options, specs ...FileSpec) ([]byte, error) {
+	return MergeFileSpecsContext(context.Background(), options, specs...)
+}
+
+// MergeFileSpecsContext is like MergeFileSpecs but stops with the context's
+// error once ctx is done.
+func MergeFileSpecsContext(ctx context.Context, options *Options, specs ...FileSpec) ([]byte, error) {
+	result, err := MergeFileSpecsResult(ctx, options, specs...)
+	if err != nil {
+		return nil, err
+	}
+	return result.Output, nil
+}
+
+// Canonicalize parses a single YAML config and re-marshals it the same way
+// MergeFiles produces its output: mapping keys are sorted and scalars are quoted
+// consistently. Canonicalize is idempotent, and the output of MergeFiles is
+// already canonical.
+func Canonicalize(data []byte) ([]byte, error) {
+	config := map[string]any{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error reading yaml: %w", err)
+	}
+	return marshal(config, buildPolicy(&Options{}), nil, FormatYAML)
+}
+
+type merge struct {
+	*mergePolicy
+	// policy is the global policy, mergePolicy the policy of the file
+	// currently being merged.
+	policy        *mergePolicy
+	filesDir      string
+	resolver      SourceResolver
+	readTimeout   time.Duration
+	strictResolve bool
+	marshaler     func(root map[string]any) ([]byte, error)
+	verifyPaths   bool
+	warnOverwrite bool
+	logger        *log.Logger
+	strategyKey   string
+	templateData  any
+	// header holds the defaults of the header keys, and checkHeader is set
+	// if the merged config is meant to have them.
+	header        map[string]string
+	checkHeader   bool
+	schema        schema
+	strictKeys    bool
+	strict        bool
+	duplicateKeys bool
+	cache         *parseCache
+	phases        []Phase
+	maxDepth      int
+	maxFiles      int
+	maxTotalBytes int64
+	// totalBytes is the size of the files read so far.
+	totalBytes  int64
+	metaKey     string
+	priorityKey string
+	afterKey    string
+	// standalone is set when a file is merged on its own to validate it, so
+	// the files it declares it comes after are not among the inputs.
+	standalone bool
+	blobs      *blobs
+	root       map[string]any
+
+	// file is the path of the file being merged, count the number of files
+	// merged before it.
+	file  string
+	count int
+
+	// elementFiles holds, for each merged sequence, the file each element
+	// came from.
+	elementFiles map[string][]string
+
+	// sources holds, when annotating the output or tracking positions, the
+	// file each key was last set by, keyed by context path.
+	sources  map[string]string
+	annotate bool
+
+	// positions holds, when tracking positions, the position of every key of
+	// the files merged.
+	positions positions
+
+	// conflicts, if non-nil, collects conflicting values instead of failing
+	// the merge. The existing value is kept.
+	conflicts *[]MergeConflictError
+	// markConflicts marks the collected conflicts in the YAML output.
+	markConflicts bool
+	// onConflict, if non-nil, decides each conflict before it is reported.
+	onConflict func(ctx ConflictContext) (Resolution, error)
+	// touched holds, when listing contributors, each value set by each file.
+	touched *[]touch
+	// resolutions holds, when building an AST, the last resolution of a
+	// conflict at each context path.
+	resolutions map[string]Resolution
+
+	// pruneEmpty removes empty mappings and sequences once merged.
+	pruneEmpty bool
+	// set and setFunc give the values set once merged.
+	set     map[string]any
+	setFunc map[string]func() (any, error)
+	// ignoreMissing reads a file that does not exist as an empty file.
+	ignoreMissing bool
+	// seen holds, when skipping duplicate inputs, the file merged with each
+	// content hash.
+	seen map[[sha256.Size]byte]string
+	// decisions holds, when explaining the policy, the policy decided for
+	// each key merged.
+	decisions *[]PolicyDecision
+	// lintRules check the merged config, and findings holds what they found.
+	lintRules  []func(root map[string]any) []LintFinding
+	failOnLint bool
+	findings   []LintFinding
+
+	// warnings holds the problems found that did not fail the merge.
+	warnings []Warning
+	// read holds the local path of each file read, in the order first read.
+	read []string
+
+	// strategies holds the inline strategy markers of the file being merged,
+	// keyed by the context path of each key in the marked mapping.
+	strategies map[string]mergeMode
+	// tags holds the merge tags of each file read, keyed by file name and
+	// then by context path.
+	tags map[string]map[string]mergeMode
+}
+
+// newMerge returns the state of a single merge using options. If policy is
+// nil it is built from options, and otherwise it must have been built from
+// options by an earlier call.
+func newMerge(options *Options, policy *mergePolicy) (*merge, error) {
+	s, err := lookupSchema(options.Variant, options.Version)
+	if err != nil {
+		return nil, err
+	}
+	if options.StrictKeys && s == nil {
+		return nil, fmt.Errorf("StrictKeys requires a Variant and Version")
+	}
+	if options.EmitConflictMarkers && options.OutputFormat == FormatJSON {
+		return nil, fmt.Errorf("EmitConflictMarkers requires YAML output")
+	}
+	if options.EmitConflictMarkers && options.Marshaler != nil {
+		return nil, fmt.Errorf("EmitConflictMarkers may not be combined with a Marshaler")
+	}
+	maxDepth := options.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	phases := options.Phases
+	if phases == nil {
+		phases = DefaultPhases()
+	}
+	if err := checkPhases(phases); err != nil {
+		return nil, err
+	}
+	if err := options.DefaultSequencePolicy.check(); err != nil {
+		return nil, err
+	}
+	if err := checkSetPaths(options); err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		expanded, err := expandAliases(options)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkQueries(expanded); err != nil {
+			return nil, err
+		}
+		policy = buildPolicy(expanded)
+	}
+	resolver := options.Resolver
+	if resolver == nil {
+		resolver = FileResolver{}
+	}
+	var seen map[[sha256.Size]byte]string
+	if options.SkipDuplicateInputs {
+		seen = map[[sha256.Size]byte]string{}
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	var b *blobs
+	if options.BlobSize > 0 {
+		b = newBlobs(options.BlobSize)
+	}
+	var sources map[string]string
+	if options.AnnotateSource || options.TrackPositions || options.OnConflict != nil || options.EmitConflictMarkers || options.WarnOnOverwrite {
+		sources = map[string]string{}
+	}
+	var conflicts *[]MergeConflictError
+	if options.EmitConflictMarkers {
+		conflicts = &[]MergeConflictError{}
+	}
+	var decisions *[]PolicyDecision
+	if options.ExplainPolicy {
+		decisions = &[]PolicyDecision{}
+	}
+	var pos positions
+	if options.TrackPositions {
+		pos = positions{}
+	}
+	var root map[string]any
+	if options.Seed != nil {
+		root = deepCopy(options.Seed).(map[string]any)
+	}
+	m := &merge{
+		root:          root,
+		policy:        policy,
+		filesDir:      options.FilesDir,
+		resolver:      resolver,
+		readTimeout:   options.ReadTimeout,
+		strictResolve: options.StrictResolve,
+		marshaler:     options.Marshaler,
+		verifyPaths:   options.VerifyResolvedPaths,
+		warnOverwrite: options.WarnOnOverwrite,
+		logger:        logger,
+		strategyKey:   options.StrategyKey,
+		templateData:  options.TemplateData,
+		header:        map[string]string{"variant": options.DefaultVariant, "version": options.DefaultVersion},
+		checkHeader:   options.Variant != "" || options.Version != "" || options.DefaultVariant != "" || options.DefaultVersion != "",
+		schema:        s,
+		elementFiles:  map[string][]string{},
+		tags:          map[string]map[string]mergeMode{},
+		phases:        phases,
+		maxDepth:      maxDepth,
+		maxFiles:      options.MaxFiles,
+		maxTotalBytes: options.MaxTotalBytes,
+		metaKey:       options.MetaKey,
+		priorityKey:   options.PriorityKey,
+		afterKey:      options.AfterKey,
+		blobs:         b,
+		sources:       sources,
+		annotate:      options.AnnotateSource,
+		positions:     pos,
+		pruneEmpty:    options.PruneEmpty,
+		set:           options.Set,
+		setFunc:       options.SetFunc,
+		ignoreMissing: options.IgnoreMissing,
+		seen:          seen,
+		decisions:     decisions,
+		lintRules:     options.LintRules,
+		failOnLint:    options.FailOnLintError,
+		conflicts:     conflicts,
+		markConflicts: options.EmitConflictMarkers,
+		onConflict:    options.OnConflict,
+		strictKeys:    options.StrictKeys || options.StrictUnmarshal && s != nil,
+		strict:        options.StrictUnmarshal,
+		duplicateKeys: options.ErrorOnDuplicateKeys,
+	}
+	if root != nil {
+		m.addSeedFiles(root, "$")
+	}
+	return m, nil
+}
+
+// seedFile names Options.Seed where the file of a value is reported, such as
+// the files of duplicate elements.
+const seedFile = "seed"
+
+// addSeedFiles records the seed as the file of every element of the
+// sequences within v, which is at ctxpath in the seed.
+func (m *merge) addSeedFiles(v any, ctxpath string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, vi := range v {
+			m.addSeedFiles(vi, joinPath(ctxpath, k))
+		}
+	case []any:
+		files := make([]string, len(v))
+		for i := range files {
+			files[i] = seedFile
+		}
+		m.elementFiles[ctxpath] = files
+	}
+}
+
+// mergeSpecs reads every file and then merges them in order of priority, as
+// given by their metadata, and otherwise in the order given. Empty files are
+// skipped wherever they are, so that an empty first file does not count as
+// the first file merged, and merging only empty files results in an empty
+// config.
+func (m *merge) mergeSpecs(ctx context.Context, specs []FileSpec) error {
+	if m.maxFiles > 0 && len(specs) > m.maxFiles {
+		return fmt.Errorf("%d input files are more than MaxFiles of %d", len(specs), m.maxFiles)
+	}
+	configs := make([]map[string]any, len(specs))
+	locals := make([]string, len(specs))
+	for i, spec := range specs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		local, config, err := m.readSource(ctx, spec.Path)
+		if err != nil {
+			return fmt.Errorf("file[%s]: %w", spec.Path, err)
+		}
+		configs[i] = config
+		locals[i] = local
+	}
+	order, err := m.mergeOrder(specs, configs)
+	if err != nil {
+		return err
+	}
+	usesPolicy := false
+	for _, i := range order {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		spec := specs[i]
+		if len(configs[i]) == 0 {
+			// An empty file, or one holding only comments, is skipped.
+			continue
+		}
+		m.mergePolicy = m.policy
+		if spec.Options != nil {
+			options, err := expandAliases(spec.Options)
+			if err != nil {
+				return fmt.Errorf("file[%s]: %w", spec.Path, err)
+			}
+			if err := checkQueries(options); err != nil {
+				return fmt.Errorf("file[%s]: %w", spec.Path, err)
+			}
+			if err := spec.Options.DefaultSequencePolicy.check(); err != nil {
+				return fmt.Errorf("file[%s]: %w", spec.Path, err)
+			}
+			m.mergePolicy = buildPolicy(options)
+		} else {
+			usesPolicy = true
+		}
+		if err := m.mergeFile(spec, locals[i], configs[i]); err != nil {
+			return fmt.Errorf("file[%s]: %w", spec.Path, err)
+		}
+		if spec.Options != nil {
+			m.warnings = append(m.warnings, m.mergePolicy.unused(spec.Path)...)
+		}
+	}
+	if usesPolicy {
+		m.warnings = append(m.policy.unused(""), m.warnings...)
+	}
+	if m.root == nil {
+		m.root = map[string]any{}
+	}
+	if m.pruneEmpty {
+		pruneEmpty(m.root, "$", m.policy)
+	}
+	if err := m.setValues(); err != nil {
+		return err
+	}
+	m.setHeader()
+	if m.policy.octalModes {
+		m.normalizeModes()
+	}
+	if len(m.policy.sortSequences) > 0 {
+		m.sortSequences(m.root, "$")
+	}
+	return m.lint()
+}
+
+// setHeader sets each header key missing from the merged config to its
+// default, and warns of any still missing.
+func (m *merge) setHeader() {
+	for _, key := range []string{"variant", "version"} {
+		if v, ok := m.root[key]; ok && v != nil {
+			continue
+		}
+		switch {
+		case m.header[key] != "":
+			m.root[key] = m.header[key]
+		case m.checkHeader:
+			m.warnings = append(m.warnings, Warning{Path: joinPath("$", key), Message: "is not set by any file or default, so Butane rejects the config"})
+		}
+	}
+}
+
+// mergeOrder returns the indices of specs sorted by the priority their configs
+// declare. Files without a priority have priority 0, and files of equal
+// priority keep their order. It is an error for the order to merge a file
+// before a file it declares it comes after, unless the file is merged on its
+// own.
+func (m *merge) mergeOrder(specs []FileSpec, configs []map[string]any) ([]int, error) {
+	order := make([]int, len(specs))
+	priorities := make([]int, len(specs))
+	for i, config := range configs {
+		order[i] = i
+		priority, err := m.priority(config)
+		if err != nil {
+			return nil, fmt.Errorf("file[%s]: %w", specs[i].Path, err)
+		}
+		priorities[i] = priority
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return cmp.Compare(priorities[a], priorities[b])
+	})
+	merged := map[string]int{}
+	for n, i := range order {
+		if _, ok := merged[specs[i].Path]; !ok {
+			merged[specs[i].Path] = n
+		}
+	}
+	for n, i := range order {
+		after, cpath, err := m.after(configs[i])
+		if err != nil {
+			return nil, fmt.Errorf("file[%s]: %w", specs[i].Path, err)
+		}
+		if m.standalone {
+			continue
+		}
+		for _, file := range after {
+			switch before, ok := merged[file]; {
+			case !ok:
+				return nil, fmt.Errorf("file[%s]: key[%s] names %s, which is not an input file", specs[i].Path, cpath, file)
+			case before >= n:
+				return nil, fmt.Errorf("file[%s]: key[%s] requires %s to be merged first", specs[i].Path, cpath, file)
+			}
+		}
+	}
+	return order, nil
+}
+
+// after returns the files config declares it comes after with the after key
+// or in its metadata, and the context path that declares them.
+func (m *merge) after(config map[string]any) ([]string, string, error) {
+	var cpath string
+	var value any
+	if a, ok := config[m.afterKey]; ok && m.afterKey != "" {
+		cpath, value = joinPath("$", m.afterKey), a
+	}
+	if meta, ok := config[m.metaKey].(map[string]any); ok && m.metaKey != "" {
+		if a, ok := meta["after"]; ok {
+			if cpath != "" {
+				return nil, "", fmt.Errorf("key[%s] conflicts with key[%s]", cpath, joinPath(joinPath("$", m.metaKey), "after"))
+			}
+			cpath, value = joinPath(joinPath("$", m.metaKey), "after"), a
+		}
+	}
+	if cpath == "" {
+		return nil, "", nil
+	}
+	seq, ok := value.([]any)
+	if !ok {
+		return nil, "", fmt.Errorf("key[%s] is %T, want a sequence of file names", cpath, value)
+	}
+	files := make([]string, len(seq))
+	for i, e := range seq {
+		if files[i], ok = e.(string); !ok {
+			return nil, "", fmt.Errorf("key[%s] has a %T, want a sequence of file names", cpath, e)
+		}
+	}
+	return files, cpath, nil
+}
+
+// priority returns the priority config declares with the priority key or in
+// its metadata, or 0 if it declares none.
+func (m *merge) priority(config map[string]any) (int, error) {
+	var cpath string
+	var value any
+	if p, ok := config[m.priorityKey]; ok && m.priorityKey != "" {
+		cpath, value = joinPath("$", m.priorityKey), p
+	}
+	if meta, ok := config[m.metaKey].(map[string]any); ok && m.metaKey != "" {
+		if p, ok := meta["priority"]; ok {
+			if cpath != "" {
+				return 0, fmt.Errorf("key[%s] conflicts with key[%s]", cpath, joinPath(joinPath("$", m.metaKey), "priority"))
+			}
+			cpath, value = joinPath(joinPath("$", m.metaKey), "priority"), p
+		}
+	}
+	if cpath == "" {
+		return 0, nil
+	}
+	priority, ok := value.(int)
+	if !ok {
+		return 0, fmt.Errorf("key[%s] is %T, want an integer", cpath, value)
+	}
+	return priority, nil
+}
+
+// mergeFile merges the config of the file named by spec, which was read from
+// the local path.
+func (m *merge) mergeFile(spec FileSpec, local string, config map[string]any) error {
+	m.file = spec.Path
+	root := spec.Root
+	if root == "" {
+		root = filepath.Dir(local)
+	}
+	return m.mergeConfig(root, config)
+}
+
+// readSource resolves the file named path and reads its config, within the
+// ReadTimeout if there is one. It returns the local path and the config, which
+// may be shared and must not be modified.
+func (m *merge) readSource(ctx context.Context, path string) (string, map[string]any, error) {
+	if m.readTimeout > 0 {
+		timeout := fmt.Errorf("read timed out after %s: %w", m.readTimeout, context.DeadlineExceeded)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, m.readTimeout, timeout)
+		defer cancel()
+	}
+	local, err := m.resolver.Resolve(ctx, path)
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			// The resolver only knows that the context is done.
+			err = cause
+		}
+		return "", nil, fmt.Errorf("error resolving source: %w", err)
+	}
+	config, err := m.readConfig(ctx, path, local)
+	if err != nil {
+		return "", nil, err
+	}
+	return local, config, nil
+}
+
+// readConfig reads and parses the file named path from its local path, using
+// the parse cache if there is one, and gives up once ctx is done. The
+// returned config may be shared and must not be modified.
+func (m *merge) readConfig(ctx context.Context, path, local string) (map[string]any, error) {
+	file := m.localPath(local)
+	m.addRead(file)
+	var info os.FileInfo
+	if m.cache != nil || m.maxTotalBytes > 0 {
+		var err error
+		if info, err = os.Stat(file); err != nil {
+			if m.ignoreMissing && errors.Is(err, fs.ErrNotExist) {
+				return map[string]any{}, nil
+			}
+			return nil, fmt.Errorf("error reading file: %w", err)
+		}
+		if m.maxTotalBytes > 0 {
+			m.totalBytes += info.Size()
+			if m.totalBytes > m.maxTotalBytes {
+				return nil, fmt.Errorf("input files total more than MaxTotalBytes of %d bytes", m.maxTotalBytes)
+			}
+		}
+	}
+	// The positions of the keys are only known from the file itself.
+	if m.cache != nil && m.positions == nil {
+		if config, tags, ok := m.cache.get(file, info); ok {
+			m.tags[path] = tags
+			return config, nil
+		}
+	}
+	d, err := readFile(ctx, file)
+	if err != nil {
+		if m.ignoreMissing && errors.Is(err, fs.ErrNotExist) {
+			return map[string]any{}, nil
+		}
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	name := local
+	if bytes.HasPrefix(d, gzipMagic) {
+		// The limit is on the content merged, not the content stored.
+		size := int64(len(d))
+		var max int64
+		if m.maxTotalBytes > 0 {
+			max = m.maxTotalBytes - m.totalBytes + size
+		}
+		if d, err = gunzip(d, max); err != nil {
+			return nil, fmt.Errorf("error reading gzip: %w", err)
+		}
+		if m.maxTotalBytes > 0 {
+			m.totalBytes += int64(len(d)) - size
+			if m.totalBytes > m.maxTotalBytes {
+				return nil, fmt.Errorf("input files total more than MaxTotalBytes of %d bytes", m.maxTotalBytes)
+			}
+		}
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	config, tags, err := parseConfig(name, d, m.metaKey, m.strict, m.duplicateKeys, m.policy)
+	if err != nil {
+		return nil, err
+	}
+	if m.positions != nil {
+		if err := m.positions.read(d, path, m.metaKey, m.keyField); err != nil {
+			return nil, err
+		}
+	}
+	if m.cache != nil {
+		m.cache.put(file, info, config, tags)
+	}
+	m.tags[path] = tags
+	return config, nil
+}
+
+// readFile reads file like os.ReadFile, but returns the cause of ctx once it
+// is done, such as a read timeout, leaving the read to finish unobserved.
+func readFile(ctx context.Context, file string) ([]byte, error) {
+	if ctx.Done() == nil {
+		return os.ReadFile(file)
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		d, err := os.ReadFile(file)
+		done <- result{d, err}
+	}()
+	select {
+	case r := <-done:
+		return r.data, r.err
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// gzipMagic starts every gzip-compressed file.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzip returns the decompressed content of the gzip-compressed data. If max
+// is positive no more than one byte beyond max is decompressed, so that
+// content too large is found without reading all of it.
+func gunzip(data []byte, max int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if max <= 0 {
+		return io.ReadAll(r)
+	}
+	return io.ReadAll(io.LimitReader(r, max+1))
+}
+
+// addRead records that the local file was read.
+func (m *merge) addRead(file string) {
+	if !slices.Contains(m.read, file) {
+		m.read = append(m.read, file)
+	}
+}
+
+// localPath returns the path of a local file, which is relative to FilesDir
+// unless absolute.
+func (m *merge) localPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(m.filesDir, path)
+}
+
+// parseConfig parses the contents of the file at path as JSON or YAML depending
+// on its extension. The merge tags of a YAML file are removed from the config
+// and returned by context path, and its plain scalars in the string fields of
+// policy are read as strings.
+//
+// If metaKey is set, a YAML file may start with a front-matter document holding
+// metaKey, followed by the config itself. The metadata is then moved into the
+// config under metaKey, as if it had been given inline. If strict is true any
+// further document is an error rather than ignored. If duplicateKeys is true a
+// key repeated within a mapping is an error naming its context path.
+func parseConfig(path string, data []byte, metaKey string, strict, duplicateKeys bool, policy *mergePolicy) (map[string]any, map[string]mergeMode, error) {
+	if filepath.Ext(path) == ".json" {
+		if len(bytes.TrimSpace(data)) == 0 {
+			return map[string]any{}, nil, nil
+		}
+		config, err := decodeJSON(data, strict, duplicateKeys)
+		return config, nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	var doc yaml.Node
+	if err := dec.Decode(&doc); err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("error reading yaml: %w", err)
+	}
+	if duplicateKeys {
+		if err := checkDuplicateKeys(&doc, "$"); err != nil {
+			return nil, nil, err
+		}
+	}
+	var meta any
+	if metaKey != "" && hasKey(&doc, metaKey) {
+		var next yaml.Node
+		switch err := dec.Decode(&next); {
+		case err == io.EOF:
+			// The metadata is inline.
+		case err != nil:
+			return nil, nil, fmt.Errorf("error reading yaml: %w", err)
+		default:
+			if duplicateKeys {
+				if err := checkDuplicateKeys(&next, "$"); err != nil {
+					return nil, nil, err
+				}
+			}
+			front := map[string]any{}
+			if err := doc.Decode(&front); err != nil {
+				return nil, nil, fmt.Errorf("error reading yaml: %w", err)
+			}
+			meta, doc = front[metaKey], next
+		}
+	}
+	if strict {
+		var extra yaml.Node
+		switch err := dec.Decode(&extra); {
+		case err == io.EOF:
+		case err != nil:
+			return nil, nil, fmt.Errorf("error reading yaml: %w", err)
+		default:
+			return nil, nil, fmt.Errorf("line %d: more than one document", extra.Line)
+		}
+	}
+	if len(doc.Content) == 1 {
+		switch root := doc.Content[0]; {
+		case root.Kind == yaml.SequenceNode:
+			return nil, nil, fmt.Errorf("line %d: the top level is a sequence, not a mapping", root.Line)
+		case root.Kind == yaml.ScalarNode && root.Tag != "!!null":
+			return nil, nil, fmt.Errorf("line %d: the top level is a scalar, not a mapping", root.Line)
+		}
+	}
+	config := map[string]any{}
+	tags := map[string]mergeMode{}
+	if doc.Kind != 0 {
+		if err := extractTags(&doc, "$", true, tags); err != nil {
+			return nil, nil, err
+		}
+		if len(policy.stringFields) > 0 {
+			tagStrings(&doc, "$", policy)
+		}
+		if err := doc.Decode(&config); err != nil {
+			return nil, nil, fmt.Errorf("error reading yaml: %w", err)
+		}
+	}
+	if meta != nil {
+		config[metaKey] = meta
+	}
+	return config, tags, nil
+}
+
+// checkDuplicateKeys returns an error for the first key repeated within a
+// mapping within n, which is at ctxpath.
+func checkDuplicateKeys(n *yaml.Node, ctxpath string) error {
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			if err := checkDuplicateKeys(c, ctxpath); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		lines := map[string]int{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			cpath := joinPath(ctxpath, k.Value)
+			if line, ok := lines[k.Value]; ok {
+				return fmt.Errorf("line %d: key[%s] is already defined at line %d", k.Line, cpath, line)
+			}
+			lines[k.Value] = k.Line
+			if err := checkDuplicateKeys(v, cpath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// extractTags clears the merge tag of every node within n, which is at
+// ctxpath. When record is true the mode of each tag is recorded in tags for
+// the tagged node and, if it is a mapping, for each of its keys.
+// Nodes nested in sequences are never merged key by key, so their tags are
+// only cleared.
+func extractTags(n *yaml.Node, ctxpath string, record bool, tags map[string]mergeMode) error {
+	if mode, ok := parseMergeTag(n.Tag); ok {
+		n.Tag = ""
+		n.Style &^= yaml.TaggedStyle
+		if record {
+			tags[ctxpath] = mode
+			if n.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(n.Content); i += 2 {
+					tags[joinPath(ctxpath, n.Content[i].Value)] = mode
+				}
+			}
+		}
+	} else if strings.HasPrefix(n.Tag, "!") && !strings.HasPrefix(n.Tag, "!!") && n.Kind != yaml.DocumentNode {
+		return fmt.Errorf("key[%s] unknown merge tag %s", ctxpath, n.Tag)
+	}
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			if err := extractTags(c, ctxpath, record, tags); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, c := range n.Content {
+			if err := extractTags(c, ctxpath, false, tags); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			cpath := joinPath(ctxpath, n.Content[i].Value)
+			if err := extractTags(n.Content[i+1], cpath, record, tags); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tagStrings tags each plain, non-null scalar within n, which is at ctxpath,
+// as a string if it is in a string field of policy.
+func tagStrings(n *yaml.Node, ctxpath string, policy *mergePolicy) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			tagStrings(c, ctxpath, policy)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			policy.scope.push(ctxpath, i, c)
+			tagStrings(c, ctxpath, policy)
+			policy.scope.pop()
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			tagStrings(n.Content[i+1], joinPath(ctxpath, n.Content[i].Value), policy)
+		}
+	case yaml.ScalarNode:
+		if n.Style&yaml.TaggedStyle == 0 && n.Tag != "!!null" && policy.isStringField(ctxpath) {
+			n.Tag = "!!str"
+		}
+	}
+}
+
+// parseMergeTag returns the merge mode named by a YAML tag such as `!append`.
+func parseMergeTag(tag string) (mergeMode, bool) {
+	name, ok := strings.CutPrefix(tag, "!")
+	if !ok || strings.HasPrefix(name, "!") {
+		return 0, false
+	}
+	return parseMergeMode(name)
+}
+
+// mergeConfig merges a parsed file onto the root. The config is copied first
+// so that neither the preprocessing below nor the merge modifies it, and the
+// root never shares a mapping or sequence with it.
+func (m *merge) mergeConfig(fileRoot string, config map[string]any) error {
+	config = deepCopy(config).(map[string]any)
+	if m.metaKey != "" {
+		delete(config, m.metaKey)
+	}
+	if m.priorityKey != "" {
+		delete(config, m.priorityKey)
+	}
+	if m.afterKey != "" {
+		delete(config, m.afterKey)
+	}
+	m.filterSections(config)
+	m.strategies = map[string]mergeMode{}
+	if err := m.runPhases(fileRoot, config); err != nil {
+		return err
+	}
+	// A tag is specific to its value, so it overrides any marker.
+	for cpath, mode := range m.tags[m.file] {
+		m.strategies[cpath] = mode
+	}
+	if len(m.mergePolicy.renameKeys) > 0 {
+		m.renameKeys(config, "$")
+	}
+	if m.seen != nil {
+		// Encoding JSON sorts the keys of mappings.
+		d, err := json.Marshal(config)
+		if err != nil {
+			return fmt.Errorf("error hashing config: %w", err)
+		}
+		sum := sha256.Sum256(d)
+		if file, ok := m.seen[sum]; ok {
+			m.warnings = append(m.warnings, Warning{File: m.file, Path: "$", Message: fmt.Sprintf("has the same content as %s and is skipped", file)})
+			return nil
+		}
+		m.seen[sum] = m.file
+	}
+	if m.strictKeys {
+		if err := m.schema.checkKeys(config, m.file); err != nil {
+			return err
+		}
+	}
+	if m.blobs != nil {
+		m.blobs.extract(config, m.policy)
+	}
+	m.markModes(config)
+	if m.root == nil {
+		m.root = map[string]any{}
+	}
+	if err := m.mergeMapping(m.root, config, "$", 1); err != nil {
+		return err
+	}
+	m.count++
+	return nil
+}
+
+// deepCopy returns a copy of v sharing no mappings or sequences with it.
+func deepCopy(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for k, vi := range v {
+			c[k] = deepCopy(vi)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, vi := range v {
+			c[i] = deepCopy(vi)
+		}
+		return c
+	}
+	return v
+}
+
+// removeIgnored deletes every key within v matching an Ignore pattern.
+func removeIgnored(v any, ctxpath string, policy *mergePolicy) {
+	if len(policy.ignore) == 0 {
+		return
+	}
+	switch v := v.(type) {
+	case []any:
+		for i, vi := range v {
+			policy.scope.push(ctxpath, i, vi)
+			removeIgnored(vi, ctxpath, policy)
+			policy.scope.pop()
+		}
+	case map[string]any:
+		for k, vi := range v {
+			cpath := joinPath(ctxpath, k)
+			if policy.isIgnored(cpath) {
+				delete(v, k)
+				continue
+			}
+			removeIgnored(vi, cpath, policy)
+		}
+	}
+}
+
+// pruneEmpty deletes every key within v whose value is an empty mapping or
+// sequence, after pruning the value itself, unless it matches a KeepEmpty
+// pattern. Sequence elements are pruned within but never removed.
+func pruneEmpty(v any, ctxpath string, policy *mergePolicy) {
+	switch v := v.(type) {
+	case []any:
+		for i, vi := range v {
+			policy.scope.push(ctxpath, i, vi)
+			pruneEmpty(vi, ctxpath, policy)
+			policy.scope.pop()
+		}
+	case map[string]any:
+		for k, vi := range v {
+			cpath := joinPath(ctxpath, k)
+			pruneEmpty(vi, cpath, policy)
+			if isEmpty(vi) && !policy.isKeepEmpty(cpath) {
+				delete(v, k)
+			}
+		}
+	}
+}
+
+// sortSequences sorts each sequence within v, which is at ctxpath, that
+// matches a SortSequences pattern, after sorting those within it.
+func (m *merge) sortSequences(v any, ctxpath string) {
+	switch v := v.(type) {
+	case map[string]any:
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			m.sortSequences(v[k], joinPath(ctxpath, k))
+		}
+	case []any:
+		for i, vi := range v {
+			m.policy.scope.push(ctxpath, i, vi)
+			m.sortSequences(vi, ctxpath)
+			m.policy.scope.pop()
+		}
+		if !m.policy.isSortSequence(ctxpath) {
+			return
+		}
+		field, ok := m.policy.mergeByField(ctxpath)
+		if !ok {
+			field, ok = m.policy.uniqueField(ctxpath)
+		}
+		if !ok {
+			field, ok = m.schema.mergeByField(ctxpath)
+		}
+		keys := make([]string, len(v))
+		for i, e := range v {
+			switch e := e.(type) {
+			case map[string]any:
+				if !ok {
+					m.warnings = append(m.warnings, Warning{Path: ctxpath, Message: "is not sorted, as its mappings have no key field"})
+					return
+				}
+				keys[i] = fmt.Sprint(e[field])
+			case []any:
+				m.warnings = append(m.warnings, Warning{Path: ctxpath, Message: "is not sorted, as it holds sequences"})
+				return
+			default:
+				keys[i] = fmt.Sprint(e)
+			}
+		}
+		order := make([]int, len(v))
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortStableFunc(order, func(a, b int) int {
+			return strings.Compare(keys[a], keys[b])
+		})
+		sorted := make([]any, len(v))
+		for i, j := range order {
+			sorted[i] = v[j]
+		}
+		copy(v, sorted)
+		// The files of the elements move with them.
+		if files := m.elementFiles[ctxpath]; len(files) == len(v) {
+			sortedFiles := make([]string, len(files))
+			for i, j := range order {
+				sortedFiles[i] = files[j]
+			}
+			m.elementFiles[ctxpath] = sortedFiles
+		}
+	}
+}
+
+// checkSetPaths returns an error if a path of Set or SetFunc is not an
+// absolute context path, or is in both.
+func checkSetPaths(options *Options) error {
+	for ctxpath := range options.Set {
+		if _, ok := splitKeys(ctxpath); !ok {
+			return fmt.Errorf("Set path %q is not an absolute context path", ctxpath)
+		}
+		if _, ok := options.SetFunc[ctxpath]; ok {
+			return fmt.Errorf("Set path %q is also in SetFunc", ctxpath)
+		}
+	}
+	for ctxpath := range options.SetFunc {
+		if _, ok := splitKeys(ctxpath); !ok {
+			return fmt.Errorf("SetFunc path %q is not an absolute context path", ctxpath)
+		}
+	}
+	return nil
+}
+
+// setValues sets the values of Set and SetFunc in the root.
+func (m *merge) setValues() error {
+	paths := make([]string, 0, len(m.set)+len(m.setFunc))
+	for ctxpath := range m.set {
+		paths = append(paths, ctxpath)
+	}
+	for ctxpath := range m.setFunc {
+		paths = append(paths, ctxpath)
+	}
+	slices.Sort(paths)
+	for _, ctxpath := range paths {
+		v, ok := m.set[ctxpath]
+		if ok {
+			v = deepCopy(v)
+		} else {
+			var err error
+			if v, err = m.setFunc[ctxpath](); err != nil {
+				return fmt.Errorf("key[%s]: %w", ctxpath, err)
+			}
+		}
+		keys, _ := splitKeys(ctxpath)
+		parent, cpath := m.root, "$"
+		for _, key := range keys[:len(keys)-1] {
+			cpath = joinPath(cpath, key)
+			switch next := parent[key].(type) {
+			case map[string]any:
+				parent = next
+			case nil:
+				created := map[string]any{}
+				parent[key] = created
+				parent = created
+			default:
+				return fmt.Errorf("key[%s] is %T, not a mapping to set %s in", cpath, next, ctxpath)
+			}
+		}
+		parent[keys[len(keys)-1]] = v
+		if m.sources != nil {
+			// The value did not come from a file.
+			delete(m.sources, ctxpath)
+		}
+	}
+	return nil
+}
+
+// isEmpty returns whether v is an empty mapping or sequence.
+func isEmpty(v any) bool {
+	switch v := v.(type) {
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
+
+// resolvePaths rewrites every string matching a ResolvePath pattern to be
+// relative to fileRoot.
+func (m *merge) resolvePaths(config map[string]any, fileRoot string) error {
+	w := &walker{visit: func(ctxpath string, v any) (any, bool, error) {
+		if !m.resolvePath(ctxpath) {
+			return nil, false, nil
+		}
+		switch v := v.(type) {
+		case string:
+			m.markResolvePath(ctxpath)
+			if m.decisions != nil {
+				m.explainResolve(ctxpath)
+			}
+			vv := filepath.Join(fileRoot, v)
+			m.logger.Printf("\t Update[%s] %s -> %s", ctxpath, v, vv)
+			if m.verifyPaths {
+				if _, err := os.Stat(m.localPath(vv)); errors.Is(err, fs.ErrNotExist) {
+					return nil, false, fmt.Errorf("key[%s] resolved path %s does not exist", ctxpath, vv)
+				} else if err != nil {
+					return nil, false, fmt.Errorf("key[%s] error checking resolved path: %w", ctxpath, err)
+				}
+			}
+			return vv, true, nil
+		case []any:
+			// Each element is visited on its own.
+		default:
+			if m.strictResolve {
+				return nil, false, fmt.Errorf("key[%s] resolve path matched %T, want string", ctxpath, v)
+			}
+		}
+		return nil, false, nil
+	}, maxDepth: m.maxDepth, scope: m.mergePolicy.scope}
+	return w.mapping(config, "$")
+}
+
+// extractStrategies removes the strategy marker from every mapping within v.
+// When record is true the strategy is recorded for each key of the mapping at
+// ctxpath.
+// Mappings nested in sequences are never merged key by key, so their markers
+// are only removed.
+func (m *merge) extractStrategies(v any, ctxpath string, record bool) error {
+	switch v := v.(type) {
+	case []any:
+		for _, vi := range v {
+			if err := m.extractStrategies(vi, ctxpath, false); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		if sv, ok := v[m.strategyKey]; ok {
+			delete(v, m.strategyKey)
+			mode, ok := parseMergeMode(sv)
+			if !ok {
+				return fmt.Errorf("key[%s] unknown merge strategy: %v", joinPath(ctxpath, m.strategyKey), sv)
+			}
+			if record {
+				for k := range v {
+					m.strategies[joinPath(ctxpath, k)] = mode
+				}
+			}
+		}
+		for k, vi := range v {
+			if err := m.extractStrategies(vi, joinPath(ctxpath, k), record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-// MergeFiles will merge each of the YAML files specified into single
-// array of bytes of yaml intended to be passed directly to Butane transformation.
-func MergeFiles(options *Options, path ...string) ([]byte, error) {
-	if options == nil {
-		options = &Options{}
-	}
-	m := &merge{
-		filesDir:    options.FilesDir,
-		mergePolicy: buildPolicy(options),
-	}
-	for _, f := range path {
-		if err := m.mergeFile(f); err != nil {
-			return nil, fmt.Errorf("file[%s]: %w", path, err)
+// renameKeys renames each key within v, which is at ctxpath, that matches a
+// RenameKeys pattern.
+func (m *merge) renameKeys(v any, ctxpath string) {
+	switch v := v.(type) {
+	case []any:
+		for i, vi := range v {
+			m.mergePolicy.scope.push(ctxpath, i, vi)
+			m.renameKeys(vi, ctxpath)
+			m.mergePolicy.scope.pop()
+		}
+	case map[string]any:
+		// Keys are renamed in order so that any warnings are too.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			vi := v[k]
+			cpath := joinPath(ctxpath, k)
+			name, ok := m.renameKey(cpath)
+			if !ok || name == k {
+				continue
+			}
+			delete(v, k)
+			if existing, ok := v[name]; ok {
+				if !reflect.DeepEqual(existing, vi) {
+					m.warnings = append(m.warnings, Warning{File: m.file, Path: cpath, Message: fmt.Sprintf("is renamed to %s, which has a different value that is kept", name)})
+				}
+				continue
+			}
+			v[name] = vi
+		}
+		for k, vi := range v {
+			m.renameKeys(vi, joinPath(ctxpath, k))
 		}
 	}
-	return yaml.Marshal(m.root)
 }
 
-type merge struct {
-	*mergePolicy
-	filesDir string
-	root     map[string]any
+// mode returns the merge mode of the key at ctxpath, preferring an inline
+// strategy marker over the configured policy.
+func (m *merge) mode(ctxpath string) mergeMode {
+	if mode, ok := m.strategies[ctxpath]; ok {
+		return mode
+	}
+	return m.mergePolicy.mode(ctxpath)
 }
 
-func (m *merge) mergeFile(path string) error {
-	d, err := os.ReadFile(filepath.Join(m.filesDir, path))
-	if err != nil {
-		return fmt.Errorf("error file[%s]: %w", path, err)
+// sequenceMode returns the merge mode of the sequence at ctxpath, which no
+// pattern matching falls back to DefaultSequencePolicy, and false if the
+// sequence conflicts with an existing one instead.
+func (m *merge) sequenceMode(ctxpath string) (mergeMode, bool) {
+	if mode, ok := m.strategies[ctxpath]; ok {
+		return mode, true
 	}
-	if err := m.mergeBytes(filepath.Dir(path), d); err != nil {
-		return fmt.Errorf("error during Merge[%s]: %w", path, err)
+	mode, _, ok := m.mergePolicy.resolve(ctxpath)
+	if ok {
+		return mode, true
 	}
-	return nil
+	switch m.mergePolicy.defaultSequence {
+	case SequenceAppend:
+		return modeAppend, true
+	case SequencePrepend:
+		return modePrepend, true
+	case SequenceOverwrite:
+		return modeOverwrite, true
+	case SequenceError:
+		return 0, false
+	}
+	return mode, true
 }
 
-func (m *merge) mergeBytes(fileRoot string, data []byte) error {
-	config := map[string]any{}
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return fmt.Errorf("error reading yaml: %w", err)
+func (m *merge) isOverwrite(ctxpath string) bool {
+	return m.mode(ctxpath) == modeOverwrite
+}
+
+// repeatFile returns the file being merged n times.
+func (m *merge) repeatFile(n int) []string {
+	files := make([]string, n)
+	for i := range files {
+		files[i] = m.file
 	}
+	return files
+}
 
-	if fileRoot != "" {
-		m.resolvePaths(config, fileRoot, "$")
+// keyField returns the field the elements of the sequence at ctxpath are
+// merged by, as configured by MergeBy or the schema, if any.
+func (m *merge) keyField(ctxpath string) (string, bool) {
+	if field, ok := m.policy.mergeByField(ctxpath); ok {
+		return field, true
 	}
-	if m.root == nil {
-		m.root = config
-		return nil
+	return m.schema.mergeByField(ctxpath)
+}
+
+// mergeByKey merges each element of src whose field has the same value as an
+// element of dst into that element, and returns the other elements of src.
+// The elements of dst are matched in order, so the first of any duplicates
+// is merged into.
+func (m *merge) mergeByKey(ctxpath, field string, dst, src []any, depth int) ([]any, error) {
+	index := map[any]int{}
+	for i := len(dst) - 1; i >= 0; i-- {
+		if v, ok := elementKey(dst[i], field); ok {
+			index[v] = i
+		}
 	}
-	if err := m.mergeMapping(m.root, config, "$"); err != nil {
-		return err
+	var rest []any
+	for _, e := range src {
+		v, ok := elementKey(e, field)
+		i, found := index[v]
+		if !ok || !found {
+			rest = append(rest, e)
+			continue
+		}
+		epath := elementPath(ctxpath, field, v)
+		if files := m.elementFiles[ctxpath]; m.sources != nil && i < len(files) {
+			m.sources[epath] = files[i]
+		}
+		m.mergePolicy.scope.push(ctxpath, i, dst[i])
+		err := m.mergeMapping(dst[i].(map[string]any), e.(map[string]any), epath, depth+1)
+		m.mergePolicy.scope.pop()
+		if err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	return rest, nil
 }
 
-func (m *merge) resolvePaths(object map[string]any, fileRoot, ctxpath string) {
-	for k, v := range object {
-		cpath := ctxpath + "." + k
-		if vv, ok := m.resolvePathsValue(v, fileRoot, cpath); ok {
-			object[k] = vv
-		}
+// elementKey returns the value of field of e, if e is a mapping and the value
+// is a scalar.
+func elementKey(e any, field string) (any, bool) {
+	em, ok := e.(map[string]any)
+	if !ok {
+		return nil, false
 	}
+	v := em[field]
+	if kind, ok := kindOf(v); !ok || kind != kindScalar {
+		return nil, false
+	}
+	return v, true
 }
 
-func (m *merge) resolvePathsValue(v any, fileRoot, ctxpath string) (any, bool) {
-	switch v := v.(type) {
-	// Sequence
-	case []any:
-		var updated []any
-		for _, vi := range v {
-			if upv, ok := m.resolvePathsValue(vi, fileRoot, ctxpath); ok {
-				updated = append(updated, upv)
-			}
+// checkUnique returns an error if two elements of the sequence at ctxpath have
+// the same value for the field configured by UniqueBy.
+func (m *merge) checkUnique(ctxpath string, seq []any) error {
+	field, ok := m.uniqueField(ctxpath)
+	if !ok {
+		return nil
+	}
+	seen := map[any]int{}
+	for i, e := range seq {
+		em, ok := e.(map[string]any)
+		if !ok {
+			continue
 		}
-		// only return true if all values in v were updated
-		return updated, len(updated) == len(v)
-
-	// Mapping
-	case map[string]any:
-		m.resolvePaths(v, fileRoot, ctxpath)
-
-	// Scalar
-	case string:
-		if m.resolvePath(ctxpath) {
-			vv := filepath.Join(fileRoot, v)
-			log.Printf("\t Update[%s] %s -> %s", ctxpath, v, vv)
-			return vv, true
+		v := em[field]
+		if kind, ok := kindOf(v); !ok || kind != kindScalar {
+			continue
+		}
+		if j, dup := seen[v]; dup {
+			files := m.elementFiles[ctxpath]
+			if len(files) != len(seq) {
+				// The files of the elements are not known.
+				return fmt.Errorf("key[%s] duplicate %s %v", ctxpath, field, v)
+			}
+			return fmt.Errorf("key[%s] duplicate %s %v: in %s and %s", ctxpath, field, v, files[j], files[i])
 		}
+		seen[v] = i
 	}
-	return nil, false
+	return nil
 }
 
-func (m *merge) mergeMapping(dst, src map[string]any, ctxpath string) error {
+// isSealed reports whether a new key may not be added at ctxpath, which has
+// the given depth.
+func (m *merge) isSealed(ctxpath string, depth int) bool {
+	return m.count > 0 && depth <= m.sealDepth && !matchAny(m.allowedNewKeys, ctxpath)
+}
+
+// mergeMapping merges src into dst. The keys of both mappings have the given
+// depth, starting with 1 for the top-level keys.
+func (m *merge) mergeMapping(dst, src map[string]any, ctxpath string, depth int) error {
+	if depth > m.maxDepth {
+		return fmt.Errorf("key[%s] exceeds the maximum depth of %d", ctxpath, m.maxDepth)
+	}
 	for key, sv := range src {
-		cpath := ctxpath + "." + key
+		cpath := joinPath(ctxpath, key)
+		if dv, ok := dst[key]; ok && dv == nil {
+			// A null in dst is the same as a missing key.
+			delete(dst, key)
+		}
+		if _, exists := dst[key]; !exists && !(sv == nil && m.isNullDelete(cpath)) && m.isSealed(cpath, depth) {
+			return fmt.Errorf("key[%s] is not present in the base config (sealed to depth %d)", cpath, m.sealDepth)
+		}
+		listField := m.isListField(cpath)
+		if listField && sv != nil && !isContainer(sv) {
+			sv = []any{sv}
+		}
+		if _, exists := dst[key]; exists && m.isReplaceSubtree(cpath) {
+			// Merge src as if the key were missing.
+			delete(dst, key)
+		}
+		if dv, exists := dst[key]; exists && (listField || m.isCoerceToSequence(cpath)) {
+			_, dstSeq := dv.([]any)
+			_, srcSeq := sv.([]any)
+			switch {
+			case srcSeq && !dstSeq && !isContainer(dv):
+				dst[key] = []any{dv}
+				// The file that set the scalar is only known when annotating.
+				m.elementFiles[cpath] = []string{m.sources[cpath]}
+			case dstSeq && !srcSeq && sv != nil && !isContainer(sv):
+				sv = []any{sv}
+			}
+		}
+		// The value is checked as promoted to a sequence, if it is.
+		if m.decisions != nil {
+			m.explain(cpath, sv)
+		}
+		if m.schema != nil {
+			if err := m.schema.check(cpath, sv, m.file); err != nil {
+				return err
+			}
+		}
 		switch sv := sv.(type) {
 		// Sequence
 		case []any:
@@ -139,19 +1952,69 @@ func (m *merge) mergeMapping(dst, src map[string]any, ctxpath string) error {
 			switch {
 			case !exists:
 				dst[key] = sv
+				m.elementFiles[cpath] = m.repeatFile(len(sv))
+				m.setSource(cpath)
+				m.touch(cpath, sv)
 
 			case exists && isSlice:
-				if !m.isOverwrite(ctxpath) {
+				mode, ok := m.sequenceMode(cpath)
+				if !ok {
+					if !reflect.DeepEqual(dvv, sv) {
+						if err := m.resolveConflict(dst, key, cpath, depth, dv, sv); err != nil {
+							return err
+						}
+					}
+					continue
+				}
+				field, ok := m.mergeByField(cpath)
+				if !ok {
+					field, ok = m.schema.mergeByField(cpath)
+				}
+				if ok && mode != modeOverwrite {
+					var err error
+					if sv, err = m.mergeByKey(cpath, field, dvv, sv, depth); err != nil {
+						return err
+					}
+				}
+				m.touch(cpath, sv)
+				files := m.repeatFile(len(sv))
+				switch mode {
+				case modeAppend:
 					sv = append(dvv, sv...)
+					files = append(m.elementFiles[cpath], files...)
+				case modePrepend:
+					sv = append(sv, dvv...)
+					files = append(files, m.elementFiles[cpath]...)
+				case modeOverwrite:
+					m.overwritten(cpath, dvv, sv)
+					m.setSource(cpath)
 				}
 				dst[key] = sv
+				m.elementFiles[cpath] = files
+
+			case exists && !isSlice && m.isOverwrite(cpath):
+				// Restructure the key with the later value.
+				m.overwritten(cpath, dv, sv)
+				dst[key] = sv
+				m.elementFiles[cpath] = m.repeatFile(len(sv))
+				m.setSource(cpath)
+				m.touch(cpath, sv)
 
 			case exists && !isSlice:
-				return fmt.Errorf("key[%s] mismatch: src(%T) vs dst(%T)", cpath, sv, dv)
+				if err := m.resolveConflict(dst, key, cpath, depth, dv, sv); err != nil {
+					return err
+				}
+				continue
 
-			case exists && m.isOverwrite(ctxpath):
+			case exists && m.isOverwrite(cpath):
 				return fmt.Errorf("key[%s] duplicated (overrwrite=false)", cpath)
 			}
+			if err := m.checkUnique(cpath, dst[key].([]any)); err != nil {
+				return err
+			}
+			if max, ok := m.maxLen(cpath); ok && len(dst[key].([]any)) > max {
+				return fmt.Errorf("key[%s] has %d elements, more than its MaxSequenceLen of %d", cpath, len(dst[key].([]any)), max)
+			}
 
 		// Mapping
 		case map[string]any:
@@ -162,80 +2025,555 @@ func (m *merge) mergeMapping(dst, src map[string]any, ctxpath string) error {
 				// Dest Missing
 				dv := make(map[string]any)
 				dst[key] = dv
-				err := m.mergeMapping(dv, sv, cpath)
+				m.setSource(cpath)
+				m.touch(cpath, nil)
+				err := m.mergeMapping(dv, sv, cpath, depth+1)
 				if err != nil {
 					return err
 				}
+			case isMap && m.schema.isSingular(cpath):
+				// Dest replaced whole, if at all
+				switch {
+				case reflect.DeepEqual(dvv, sv):
+				case m.isOverwrite(cpath):
+					dv := make(map[string]any)
+					dst[key] = dv
+					m.setSource(cpath)
+					m.touch(cpath, nil)
+					if err := m.mergeMapping(dv, sv, cpath, depth+1); err != nil {
+						return err
+					}
+				default:
+					if err := m.resolveConflict(dst, key, cpath, depth, dv, sv); err != nil {
+						return err
+					}
+				}
 			case isMap:
 				// Dest Merge
-				err := m.mergeMapping(dvv, sv, cpath)
+				err := m.mergeMapping(dvv, sv, cpath, depth+1)
+				if err != nil {
+					return err
+				}
+			case m.isOverwrite(cpath):
+				// Dest type mismatch, replaced by src
+				dv := make(map[string]any)
+				dst[key] = dv
+				m.setSource(cpath)
+				m.touch(cpath, nil)
+				err := m.mergeMapping(dv, sv, cpath, depth+1)
 				if err != nil {
 					return err
 				}
 			default:
 				// Dest type mismatch
-				return fmt.Errorf("key[%s] mismatch: src(%T) vs dst(%T)", cpath, sv, dv)
+				if err := m.resolveConflict(dst, key, cpath, depth, dv, sv); err != nil {
+					return err
+				}
 			}
 
 		// Scalar
 		default:
 			dv, ok := dst[key]
 			switch {
+			case sv == nil && m.isNullDelete(cpath):
+				delete(dst, key)
+				m.touch(cpath, nil)
+			case ok && isString(dv) && isString(sv) && m.isConcatInline(cpath):
+				// A token of BlobSize is only restored whole, so the joined
+				// string holds the values.
+				dst[key] = concatLines(m.blobs.restoreValue(dv.(string)), m.blobs.restoreValue(sv.(string)))
+				m.touch(cpath, sv)
 			case ok && reflect.DeepEqual(sv, dv):
 				continue
-			case ok && !m.isOverwrite(ctxpath):
-				return fmt.Errorf("duplicate Keys(overrwrite=false): %s", cpath)
+			case ok && !m.isOverwrite(cpath):
+				if err := m.resolveConflict(dst, key, cpath, depth, dv, sv); err != nil {
+					return err
+				}
 			default:
+				if ok {
+					m.overwritten(cpath, dv, sv)
+				}
 				dst[key] = sv
+				m.setSource(cpath)
+				m.touch(cpath, sv)
 			}
 		}
 	}
 	return nil
 }
 
+// overwritten warns, with WarnOnOverwrite, that the file being merged
+// replaced dv, the value of the key at ctxpath, with sv.
+func (m *merge) overwritten(ctxpath string, dv, sv any) {
+	if !m.warnOverwrite || reflect.DeepEqual(dv, sv) {
+		return
+	}
+	m.warnings = append(m.warnings, Warning{
+		File:    m.file,
+		Path:    ctxpath,
+		Message: fmt.Sprintf("is overwritten: %v from %s is replaced by %v", dv, m.sourceOf(ctxpath), sv),
+	})
+}
+
+// isString returns whether v is a string.
+func isString(v any) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+// concatLines returns b appended to a, on a new line.
+func concatLines(a, b string) string {
+	if a == "" || strings.HasSuffix(a, "\n") {
+		return a + b
+	}
+	return a + "\n" + b
+}
+
+// isContainer returns whether v is a mapping or sequence.
+func isContainer(v any) bool {
+	switch v.(type) {
+	case map[string]any, []any:
+		return true
+	}
+	return false
+}
+
+// output serializes the merged config in the given format, or with the
+// Marshaler if there is one, restoring any strings held aside while merging.
+func (m *merge) output(format Format) ([]byte, error) {
+	if m.marshaler != nil {
+		if m.blobs != nil {
+			m.blobs.restoreValues(m.root)
+		}
+		out, err := m.marshaler(m.root)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding output: %w", err)
+		}
+		return out, nil
+	}
+	if m.blobs == nil {
+		return m.marshal(format)
+	}
+	if format == FormatJSON {
+		m.blobs.restoreValues(m.root)
+	}
+	out, err := m.marshal(format)
+	if err != nil {
+		return nil, err
+	}
+	return m.blobs.restore(out), nil
+}
+
+// marshal serializes the merged config in the given format, marking the
+// conflicts collected in YAML output if asked to.
+func (m *merge) marshal(format Format) ([]byte, error) {
+	if !m.markConflicts || (format != "" && format != FormatYAML) {
+		return marshal(m.root, m.policy, m.annotations(), format)
+	}
+	doc, err := encodeNode(m.root, m.policy, m.annotations())
+	if err != nil {
+		return nil, err
+	}
+	if err := m.markNode(doc, "$"); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// annotations returns the sources to annotate the output with, if any.
+func (m *merge) annotations() map[string]string {
+	if !m.annotate {
+		return nil
+	}
+	return m.sources
+}
+
+// setSource records the file being merged as the source of the key at
+// ctxpath, if annotating the output or tracking positions.
+func (m *merge) setSource(ctxpath string) {
+	if m.sources != nil {
+		m.sources[ctxpath] = m.file
+	}
+}
+
 func buildPolicy(c *Options) *mergePolicy {
-	var overwrite []policyEntry[bool]
+	var modes []policyEntry[mergeMode]
 	for _, pattern := range c.Overwrite {
-		overwrite = addPolicy(overwrite, pattern, true)
+		modes = addPolicy(modes, pattern, modeOverwrite)
 	}
 	for _, pattern := range c.Append {
-		overwrite = addPolicy(overwrite, pattern, false)
+		modes = addPolicy(modes, pattern, modeAppend)
+	}
+	for _, pattern := range c.Prepend {
+		modes = addPolicy(modes, pattern, modePrepend)
+	}
+	sortPolicies(modes)
+
+	var uniqueBy []policyEntry[string]
+	for _, pattern := range slices.Sorted(maps.Keys(c.UniqueBy)) {
+		uniqueBy = addPolicy(uniqueBy, pattern, c.UniqueBy[pattern])
+	}
+	sortPolicies(uniqueBy)
+
+	var mergeBy []policyEntry[string]
+	for _, pattern := range slices.Sorted(maps.Keys(c.MergeBy)) {
+		mergeBy = addPolicy(mergeBy, pattern, c.MergeBy[pattern])
+	}
+	sortPolicies(mergeBy)
+
+	var renameKeys []policyEntry[string]
+	for _, pattern := range slices.Sorted(maps.Keys(c.RenameKeys)) {
+		renameKeys = addPolicy(renameKeys, pattern, c.RenameKeys[pattern])
+	}
+	sortPolicies(renameKeys)
+
+	var maxSequenceLen []policyEntry[int]
+	for _, pattern := range slices.Sorted(maps.Keys(c.MaxSequenceLen)) {
+		maxSequenceLen = addPolicy(maxSequenceLen, pattern, c.MaxSequenceLen[pattern])
+	}
+	sortPolicies(maxSequenceLen)
+
+	var quote []policyEntry[bool]
+	for _, pattern := range c.ForceQuote {
+		quote = addPolicy(quote, pattern, true)
+	}
+	for _, pattern := range c.ForceUnquote {
+		quote = addPolicy(quote, pattern, false)
+	}
+	sortPolicies(quote)
+
+	p := &mergePolicy{
+		modes:            modes,
+		uniqueBy:         uniqueBy,
+		mergeBy:          mergeBy,
+		renameKeys:       renameKeys,
+		maxSequenceLen:   maxSequenceLen,
+		defaultOverwrite: c.DefaultOverWrite,
+		defaultSequence:  c.DefaultSequencePolicy,
+		nullDeletes:      c.NullDeletes,
+		deleteIfNull:     buildPatterns(c.DeleteIfNull),
+		sealDepth:        c.SealDepth,
+		allowedNewKeys:   buildPatterns(c.AllowedNewKeys),
+		resolvePaths:     buildPatterns(c.ResolvePath),
+		ignore:           buildPatterns(c.Ignore),
+		replaceSubtree:   buildPatterns(c.ReplaceSubtree),
+		coerceToSequence: buildPatterns(c.CoerceScalarToSequence),
+		listFields:       buildPatterns(c.ListFields),
+		concatInline:     buildPatterns(c.ConcatInline),
+		literalStyle:     buildPatterns(c.LiteralStyle),
+		quote:            quote,
+		keepEmpty:        buildPatterns(c.KeepEmpty),
+		sortSequences:    buildPatterns(c.SortSequences),
+		stringFields:     buildPatterns(c.StringFields),
+		octalModes:       c.NormalizeModes,
+		onlySections:     c.OnlySections,
+		skipSections:     c.SkipSections,
+		used:             map[string]bool{},
+	}
+	if c.CaseInsensitivePatterns {
+		foldCase(p.modes)
+		foldCase(p.uniqueBy)
+		foldCase(p.mergeBy)
+		foldCase(p.renameKeys)
+		foldCase(p.maxSequenceLen)
+		for _, entries := range p.patterns() {
+			foldCase(*entries)
+		}
+	}
+	s := &scope{}
+	hasQuery := setScope(p.modes, s)
+	hasQuery = setScope(p.uniqueBy, s) || hasQuery
+	hasQuery = setScope(p.mergeBy, s) || hasQuery
+	hasQuery = setScope(p.renameKeys, s) || hasQuery
+	hasQuery = setScope(p.maxSequenceLen, s) || hasQuery
+	for _, entries := range p.patterns() {
+		hasQuery = setScope(*entries, s) || hasQuery
+	}
+	if hasQuery {
+		p.scope = s
+	}
+	return p
+}
+
+// patterns returns the lists of patterns of p that match without a value.
+func (p *mergePolicy) patterns() []*[]policyEntry[bool] {
+	return []*[]policyEntry[bool]{
+		&p.deleteIfNull, &p.allowedNewKeys, &p.resolvePaths, &p.ignore,
+		&p.replaceSubtree, &p.coerceToSequence, &p.listFields, &p.literalStyle,
+		&p.quote, &p.keepEmpty, &p.sortSequences, &p.stringFields, &p.concatInline,
+	}
+}
+
+// clone returns a copy of p for a single merge. The copy shares the patterns
+// of p but has its own scope and record of the patterns used, so a policy
+// built once may be cloned by any number of concurrent merges.
+func (p *mergePolicy) clone() *mergePolicy {
+	c := *p
+	c.used = map[string]bool{}
+	if p.scope != nil {
+		c.scope = &scope{}
+		c.modes = rescope(p.modes, c.scope)
+		c.uniqueBy = rescope(p.uniqueBy, c.scope)
+		c.mergeBy = rescope(p.mergeBy, c.scope)
+		c.renameKeys = rescope(p.renameKeys, c.scope)
+		c.maxSequenceLen = rescope(p.maxSequenceLen, c.scope)
+		for _, entries := range c.patterns() {
+			*entries = rescope(*entries, c.scope)
+		}
+	}
+	return &c
+}
+
+// foldCase makes the entries match context paths without regard to case.
+func foldCase[T comparable](entries []policyEntry[T]) {
+	for i := range entries {
+		entries[i].foldCase = true
+	}
+}
+
+// setScope sets the scope that the queries among entries are matched within,
+// and returns whether there are any.
+func setScope[T comparable](entries []policyEntry[T], s *scope) bool {
+	found := false
+	for i := range entries {
+		if entries[i].query != nil {
+			entries[i].scope = s
+			found = true
+		}
 	}
-	// Absolute patterns before relative patterns.
-	slices.SortFunc(overwrite, func(a, b policyEntry[bool]) int {
+	return found
+}
+
+// rescope returns a copy of entries whose queries match within s.
+func rescope[T comparable](entries []policyEntry[T], s *scope) []policyEntry[T] {
+	entries = slices.Clone(entries)
+	setScope(entries, s)
+	return entries
+}
+
+// sortPolicies orders the entries by precedence.
+func sortPolicies[T comparable](entries []policyEntry[T]) {
+	// Queries, which are the most specific, before absolute patterns before
+	// relative patterns before patterns with descent. Patterns of the same
+	// kind are ordered by specificity and otherwise keep the order they were
+	// added in.
+	slices.SortStableFunc(entries, func(a, b policyEntry[T]) int {
 		return cmp.Or(
+			compareBool(a.query == nil, b.query == nil),
+			compareBool(a.descent, b.descent),
 			compareBool(a.isRelative, b.isRelative),
-			cmp.Compare(a.pattern, b.pattern))
+			cmp.Compare(b.specificity, a.specificity))
 	})
+}
 
-	var resolvePaths []policyEntry[bool]
-	for _, pattern := range c.ResolvePath {
-		resolvePaths = addPolicy(resolvePaths, pattern, true)
+// buildPatterns builds a table of patterns that either match or do not.
+func buildPatterns(patterns []string) []policyEntry[bool] {
+	var entries []policyEntry[bool]
+	for _, pattern := range patterns {
+		entries = addPolicy(entries, pattern, true)
 	}
-	return &mergePolicy{
-		overwrite:        overwrite,
-		defaultOverwrite: c.DefaultOverWrite,
-		resolvePaths:     resolvePaths,
+	return entries
+}
+
+// mergeMode is the behavior applied when a key is present in both the merged
+// config and the file being merged.
+type mergeMode int
+
+const (
+	modeAppend mergeMode = iota
+	modeOverwrite
+	modePrepend
+)
+
+func parseMergeMode(v any) (mergeMode, bool) {
+	switch v {
+	case "append":
+		return modeAppend, true
+	case "overwrite":
+		return modeOverwrite, true
+	case "prepend":
+		return modePrepend, true
 	}
+	return 0, false
 }
 
+// mergePolicy is the policy built from Options. Only the scope and the record
+// of the patterns used change once it is built, so a policy is shared between
+// merges by giving each a clone.
 type mergePolicy struct {
-	overwrite        []policyEntry[bool]
+	modes            []policyEntry[mergeMode]
+	uniqueBy         []policyEntry[string]
+	mergeBy          []policyEntry[string]
+	renameKeys       []policyEntry[string]
+	maxSequenceLen   []policyEntry[int]
 	defaultOverwrite bool
+	defaultSequence  SequencePolicy
+	nullDeletes      bool
+	deleteIfNull     []policyEntry[bool]
+	sealDepth        int
+	allowedNewKeys   []policyEntry[bool]
 	resolvePaths     []policyEntry[bool]
+	ignore           []policyEntry[bool]
+	replaceSubtree   []policyEntry[bool]
+	coerceToSequence []policyEntry[bool]
+	listFields       []policyEntry[bool]
+	concatInline     []policyEntry[bool]
+	literalStyle     []policyEntry[bool]
+	quote            []policyEntry[bool]
+	keepEmpty        []policyEntry[bool]
+	sortSequences    []policyEntry[bool]
+	stringFields     []policyEntry[bool]
+	// octalModes emits file modes in octal.
+	octalModes   bool
+	onlySections []string
+	skipSections []string
+
+	// scope holds the sequence elements enclosing the value being matched,
+	// when any pattern is a query.
+	scope *scope
+
+	// used holds the patterns that applied during the merge, keyed by the
+	// name of their list and the pattern.
+	used map[string]bool
+}
+
+// resolve returns the mode of the key at contextPath and the entry of the
+// Overwrite, Append and Prepend table that decided it, if any. Entries are
+// tried in the order sortPolicies leaves them, so the first match wins:
+//
+//  1. queries,
+//  2. absolute patterns,
+//  3. relative patterns,
+//  4. patterns with descent, such as `$..mode`,
+//
+// each kind from the most specific pattern to the least, and then in the order
+// the patterns were declared. If none matches, ok is false and the mode is the
+// default given by DefaultOverWrite.
+func (m *mergePolicy) resolve(contextPath string) (mode mergeMode, matched policyEntry[mergeMode], ok bool) {
+	for _, entry := range m.modes {
+		if entry.match(contextPath) {
+			return entry.policy, entry, true
+		}
+	}
+	if m.defaultOverwrite {
+		return modeOverwrite, policyEntry[mergeMode]{}, false
+	}
+	return modeAppend, policyEntry[mergeMode]{}, false
+}
+
+func (m *mergePolicy) mode(contextPath string) mergeMode {
+	mode, _, _ := m.resolve(contextPath)
+	return mode
 }
 
 func (m *mergePolicy) isOverwrite(contextPath string) bool {
-	for _, entry := range m.overwrite {
+	return m.mode(contextPath) == modeOverwrite
+}
+
+func (m *mergePolicy) uniqueField(contextPath string) (string, bool) {
+	for _, entry := range m.uniqueBy {
+		if entry.match(contextPath) {
+			return entry.policy, true
+		}
+	}
+	return "", false
+}
+
+func (m *mergePolicy) mergeByField(contextPath string) (string, bool) {
+	for _, entry := range m.mergeBy {
+		if entry.match(contextPath) {
+			return entry.policy, true
+		}
+	}
+	return "", false
+}
+
+func (m *mergePolicy) maxLen(contextPath string) (int, bool) {
+	for _, entry := range m.maxSequenceLen {
+		if entry.match(contextPath) {
+			return entry.policy, true
+		}
+	}
+	return 0, false
+}
+
+func (m *mergePolicy) renameKey(contextPath string) (string, bool) {
+	for _, entry := range m.renameKeys {
 		if entry.match(contextPath) {
-			return entry.policy
+			return entry.policy, true
 		}
 	}
-	return m.defaultOverwrite
+	return "", false
 }
 
 func (m *mergePolicy) resolvePath(contextPath string) bool {
-	for _, entry := range m.resolvePaths {
+	return matchAny(m.resolvePaths, contextPath)
+}
+
+func (m *mergePolicy) isIgnored(contextPath string) bool {
+	return matchAny(m.ignore, contextPath)
+}
+
+// isNullDelete returns whether a null value deletes the key at contextPath.
+func (m *mergePolicy) isNullDelete(contextPath string) bool {
+	return m.nullDeletes || matchAny(m.deleteIfNull, contextPath)
+}
+
+func (m *mergePolicy) isCoerceToSequence(contextPath string) bool {
+	return matchAny(m.coerceToSequence, contextPath)
+}
+
+func (m *mergePolicy) isListField(contextPath string) bool {
+	return matchAny(m.listFields, contextPath)
+}
+
+func (m *mergePolicy) isConcatInline(contextPath string) bool {
+	return matchAny(m.concatInline, contextPath)
+}
+
+func (m *mergePolicy) isReplaceSubtree(contextPath string) bool {
+	return matchAny(m.replaceSubtree, contextPath)
+}
+
+func (m *mergePolicy) isKeepEmpty(contextPath string) bool {
+	return matchAny(m.keepEmpty, contextPath)
+}
+
+func (m *mergePolicy) isSortSequence(contextPath string) bool {
+	return matchAny(m.sortSequences, contextPath)
+}
+
+func (m *mergePolicy) isStringField(contextPath string) bool {
+	return matchAny(m.stringFields, contextPath)
+}
+
+// filterSections drops the top-level keys of config that are not among
+// onlySections, if set, or are among skipSections.
+func (m *mergePolicy) filterSections(config map[string]any) {
+	for key := range config {
+		if (len(m.onlySections) > 0 && !slices.Contains(m.onlySections, key)) || slices.Contains(m.skipSections, key) {
+			delete(config, key)
+		}
+	}
+}
+
+func (m *mergePolicy) isLiteralStyle(contextPath string) bool {
+	return matchAny(m.literalStyle, contextPath)
+}
+
+// quoteStyle returns whether the scalar at contextPath is forced to be quoted
+// or unquoted, if either.
+func (m *mergePolicy) quoteStyle(contextPath string) (quote bool, ok bool) {
+	for _, entry := range m.quote {
+		if entry.match(contextPath) {
+			return entry.policy, true
+		}
+	}
+	return false, false
+}
+
+func matchAny[T comparable](entries []policyEntry[T], contextPath string) bool {
+	for _, entry := range entries {
 		if entry.match(contextPath) {
 			return true
 		}
@@ -247,32 +2585,116 @@ type policyEntry[T comparable] struct {
 	pattern    string
 	policy     T
 	isRelative bool
+	foldCase   bool
+	// descent is set for a pattern with `..`, which matches any number of
+	// segments, such as `$..mode`.
+	descent bool
+	// segments holds the segments of a relative pattern or a pattern with
+	// descent.
+	segments []string
+	// query is the compiled query of a JSONPath pattern, which is matched
+	// within the sequence elements held by scope.
+	query *query
+	scope *scope
+	// specificity is the number of keys and selectors a path matched by the
+	// pattern must have, such as 2 for `.contents.local`. It is zero for a
+	// query.
+	specificity int
 }
 
+// match reports whether the entry matches contextPath. A relative pattern
+// matches when its segments equal the trailing segments of contextPath, so
+// `.contents.local` matches `$.storage.files.contents.local` but `.local` does
+// not match `$.storage.my\.local`. A path within a sequence element merged by
+// key, such as `$.storage.files[path=/etc/foo].mode`, matches patterns with
+// the same selector and patterns without, such as `$.storage.files.mode`.
 func (e policyEntry[T]) match(contextPath string) bool {
-	if e.isRelative && strings.HasSuffix(contextPath, string(e.pattern)) {
+	if e.matchPath(contextPath) {
 		return true
 	}
-	if e.pattern == contextPath {
-		return true
+	if plain, ok := stripSelectors(contextPath); ok {
+		return e.matchPath(plain)
 	}
 	return false
 }
 
+func (e policyEntry[T]) matchPath(contextPath string) bool {
+	equal := func(a, b string) bool { return a == b }
+	if e.foldCase {
+		equal = strings.EqualFold
+	}
+	if e.query != nil {
+		return e.query.match(contextPath, e.scope, equal)
+	}
+	if e.descent {
+		return matchSegments(e.segments, splitPath(contextPath), equal)
+	}
+	if !e.isRelative {
+		return equal(e.pattern, contextPath)
+	}
+	segments := splitPath(contextPath)
+	n := len(segments) - len(e.segments)
+	return n > 0 && slices.EqualFunc(segments[n:], e.segments, equal)
+}
+
+// matchSegments reports whether the segments of a pattern match the whole of
+// the segments of a context path. An empty pattern segment, from `..`,
+// matches any number of path segments.
+func matchSegments(pattern, path []string, equal func(a, b string) bool) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:], equal) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(path) > 0 && equal(pattern[0], path[0]) && matchSegments(pattern[1:], path[1:], equal)
+}
+
 func addPolicy[T comparable](policies []policyEntry[T], pattern string, policy T) []policyEntry[T] {
 	if slices.ContainsFunc(policies, func(p policyEntry[T]) bool {
 		return p.pattern == pattern && p.policy != policy
 	}) {
 		panic("config contains conflicting policies")
 	}
+	if isQuery(pattern) {
+		q, err := compileQuery(pattern)
+		if err != nil {
+			// Queries are checked by checkQueries before policies are built.
+			panic(err)
+		}
+		return append(policies, policyEntry[T]{pattern: pattern, policy: policy, query: q})
+	}
 	if !strings.HasPrefix(pattern, ".") && !strings.HasPrefix(pattern, "$.") {
 		pattern = "$." + pattern
 	}
-	return append(policies, policyEntry[T]{
+	entry := policyEntry[T]{
 		pattern:    pattern,
 		policy:     policy,
 		isRelative: strings.HasPrefix(pattern, "."),
-	})
+	}
+	if entry.isRelative {
+		entry.segments = splitPath(pattern)[1:]
+	}
+	if segments := splitPath(pattern); slices.Contains(segments[1:], "") {
+		// A relative pattern may match after any leading segments.
+		entry.descent = true
+		entry.segments = segments
+	}
+	for _, segment := range splitPath(pattern)[1:] {
+		if segment == "" {
+			continue
+		}
+		entry.specificity++
+		if _, ok := stripSelectors(segment); ok {
+			entry.specificity++
+		}
+	}
+	return append(policies, entry)
 }
 
 func compareBool(a, b bool) int {
@@ -1,11 +1,21 @@
 package butanex
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/go-cmp/cmp"
 	yaml "gopkg.in/yaml.v3"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -55,6 +65,67 @@ func TestMergeFiles(t *testing.T) {
 				"host-dir/input2.yaml",
 			},
 		},
+		{
+			name: "ignore",
+			config: &Options{
+				FilesDir: "./ignore",
+				Ignore: []string{
+					"$.x-owner",
+					".x-ticket",
+				},
+			},
+			files: []string{
+				"input1.yaml",
+				"input2.yaml",
+			},
+		},
+		{
+			name: "json",
+			config: &Options{
+				FilesDir: "./json",
+			},
+			files: []string{
+				"input1.yaml",
+				"input2.json",
+			},
+		},
+		{
+			name: "prepend",
+			config: &Options{
+				FilesDir: "./prepend",
+				Prepend: []string{
+					"$.kernel_arguments.should_exist",
+				},
+			},
+			files: []string{
+				"input1.yaml",
+				"input2.yaml",
+			},
+		},
+		{
+			name: "template",
+			config: &Options{
+				FilesDir: "./template",
+				TemplateData: map[string]string{
+					"Hostname": "host-a",
+				},
+			},
+			files: []string{
+				"input1.yaml",
+				"host/input2.yaml",
+			},
+		},
+		{
+			name: "strategy",
+			config: &Options{
+				FilesDir:    "./strategy",
+				StrategyKey: "x-merge",
+			},
+			files: []string{
+				"input1.yaml",
+				"input2.yaml",
+			},
+		},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -126,6 +197,54 @@ func TestMergePolicy(t *testing.T) {
 			ctxpath: "$.storage.files",
 			want:    false,
 		},
+		{
+			name: "relative-path/two-segments/match",
+			config: &Options{
+				Overwrite: []string{".contents.local"},
+			},
+			ctxpath: "$.storage.files.contents.local",
+			want:    true,
+		},
+		{
+			name: "relative-path/two-segments/no-match",
+			config: &Options{
+				Overwrite: []string{".contents.local"},
+			},
+			ctxpath: "$.storage.files.local",
+			want:    false,
+		},
+		{
+			name: "relative-path/three-segments/match",
+			config: &Options{
+				Overwrite: []string{".files.contents.local"},
+			},
+			ctxpath: "$.storage.files.contents.local",
+			want:    true,
+		},
+		{
+			name: "relative-path/three-segments/no-match",
+			config: &Options{
+				Overwrite: []string{".files.contents.local"},
+			},
+			ctxpath: "$.storage.myfiles.contents.local",
+			want:    false,
+		},
+		{
+			name: "relative-path/partial-segment",
+			config: &Options{
+				Overwrite: []string{".local"},
+			},
+			ctxpath: `$.storage.myfiles\.local`,
+			want:    false,
+		},
+		{
+			name: "relative-path/whole-path",
+			config: &Options{
+				Overwrite: []string{".storage.files"},
+			},
+			ctxpath: "$.storage.files",
+			want:    true,
+		},
 		{
 			name: "both-types/absolute-wins",
 			config: &Options{
@@ -135,6 +254,32 @@ func TestMergePolicy(t *testing.T) {
 			ctxpath: "$.storage.files.local",
 			want:    false,
 		},
+		{
+			name: "case-sensitive/no-match",
+			config: &Options{
+				Overwrite: []string{"$.storage.files", ".local"},
+			},
+			ctxpath: "$.Storage.Files",
+			want:    false,
+		},
+		{
+			name: "case-insensitive/absolute-path",
+			config: &Options{
+				Overwrite:               []string{"$.storage.files"},
+				CaseInsensitivePatterns: true,
+			},
+			ctxpath: "$.Storage.files",
+			want:    true,
+		},
+		{
+			name: "case-insensitive/relative-path",
+			config: &Options{
+				Overwrite:               []string{".Contents.local"},
+				CaseInsensitivePatterns: true,
+			},
+			ctxpath: "$.storage.files.contents.LOCAL",
+			want:    true,
+		},
 	}
 
 	for _, tc := range cases {
@@ -147,3 +292,2807 @@ func TestMergePolicy(t *testing.T) {
 		})
 	}
 }
+
+func TestResolvePrecedence(t *testing.T) {
+	cases := []struct {
+		name        string
+		config      *Options
+		ctxpath     string
+		want        mergeMode
+		wantPattern string
+		wantOK      bool
+	}{
+		{
+			name:    "default-append",
+			config:  &Options{Overwrite: []string{".mode"}},
+			ctxpath: "$.storage.files.path",
+			want:    modeAppend,
+		},
+		{
+			name:    "default-overwrite",
+			config:  &Options{DefaultOverWrite: true, Append: []string{".mode"}},
+			ctxpath: "$.storage.files.path",
+			want:    modeOverwrite,
+		},
+		{
+			name:        "absolute",
+			config:      &Options{Overwrite: []string{"storage.files"}},
+			ctxpath:     "$.storage.files",
+			want:        modeOverwrite,
+			wantPattern: "$.storage.files",
+			wantOK:      true,
+		},
+		{
+			name:        "relative",
+			config:      &Options{DefaultOverWrite: true, Append: []string{".files"}},
+			ctxpath:     "$.storage.files",
+			want:        modeAppend,
+			wantPattern: ".files",
+			wantOK:      true,
+		},
+		{
+			name:        "absolute-over-relative",
+			config:      &Options{Overwrite: []string{".files"}, Prepend: []string{"$.storage.files"}},
+			ctxpath:     "$.storage.files",
+			want:        modePrepend,
+			wantPattern: "$.storage.files",
+			wantOK:      true,
+		},
+		{
+			name:        "absolute-over-longer-relative",
+			config:      &Options{Overwrite: []string{".storage.files"}, Append: []string{"$.storage.files"}},
+			ctxpath:     "$.storage.files",
+			want:        modeAppend,
+			wantPattern: "$.storage.files",
+			wantOK:      true,
+		},
+		{
+			name:        "relative-most-specific",
+			config:      &Options{Overwrite: []string{".local"}, Prepend: []string{".contents.local"}},
+			ctxpath:     "$.storage.files.contents.local",
+			want:        modePrepend,
+			wantPattern: ".contents.local",
+			wantOK:      true,
+		},
+		{
+			name:        "relative-broader-elsewhere",
+			config:      &Options{Overwrite: []string{".local"}, Prepend: []string{".contents.local"}},
+			ctxpath:     "$.storage.trees.local",
+			want:        modeOverwrite,
+			wantPattern: ".local",
+			wantOK:      true,
+		},
+		{
+			// Both patterns name two keys.
+			name:        "equally-specific",
+			config:      &Options{Overwrite: []string{"$.storage..mode"}, Append: []string{"$..files.mode"}},
+			ctxpath:     "$.storage.files.mode",
+			want:        modeOverwrite,
+			wantPattern: "$.storage..mode",
+			wantOK:      true,
+		},
+		{
+			name:        "equally-specific-overwrite-first",
+			config:      &Options{Append: []string{"$.storage..mode"}, Overwrite: []string{"$..files.mode"}},
+			ctxpath:     "$.storage.files.mode",
+			want:        modeOverwrite,
+			wantPattern: "$..files.mode",
+			wantOK:      true,
+		},
+		{
+			name:        "absolute-selector-most-specific",
+			config:      &Options{Overwrite: []string{"$.storage.files.mode"}, Append: []string{"$.storage.files[path=/etc/foo].mode"}},
+			ctxpath:     "$.storage.files[path=/etc/foo].mode",
+			want:        modeAppend,
+			wantPattern: "$.storage.files[path=/etc/foo].mode",
+			wantOK:      true,
+		},
+		{
+			name:        "absolute-selector-other-element",
+			config:      &Options{Overwrite: []string{"$.storage.files.mode"}, Append: []string{"$.storage.files[path=/etc/foo].mode"}},
+			ctxpath:     "$.storage.files[path=/etc/bar].mode",
+			want:        modeOverwrite,
+			wantPattern: "$.storage.files.mode",
+			wantOK:      true,
+		},
+		{
+			name:        "descent-most-specific",
+			config:      &Options{Overwrite: []string{"$..mode"}, Prepend: []string{"$.storage..mode"}},
+			ctxpath:     "$.storage.files.mode",
+			want:        modePrepend,
+			wantPattern: "$.storage..mode",
+			wantOK:      true,
+		},
+		{
+			name:        "queries-declaration-order",
+			config:      &Options{Overwrite: []string{"jsonpath:$..mode"}, Append: []string{"jsonpath:$.storage.files[*].mode"}},
+			ctxpath:     "$.storage.files.mode",
+			want:        modeOverwrite,
+			wantPattern: "jsonpath:$..mode",
+			wantOK:      true,
+		},
+		{
+			name:        "query-over-absolute",
+			config:      &Options{Overwrite: []string{"$.storage.files"}, Append: []string{"jsonpath:$..files"}},
+			ctxpath:     "$.storage.files",
+			want:        modeAppend,
+			wantPattern: "jsonpath:$..files",
+			wantOK:      true,
+		},
+		{
+			name:        "element-path",
+			config:      &Options{Overwrite: []string{"$.storage.files.mode"}},
+			ctxpath:     "$.storage.files[path=/etc/foo].mode",
+			want:        modeOverwrite,
+			wantPattern: "$.storage.files.mode",
+			wantOK:      true,
+		},
+		{
+			name:    "no-partial-segment",
+			config:  &Options{Overwrite: []string{".les"}},
+			ctxpath: "$.storage.files",
+			want:    modeAppend,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, entry, ok := buildPolicy(tc.config).resolve(tc.ctxpath)
+			if got != tc.want || entry.pattern != tc.wantPattern || ok != tc.wantOK {
+				t.Errorf("resolve() got %d, %q, %t wanted %d, %q, %t", got, entry.pattern, ok, tc.want, tc.wantPattern, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestDescentPatterns(t *testing.T) {
+	cases := []struct {
+		pattern string
+		ctxpath string
+		want    bool
+	}{
+		{pattern: "$..mode", ctxpath: "$.mode", want: true},
+		{pattern: "$..mode", ctxpath: "$.storage.files.mode", want: true},
+		{pattern: "$..mode", ctxpath: "$.storage.directories.mode", want: true},
+		{pattern: "$..mode", ctxpath: "$.storage.files[path=/etc/foo].mode", want: true},
+		{pattern: "$..mode", ctxpath: "$.storage.files.automode", want: false},
+		{pattern: "$..mode", ctxpath: "$.storage.files.mode.x", want: false},
+		{pattern: "$..mode", ctxpath: `$.storage.files.a\.mode`, want: false},
+		{pattern: "$.storage..mode", ctxpath: "$.storage.files.mode", want: true},
+		{pattern: "$.storage..mode", ctxpath: "$.systemd.mode", want: false},
+		{pattern: "$..files..inline", ctxpath: "$.storage.files.contents.inline", want: true},
+		{pattern: ".files..inline", ctxpath: "$.storage.files.contents.inline", want: true},
+		{pattern: ".files..inline", ctxpath: "$.storage.files.inline", want: true},
+		{pattern: ".files..inline", ctxpath: "$.storage.directories.inline", want: false},
+	}
+	for _, tc := range cases {
+		entries := buildPatterns([]string{tc.pattern})
+		if got := matchAny(entries, tc.ctxpath); got != tc.want {
+			t.Errorf("match(%q, %q) got %t wanted %t", tc.pattern, tc.ctxpath, got, tc.want)
+		}
+	}
+
+	options, err := ParsePolicySpec("overwrite=$..mode;append=.mode")
+	if err != nil {
+		t.Fatalf("ParsePolicySpec() got err: %s", err)
+	}
+	policy := buildPolicy(options)
+	if _, entry, _ := policy.resolve("$.storage.files.mode"); entry.pattern != ".mode" {
+		t.Errorf("resolve() got pattern %q, wanted relative pattern to win over descent", entry.pattern)
+	}
+	if _, entry, _ := policy.resolve("$.storage.files.automode"); entry.pattern != "" {
+		t.Errorf("resolve() got pattern %q, wanted no match", entry.pattern)
+	}
+}
+
+func TestMergeMode(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  *Options
+		ctxpath string
+		want    mergeMode
+	}{
+		{
+			name:    "default",
+			config:  &Options{},
+			ctxpath: "$.kernel_arguments.should_exist",
+			want:    modeAppend,
+		},
+		{
+			name: "prepend",
+			config: &Options{
+				Prepend: []string{".should_exist"},
+			},
+			ctxpath: "$.kernel_arguments.should_exist",
+			want:    modePrepend,
+		},
+		{
+			name: "absolute-prepend-wins",
+			config: &Options{
+				Overwrite: []string{".should_exist"},
+				Prepend:   []string{"$.kernel_arguments.should_exist"},
+			},
+			ctxpath: "$.kernel_arguments.should_exist",
+			want:    modePrepend,
+		},
+		{
+			name: "absolute-append-wins",
+			config: &Options{
+				Prepend: []string{".should_exist"},
+				Append:  []string{"$.kernel_arguments.should_exist"},
+			},
+			ctxpath: "$.kernel_arguments.should_exist",
+			want:    modeAppend,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := buildPolicy(tc.config).mode(tc.ctxpath)
+			if got != tc.want {
+				t.Errorf("mode() got %d wanted %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeModeKeyPath(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"base.yaml":    "storage:\n  files:\n    - path: /etc/a\n",
+		"overlay.yaml": "storage:\n  files:\n    - path: /etc/b\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := []struct {
+		name      string
+		overwrite []string
+		want      string
+	}{
+		{
+			name:      "key-path",
+			overwrite: []string{"$.storage.files"},
+			want:      "storage:\n  files:\n    - path: /etc/b\n",
+		},
+		{
+			// The path of the mapping holding the key no longer applies.
+			name:      "parent-path",
+			overwrite: []string{"$.storage"},
+			want:      "storage:\n  files:\n    - path: /etc/a\n    - path: /etc/b\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MergeFiles(&Options{FilesDir: dir, Overwrite: tc.overwrite}, "base.yaml", "overlay.yaml")
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestMergeFileSpecs(t *testing.T) {
+	cases := []struct {
+		name    string
+		options *Options
+		specs   []FileSpec
+		want    string
+	}{
+		{
+			name: "overlay-appends",
+			options: &Options{
+				FilesDir:         "./overwrite",
+				DefaultOverWrite: true,
+			},
+			specs: []FileSpec{
+				{Path: "input1.yaml"},
+				{Path: "input2.yaml", Options: &Options{}},
+			},
+			want: `
+variant: fcos
+version: 1.5.0
+passwd:
+  users:
+    - name: user1
+      ssh_authorized_keys:
+        - key1
+storage:
+  files:
+    - path: /opt/file
+      contents:
+        inline: Hello, world!
+    - path: /opt/file
+      contents:
+        inline: Not Hello World
+`,
+		},
+		{
+			name: "overlay-overwrites",
+			options: &Options{
+				FilesDir: "./overwrite",
+			},
+			specs: []FileSpec{
+				{Path: "input1.yaml"},
+				{Path: "input2.yaml", Options: &Options{DefaultOverWrite: true}},
+			},
+			want: `
+variant: fcos
+version: 1.5.0
+passwd:
+  users:
+    - name: user1
+      ssh_authorized_keys:
+        - key1
+storage:
+  files:
+    - path: /opt/file
+      contents:
+        inline: Not Hello World
+`,
+		},
+		{
+			name: "explicit-root",
+			options: &Options{
+				FilesDir:    "./resolve-path",
+				ResolvePath: []string{".local"},
+			},
+			specs: []FileSpec{
+				{Path: "host-dir/input2.yaml", Root: "hosts/example"},
+			},
+			want: `
+variant: fcos
+version: 1.5.0
+storage:
+  files:
+    - path: /opt/file2
+      contents:
+        local: hosts/example/input-file.txt
+`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MergeFileSpecs(tc.options, tc.specs...)
+			if err != nil {
+				t.Fatalf("MergeFileSpecs() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFileSpecs() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSections(t *testing.T) {
+	base := "variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n    - path: /etc/motd\nsystemd:\n  units:\n    - name: base.service\n"
+	overlay := "variant: fcos\nversion: 1.4.0\nstorage:\n  files:\n    - path: /etc/hosts\nsystemd:\n  units:\n    - name: overlay.service\npasswd:\n  users:\n    - name: core\n"
+	cases := []struct {
+		name    string
+		options *Options
+		specs   []FileSpec
+		want    string
+	}{
+		{
+			name:  "storage-only-overlay",
+			specs: []FileSpec{{Path: "base.yaml"}, {Path: "overlay.yaml", Options: &Options{OnlySections: []string{"storage"}}}},
+			want:  "variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n    - path: /etc/motd\n    - path: /etc/hosts\nsystemd:\n  units:\n    - name: base.service\n",
+		},
+		{
+			name:  "skip-overlay-sections",
+			specs: []FileSpec{{Path: "base.yaml"}, {Path: "overlay.yaml", Options: &Options{SkipSections: []string{"version", "systemd"}}}},
+			want:  "variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n    - path: /etc/motd\n    - path: /etc/hosts\nsystemd:\n  units:\n    - name: base.service\npasswd:\n  users:\n    - name: core\n",
+		},
+		{
+			name:    "global",
+			options: &Options{OnlySections: []string{"variant", "storage", "passwd"}, SkipSections: []string{"passwd"}},
+			specs:   []FileSpec{{Path: "base.yaml"}, {Path: "overlay.yaml"}},
+			want:    "variant: fcos\nstorage:\n  files:\n    - path: /etc/motd\n    - path: /etc/hosts\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.options == nil {
+				tc.options = &Options{}
+			}
+			tc.options.FilesDir = writeFiles(t, map[string]string{
+				"base.yaml":    base,
+				"overlay.yaml": overlay,
+			})
+			got, err := MergeFileSpecs(tc.options, tc.specs...)
+			if err != nil {
+				t.Fatalf("MergeFileSpecs() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFileSpecs() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	input := []byte(`
+version: "1.5.0"
+variant: 'fcos'
+storage:
+  files:
+    - contents: {inline: "Hello"}
+      path: /opt/file
+`)
+	want := `storage:
+    files:
+        - contents:
+            inline: Hello
+          path: /opt/file
+variant: fcos
+version: 1.5.0
+`
+	got, err := Canonicalize(input)
+	if err != nil {
+		t.Fatalf("Canonicalize() got err: %s", err)
+	}
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("Canonicalize() got diff: -want/+got: %s", diff)
+	}
+	again, err := Canonicalize(got)
+	if err != nil {
+		t.Fatalf("Canonicalize() got err: %s", err)
+	}
+	if diff := cmp.Diff(got, again); diff != "" {
+		t.Errorf("Canonicalize() not idempotent: -first/+second: %s", diff)
+	}
+}
+
+func TestMergeFilesIsCanonical(t *testing.T) {
+	got, err := MergeFiles(&Options{FilesDir: "./simple"}, "input1.yaml", "input2.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	canonical, err := Canonicalize(got)
+	if err != nil {
+		t.Fatalf("Canonicalize() got err: %s", err)
+	}
+	if diff := cmp.Diff(got, canonical); diff != "" {
+		t.Errorf("MergeFiles() output not canonical: -merged/+canonical: %s", diff)
+	}
+}
+
+func TestMergeFilesContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := MergeFilesContext(ctx, &Options{FilesDir: "./simple"}, "input1.yaml", "input2.yaml")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("MergeFilesContext() got err %v wanted %v", err, context.Canceled)
+	}
+}
+
+func TestStrictResolve(t *testing.T) {
+	cases := []struct {
+		name    string
+		options *Options
+		wantErr string
+	}{
+		{
+			name: "string",
+			options: &Options{
+				FilesDir:      "./resolve-path",
+				ResolvePath:   []string{".local"},
+				StrictResolve: true,
+			},
+		},
+		{
+			name: "mapping/not-strict",
+			options: &Options{
+				FilesDir:    "./resolve-path",
+				ResolvePath: []string{".contents"},
+			},
+		},
+		{
+			name: "mapping/strict",
+			options: &Options{
+				FilesDir:      "./resolve-path",
+				ResolvePath:   []string{".contents"},
+				StrictResolve: true,
+			},
+			wantErr: "key[$.storage.files.contents] resolve path matched map[string]interface {}, want string",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := MergeFiles(tc.options, "common/input1.yaml")
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("MergeFiles() got err: %s", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyResolvedPaths(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"host/present.yaml": "storage:\n  files:\n    - path: /etc/motd\n      contents:\n        local: motd.txt\n",
+		"host/motd.txt":     "hello\n",
+		"host/missing.yaml": "storage:\n  files:\n    - path: /etc/issue\n      contents:\n        local: issue.txt\n",
+	})
+	options := &Options{FilesDir: dir, ResolvePath: []string{".local"}, VerifyResolvedPaths: true}
+	if _, err := MergeFiles(options, "host/present.yaml"); err != nil {
+		t.Errorf("MergeFiles() got err: %s", err)
+	}
+	_, err := MergeFiles(options, "host/present.yaml", "host/missing.yaml")
+	wantErr := "file[host/missing.yaml]: phase[resolve]: key[$.storage.files.contents.local] resolved path host/issue.txt does not exist"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("MergeFiles() got err %v wanted %q", err, wantErr)
+	}
+	options.VerifyResolvedPaths = false
+	if _, err := MergeFiles(options, "host/present.yaml", "host/missing.yaml"); err != nil {
+		t.Errorf("MergeFiles() got err: %s", err)
+	}
+}
+
+// writeFiles writes each of the files to a temporary directory and returns the
+// directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("error creating directory: %s", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("error writing file: %s", err)
+		}
+	}
+	return dir
+}
+
+func TestNullValues(t *testing.T) {
+	cases := []struct {
+		name    string
+		options *Options
+		input1  string
+		input2  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "null-over-value",
+			options: &Options{},
+			input1:  "hostname: a\n",
+			input2:  "hostname:\n",
+			wantErr: true,
+		},
+		{
+			name:    "null-over-value/overwrite",
+			options: &Options{DefaultOverWrite: true},
+			input1:  "hostname: a\n",
+			input2:  "hostname:\n",
+			want:    "hostname: null\n",
+		},
+		{
+			name:    "null-over-value/null-deletes",
+			options: &Options{NullDeletes: true},
+			input1:  "hostname: a\nversion: 1.5.0\n",
+			input2:  "hostname:\n",
+			want:    "version: 1.5.0\n",
+		},
+		{
+			name:    "value-over-null",
+			options: &Options{},
+			input1:  "hostname:\n",
+			input2:  "hostname: b\n",
+			want:    "hostname: b\n",
+		},
+		{
+			name:    "mapping-over-null",
+			options: &Options{},
+			input1:  "storage:\n",
+			input2:  "storage:\n  files: []\n",
+			want:    "storage:\n  files: []\n",
+		},
+		{
+			name:    "null-over-missing",
+			options: &Options{},
+			input1:  "version: 1.5.0\n",
+			input2:  "hostname:\n",
+			want:    "version: 1.5.0\nhostname: null\n",
+		},
+		{
+			name:    "null-over-missing/null-deletes",
+			options: &Options{NullDeletes: true},
+			input1:  "version: 1.5.0\nstorage:\n",
+			input2:  "hostname:\n",
+			want:    "version: 1.5.0\n",
+		},
+		{
+			name:    "null-over-value/delete-if-null",
+			options: &Options{DeleteIfNull: []string{"$.hostname"}},
+			input1:  "hostname: a\nversion: 1.5.0\n",
+			input2:  "hostname:\n",
+			want:    "version: 1.5.0\n",
+		},
+		{
+			name:    "null-over-value/delete-if-null-unmatched",
+			options: &Options{DeleteIfNull: []string{"$.hostname"}, DefaultOverWrite: true},
+			input1:  "hostname: a\nversion: 1.5.0\n",
+			input2:  "version:\n",
+			want:    "hostname: a\nversion: null\n",
+		},
+		{
+			name:    "null-over-missing/delete-if-null",
+			options: &Options{DeleteIfNull: []string{".hostname"}},
+			input1:  "version: 1.5.0\n",
+			input2:  "hostname:\n",
+			want:    "version: 1.5.0\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, map[string]string{
+				"input1.yaml": tc.input1,
+				"input2.yaml": tc.input2,
+			})
+			got, err := MergeFiles(tc.options, "input1.yaml", "input2.yaml")
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("MergeFiles() got nil error, wanted error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	d, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading file: %s", err)
+	}
+	return d
+}
+
+func TestTypeMismatch(t *testing.T) {
+	cases := []struct {
+		name    string
+		options *Options
+		input1  string
+		input2  string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "scalar-to-mapping",
+			options: &Options{},
+			input1:  "ignition: none\n",
+			input2:  "ignition:\n  config:\n    merge: []\n",
+			wantErr: "key[$.ignition] mismatch",
+		},
+		{
+			name:    "scalar-to-mapping/overwrite",
+			options: &Options{Overwrite: []string{"$.ignition"}},
+			input1:  "ignition: none\n",
+			input2:  "ignition:\n  config:\n    merge: []\n",
+			want:    "ignition:\n  config:\n    merge: []\n",
+		},
+		{
+			name:    "mapping-to-scalar",
+			options: &Options{},
+			input1:  "ignition:\n  config:\n    merge: []\n",
+			input2:  "ignition: none\n",
+			wantErr: "key[$.ignition] mismatch",
+		},
+		{
+			name:    "mapping-to-scalar/overwrite",
+			options: &Options{Overwrite: []string{"$.ignition"}},
+			input1:  "ignition:\n  config:\n    merge: []\n",
+			input2:  "ignition: none\n",
+			want:    "ignition: none\n",
+		},
+		{
+			name:    "scalar-to-sequence/overwrite",
+			options: &Options{DefaultOverWrite: true},
+			input1:  "kernel_arguments: quiet\n",
+			input2:  "kernel_arguments:\n  - quiet\n",
+			want:    "kernel_arguments:\n  - quiet\n",
+		},
+		{
+			name:    "sequence-to-mapping/overwrite",
+			options: &Options{Overwrite: []string{"$.kernel_arguments"}},
+			input1:  "kernel_arguments:\n  - quiet\n",
+			input2:  "kernel_arguments:\n  should_exist: [quiet]\n",
+			want:    "kernel_arguments:\n  should_exist: [quiet]\n",
+		},
+		{
+			name:    "scalar-to-sequence/coerce",
+			options: &Options{CoerceScalarToSequence: []string{".should_exist"}},
+			input1:  "kernel_arguments:\n  should_exist: quiet\n",
+			input2:  "kernel_arguments:\n  should_exist: [debug, nosmt]\n",
+			want:    "kernel_arguments:\n  should_exist: [quiet, debug, nosmt]\n",
+		},
+		{
+			name:    "sequence-to-scalar/coerce",
+			options: &Options{CoerceScalarToSequence: []string{".should_exist"}, Prepend: []string{".should_exist"}},
+			input1:  "kernel_arguments:\n  should_exist: [quiet]\n",
+			input2:  "kernel_arguments:\n  should_exist: debug\n",
+			want:    "kernel_arguments:\n  should_exist: [debug, quiet]\n",
+		},
+		{
+			// The scalar is checked against the schema once promoted.
+			name:    "sequence-to-scalar/coerce-schema",
+			options: &Options{Variant: "fcos", Version: "1.5.0", CoerceScalarToSequence: []string{"$.kernel_arguments.should_exist"}},
+			input1:  "kernel_arguments:\n  should_exist: [a]\n",
+			input2:  "kernel_arguments:\n  should_exist: b\n",
+			want:    "kernel_arguments:\n  should_exist: [a, b]\n",
+		},
+		{
+			name:    "scalar-to-sequence/coerce-unmatched",
+			options: &Options{CoerceScalarToSequence: []string{".should_not_exist"}},
+			input1:  "kernel_arguments:\n  should_exist: quiet\n",
+			input2:  "kernel_arguments:\n  should_exist: [debug]\n",
+			wantErr: "key[$.kernel_arguments.should_exist] mismatch",
+		},
+		{
+			name:    "scalar-to-sequence/list-field",
+			options: &Options{ListFields: []string{"$.kernel_arguments.should_exist"}},
+			input1:  "kernel_arguments:\n  should_exist: [quiet]\n",
+			input2:  "kernel_arguments:\n  should_exist: debug\n",
+			want:    "kernel_arguments:\n  should_exist: [quiet, debug]\n",
+		},
+		{
+			name:    "scalar-alone/list-field",
+			options: &Options{ListFields: []string{".should_exist"}},
+			input1:  "kernel_arguments:\n  should_exist: quiet\n",
+			input2:  "kernel_arguments:\n  should_not_exist: [debug]\n",
+			want:    "kernel_arguments:\n  should_exist: [quiet]\n  should_not_exist: [debug]\n",
+		},
+		{
+			name:    "scalars/list-field",
+			options: &Options{ListFields: []string{".should_exist"}},
+			input1:  "kernel_arguments:\n  should_exist: quiet\n",
+			input2:  "kernel_arguments:\n  should_exist: debug\n",
+			want:    "kernel_arguments:\n  should_exist: [quiet, debug]\n",
+		},
+		{
+			name:    "scalar-alone/coerce",
+			options: &Options{CoerceScalarToSequence: []string{".should_exist"}},
+			input1:  "kernel_arguments:\n  should_exist: quiet\n",
+			input2:  "kernel_arguments:\n  should_not_exist: [debug]\n",
+			want:    "kernel_arguments:\n  should_exist: quiet\n  should_not_exist: [debug]\n",
+		},
+		{
+			name:    "mapping-to-sequence/coerce",
+			options: &Options{CoerceScalarToSequence: []string{".should_exist"}},
+			input1:  "kernel_arguments:\n  should_exist: {quiet: true}\n",
+			input2:  "kernel_arguments:\n  should_exist: [debug]\n",
+			wantErr: "key[$.kernel_arguments.should_exist] mismatch",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, map[string]string{
+				"input1.yaml": tc.input1,
+				"input2.yaml": tc.input2,
+			})
+			got, err := MergeFiles(tc.options, "input1.yaml", "input2.yaml")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	deep := "a: " + strings.Repeat("{a: ", 200) + "1" + strings.Repeat("}", 200) + "\n"
+	cases := []struct {
+		name    string
+		options *Options
+		input   string
+		wantErr string
+	}{
+		{
+			name:    "default",
+			options: &Options{},
+			input:   deep,
+			wantErr: "exceeds the maximum depth of 100",
+		},
+		{
+			name:    "within-limit",
+			options: &Options{MaxDepth: 4},
+			input:   "storage:\n  files:\n    - path: /etc/motd\n",
+		},
+		{
+			name:    "mapping",
+			options: &Options{MaxDepth: 4},
+			input:   "storage:\n  files:\n    - contents:\n        inline: hello\n",
+			wantErr: "key[$.storage.files.contents] exceeds the maximum depth of 4",
+		},
+		{
+			name:    "sequence",
+			options: &Options{MaxDepth: 2},
+			input:   "storage:\n  files: []\n",
+			wantErr: "key[$.storage.files] exceeds the maximum depth of 2",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, map[string]string{"input.yaml": tc.input})
+			_, err := MergeFiles(tc.options, "input.yaml")
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("MergeFiles() got err: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetaKey(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "x-meta:\n  owner: platform\n  priority: -1\n---\nvariant: fcos\nkernel_arguments:\n  should_exist: [base]\n",
+		"overlay.yaml": "---\nx-meta:\n  priority: 10\n---\nkernel_arguments:\n  should_exist: [overlay]\n",
+		"inline.yaml":  "x-meta:\n  owner: app\nkernel_arguments:\n  should_exist: [inline]\n",
+		"plain.yaml":   "kernel_arguments:\n  should_exist: [plain]\n",
+		"invalid.yaml": "x-meta:\n  priority: high\n",
+	})
+	cases := []struct {
+		name    string
+		files   []string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "priority",
+			files: []string{"overlay.yaml", "inline.yaml", "base.yaml", "plain.yaml"},
+			want:  "variant: fcos\nkernel_arguments:\n  should_exist: [base, inline, plain, overlay]\n",
+		},
+		{
+			name:    "invalid",
+			files:   []string{"plain.yaml", "invalid.yaml"},
+			wantErr: "file[invalid.yaml]: key[$.x-meta.priority] is string, want an integer",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MergeFiles(&Options{FilesDir: dir, MetaKey: "x-meta"}, tc.files...)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestPriorityKey(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"10-overlay.yaml": "x-priority: 20\nkernel_arguments:\n  should_exist: [overlay]\n",
+		"20-base.yaml":    "x-priority: -5\nvariant: fcos\nkernel_arguments:\n  should_exist: [base]\n",
+		"30-first.yaml":   "kernel_arguments:\n  should_exist: [first]\n",
+		"40-second.yaml":  "kernel_arguments:\n  should_exist: [second]\n",
+		"both.yaml":       "x-priority: 1\nx-meta:\n  priority: 2\n",
+	})
+	options := &Options{FilesDir: dir, MetaKey: "x-meta", PriorityKey: "x-priority"}
+	got, err := MergeGlob(options, "*0-*.yaml")
+	if err != nil {
+		t.Fatalf("MergeGlob() got err: %s", err)
+	}
+	want := "variant: fcos\nkernel_arguments:\n  should_exist: [base, first, second, overlay]\n"
+	if diff := cmp.Diff(mustUnmarshal(t, []byte(want)), mustUnmarshal(t, got)); diff != "" {
+		t.Errorf("MergeGlob() got diff: -want/+got: %s", diff)
+	}
+
+	_, err = MergeFiles(options, "both.yaml")
+	wantErr := "key[$.x-priority] conflicts with key[$.x-meta.priority]"
+	if err == nil || !strings.Contains(err.Error(), wantErr) {
+		t.Errorf("MergeFiles() got err %v wanted %q", err, wantErr)
+	}
+}
+
+func TestAfterKey(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "variant: fcos\nkernel_arguments:\n  should_exist: [base]\n",
+		"overlay.yaml": "x-after: [base.yaml]\nkernel_arguments:\n  should_exist: [overlay]\n",
+		"host.yaml":    "x-meta:\n  after: [base.yaml, overlay.yaml]\nkernel_arguments:\n  should_exist: [host]\n",
+		"early.yaml":   "x-priority: -1\nx-after: [base.yaml]\n",
+		"both.yaml":    "x-after: [base.yaml]\nx-meta:\n  after: [base.yaml]\n",
+		"invalid.yaml": "x-after: base.yaml\n",
+	})
+	cases := []struct {
+		name    string
+		files   []string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "satisfied",
+			files: []string{"base.yaml", "overlay.yaml", "host.yaml"},
+			want:  "variant: fcos\nkernel_arguments:\n  should_exist: [base, overlay, host]\n",
+		},
+		{
+			name:    "violated",
+			files:   []string{"overlay.yaml", "base.yaml"},
+			wantErr: "file[overlay.yaml]: key[$.x-after] requires base.yaml to be merged first",
+		},
+		{
+			name:    "violated-meta",
+			files:   []string{"base.yaml", "host.yaml", "overlay.yaml"},
+			wantErr: "file[host.yaml]: key[$.x-meta.after] requires overlay.yaml to be merged first",
+		},
+		{
+			// The files are checked in the order of their priority.
+			name:    "violated-priority",
+			files:   []string{"base.yaml", "early.yaml"},
+			wantErr: "file[early.yaml]: key[$.x-after] requires base.yaml to be merged first",
+		},
+		{
+			name:    "missing",
+			files:   []string{"overlay.yaml"},
+			wantErr: "file[overlay.yaml]: key[$.x-after] names base.yaml, which is not an input file",
+		},
+		{
+			name:    "both",
+			files:   []string{"base.yaml", "both.yaml"},
+			wantErr: "file[both.yaml]: key[$.x-after] conflicts with key[$.x-meta.after]",
+		},
+		{
+			name:    "invalid",
+			files:   []string{"base.yaml", "invalid.yaml"},
+			wantErr: "file[invalid.yaml]: key[$.x-after] is string, want a sequence of file names",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := &Options{FilesDir: dir, MetaKey: "x-meta", PriorityKey: "x-priority", AfterKey: "x-after"}
+			got, err := MergeFiles(options, tc.files...)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestReplaceSubtree(t *testing.T) {
+	base := "storage:\n  luks:\n    root:\n      device: /dev/sda4\n      wipe_volume: true\n      clevis:\n        tpm2: true\n"
+	overlay := "storage:\n  luks:\n    root:\n      device: /dev/sdb4\n      clevis:\n        tang:\n          - url: https://tang.example.com\n"
+	cases := []struct {
+		name    string
+		options *Options
+		want    string
+	}{
+		{
+			name:    "deep-patch",
+			options: &Options{Overwrite: []string{".device"}},
+			want:    "storage:\n  luks:\n    root:\n      device: /dev/sdb4\n      wipe_volume: true\n      clevis:\n        tpm2: true\n        tang:\n          - url: https://tang.example.com\n",
+		},
+		{
+			name:    "replace-subtree",
+			options: &Options{ReplaceSubtree: []string{"$.storage.luks.root"}},
+			want:    overlay,
+		},
+		{
+			name:    "replace-nested-subtree",
+			options: &Options{Overwrite: []string{".device"}, ReplaceSubtree: []string{".clevis"}},
+			want:    "storage:\n  luks:\n    root:\n      device: /dev/sdb4\n      wipe_volume: true\n      clevis:\n        tang:\n          - url: https://tang.example.com\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, map[string]string{
+				"input1.yaml": base,
+				"input2.yaml": overlay,
+			})
+			got, err := MergeFiles(tc.options, "input1.yaml", "input2.yaml")
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestPruneEmpty(t *testing.T) {
+	base := "variant: fcos\nstorage:\n  files:\n    - path: /etc/motd\n  disks:\n    - device: /dev/sda\n      partitions:\n        - {}\nsystemd:\n  units: []\n"
+	overlay := "storage:\n  files: null\n"
+	cases := []struct {
+		name    string
+		options *Options
+		want    string
+	}{
+		{
+			name:    "no-prune",
+			options: &Options{NullDeletes: true},
+			want:    "variant: fcos\nstorage:\n  disks:\n    - device: /dev/sda\n      partitions:\n        - {}\nsystemd:\n  units: []\n",
+		},
+		{
+			name:    "storage-emptied",
+			options: &Options{NullDeletes: true, PruneEmpty: true},
+			want:    "variant: fcos\nstorage:\n  disks:\n    - device: /dev/sda\n      partitions:\n        - {}\n",
+		},
+		{
+			name:    "keep-empty",
+			options: &Options{NullDeletes: true, PruneEmpty: true, KeepEmpty: []string{"$.systemd.units"}},
+			want:    "variant: fcos\nstorage:\n  disks:\n    - device: /dev/sda\n      partitions:\n        - {}\nsystemd:\n  units: []\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, map[string]string{
+				"input1.yaml": base,
+				"input2.yaml": overlay,
+			})
+			got, err := MergeFiles(tc.options, "input1.yaml", "input2.yaml")
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+
+	t.Run("storage-removed", func(t *testing.T) {
+		dir := writeFiles(t, map[string]string{
+			"input1.yaml": "variant: fcos\nstorage:\n  files:\n    - path: /etc/motd\n",
+			"input2.yaml": "storage:\n  files: null\n",
+		})
+		got, err := MergeFiles(&Options{FilesDir: dir, NullDeletes: true, PruneEmpty: true}, "input1.yaml", "input2.yaml")
+		if err != nil {
+			t.Fatalf("MergeFiles() got err: %s", err)
+		}
+		if diff := cmp.Diff("variant: fcos\n", string(got)); diff != "" {
+			t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+		}
+	})
+}
+
+func TestEmptyFiles(t *testing.T) {
+	files := map[string]string{
+		"empty.yaml":    "",
+		"comments.yaml": "# nothing here yet\n\n# or here\n",
+		"null.yaml":     "~\n",
+		"empty.json":    "\n",
+		"base.yaml":     "variant: fcos\nstorage:\n  files:\n    - path: /etc/motd\n",
+		"overlay.yaml":  "storage:\n  files:\n    - path: /etc/hosts\n",
+	}
+	cases := []struct {
+		name    string
+		options *Options
+		files   []string
+		want    string
+	}{
+		{
+			name:  "empty-first",
+			files: []string{"empty.yaml", "base.yaml", "overlay.yaml"},
+			want:  "storage:\n    files:\n        - path: /etc/motd\n        - path: /etc/hosts\nvariant: fcos\n",
+		},
+		{
+			// The base is still the first file merged, so it may add keys.
+			name:    "empty-first-sealed",
+			options: &Options{SealDepth: 1},
+			files:   []string{"comments.yaml", "base.yaml", "overlay.yaml"},
+			want:    "storage:\n    files:\n        - path: /etc/motd\n        - path: /etc/hosts\nvariant: fcos\n",
+		},
+		{
+			name:  "empty-middle",
+			files: []string{"base.yaml", "null.yaml", "empty.json", "overlay.yaml"},
+			want:  "storage:\n    files:\n        - path: /etc/motd\n        - path: /etc/hosts\nvariant: fcos\n",
+		},
+		{
+			name:  "all-empty",
+			files: []string{"empty.yaml", "comments.yaml", "null.yaml"},
+			want:  "{}\n",
+		},
+		{
+			name:    "all-empty-json",
+			options: &Options{OutputFormat: FormatJSON},
+			files:   []string{"empty.yaml", "empty.json"},
+			want:    "{}\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.options == nil {
+				tc.options = &Options{}
+			}
+			tc.options.FilesDir = writeFiles(t, files)
+			got, err := MergeFiles(tc.options, tc.files...)
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestIgnoreMissing(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":        "variant: fcos\nstorage:\n  files:\n    - path: /etc/motd\n",
+		"overlay.yaml":     "storage:\n  files:\n    - path: /etc/hosts\n",
+		"overlay.d/x.yaml": "storage:\n  files:\n    - path: /etc/x\n",
+	})
+	want := "storage:\n    files:\n        - path: /etc/motd\n        - path: /etc/hosts\nvariant: fcos\n"
+	cases := []struct {
+		name    string
+		options *Options
+		files   []string
+		wantErr string
+	}{
+		{
+			name:    "missing-overlay",
+			options: &Options{IgnoreMissing: true},
+			files:   []string{"base.yaml", "host.yaml", "overlay.yaml"},
+		},
+		{
+			// The base is still the first file merged, so it may add keys.
+			name:    "missing-first-sealed",
+			options: &Options{IgnoreMissing: true, SealDepth: 1},
+			files:   []string{"host.yaml", "base.yaml", "overlay.yaml"},
+		},
+		{
+			name:    "missing-tracked",
+			options: &Options{IgnoreMissing: true, TrackPositions: true},
+			files:   []string{"base.yaml", "overlay.yaml", "host.yaml"},
+		},
+		{
+			name:    "missing-error",
+			options: &Options{},
+			files:   []string{"base.yaml", "host.yaml", "overlay.yaml"},
+			wantErr: "no such file",
+		},
+		{
+			name:    "not-a-file",
+			options: &Options{IgnoreMissing: true},
+			files:   []string{"base.yaml", "overlay.d", "overlay.yaml"},
+			wantErr: "is a directory",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			for _, merge := range []func(...string) ([]byte, error){
+				func(path ...string) ([]byte, error) { return MergeFiles(tc.options, path...) },
+				NewMerger(tc.options).MergeFiles,
+			} {
+				got, err := merge(tc.files...)
+				if tc.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+						t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("MergeFiles() got err: %s", err)
+				}
+				if diff := cmp.Diff(want, string(got)); diff != "" {
+					t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeBy(t *testing.T) {
+	base := "storage:\n  files:\n    - path: /etc/foo\n      mode: 420\n    - path: /etc/motd\n      contents:\n        inline: hello\n"
+	cases := []struct {
+		name    string
+		options *Options
+		overlay string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "merge-cleanly",
+			options: &Options{},
+			overlay: "storage:\n  files:\n    - path: /etc/foo\n      contents:\n        inline: foo\n    - path: /etc/bar\n",
+			want:    "storage:\n  files:\n    - path: /etc/foo\n      mode: 420\n      contents:\n        inline: foo\n    - path: /etc/motd\n      contents:\n        inline: hello\n    - path: /etc/bar\n",
+		},
+		{
+			name:    "equal-values",
+			options: &Options{},
+			overlay: "storage:\n  files:\n    - path: /etc/foo\n      mode: 420\n",
+			want:    base,
+		},
+		{
+			name:    "prepend-rest",
+			options: &Options{Prepend: []string{"$.storage.files"}},
+			overlay: "storage:\n  files:\n    - path: /etc/bar\n    - path: /etc/foo\n      user:\n        name: core\n",
+			want:    "storage:\n  files:\n    - path: /etc/bar\n    - path: /etc/foo\n      mode: 420\n      user:\n        name: core\n    - path: /etc/motd\n      contents:\n        inline: hello\n",
+		},
+		{
+			name:    "inner-conflict",
+			options: &Options{},
+			overlay: "storage:\n  files:\n    - path: /etc/foo\n      mode: 384\n",
+			wantErr: "duplicate Keys(overrwrite=false): $.storage.files[path=/etc/foo].mode",
+		},
+		{
+			name:    "inner-mismatch",
+			options: &Options{},
+			overlay: "storage:\n  files:\n    - path: /etc/motd\n      contents: hello\n",
+			wantErr: "key[$.storage.files[path=/etc/motd].contents] mismatch",
+		},
+		{
+			name:    "inner-overwrite",
+			options: &Options{Overwrite: []string{".mode"}},
+			overlay: "storage:\n  files:\n    - path: /etc/foo\n      mode: 384\n",
+			want:    "storage:\n  files:\n    - path: /etc/foo\n      mode: 384\n    - path: /etc/motd\n      contents:\n        inline: hello\n",
+		},
+		{
+			name:    "inner-overwrite-selector",
+			options: &Options{Overwrite: []string{"$.storage.files[path=/etc/motd].contents.inline"}},
+			overlay: "storage:\n  files:\n    - path: /etc/motd\n      contents:\n        inline: goodbye\n",
+			want:    "storage:\n  files:\n    - path: /etc/foo\n      mode: 420\n    - path: /etc/motd\n      contents:\n        inline: goodbye\n",
+		},
+		{
+			name:    "overwrite-sequence",
+			options: &Options{Overwrite: []string{"$.storage.files"}},
+			overlay: "storage:\n  files:\n    - path: /etc/foo\n      mode: 384\n",
+			want:    "storage:\n  files:\n    - path: /etc/foo\n      mode: 384\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, map[string]string{
+				"input1.yaml": base,
+				"input2.yaml": tc.overlay,
+			})
+			tc.options.MergeBy = map[string]string{"$.storage.files": "path"}
+			got, err := MergeFiles(tc.options, "input1.yaml", "input2.yaml")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSeed(t *testing.T) {
+	seed := map[string]any{
+		"variant": "fcos",
+		"version": "1.5.0",
+		"storage": map[string]any{
+			"files": []any{
+				map[string]any{"path": "/etc/motd", "contents": map[string]any{"local": "motd"}},
+			},
+		},
+	}
+	want := deepCopy(seed).(map[string]any)
+	dir := writeFiles(t, map[string]string{
+		"fragments/input1.yaml": "storage:\n  files:\n    - path: /etc/hosts\n      contents:\n        local: hosts\n",
+	})
+	options := &Options{FilesDir: dir, Seed: seed, ResolvePath: []string{".local"}, SealDepth: 1}
+	got, err := MergeFiles(options, "fragments/input1.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	wantOut := "variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n    - path: /etc/motd\n      contents:\n        local: motd\n    - path: /etc/hosts\n      contents:\n        local: fragments/hosts\n"
+	if diff := cmp.Diff(mustUnmarshal(t, []byte(wantOut)), mustUnmarshal(t, got)); diff != "" {
+		t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+	}
+	if diff := cmp.Diff(want, seed); diff != "" {
+		t.Errorf("MergeFiles() modified seed: -want/+got: %s", diff)
+	}
+
+	got, err = MergeFiles(&Options{Seed: seed})
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	if diff := cmp.Diff(want, mustUnmarshal(t, got)); diff != "" {
+		t.Errorf("MergeFiles() without files got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestSeedUniqueBy(t *testing.T) {
+	seed := map[string]any{
+		"storage": map[string]any{
+			"files": []any{map[string]any{"path": "/a"}},
+		},
+	}
+	dir := writeFiles(t, map[string]string{
+		"input.yaml": "storage:\n  files:\n    - path: /a\n",
+	})
+	options := &Options{FilesDir: dir, Seed: seed, UniqueBy: map[string]string{"$.storage.files": "path"}}
+	_, err := MergeFiles(options, "input.yaml")
+	wantErr := "file[input.yaml]: key[$.storage.files] duplicate path /a: in seed and input.yaml"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("MergeFiles() got err %v wanted %q", err, wantErr)
+	}
+
+	// Without the files of the elements the duplicate is still reported.
+	m, err := newMerge(options, nil)
+	if err != nil {
+		t.Fatalf("newMerge() got err: %s", err)
+	}
+	m.mergePolicy = m.policy
+	delete(m.elementFiles, "$.storage.files")
+	err = m.checkUnique("$.storage.files", []any{map[string]any{"path": "/a"}, map[string]any{"path": "/a"}})
+	wantErr = "key[$.storage.files] duplicate path /a"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("checkUnique() got err %v wanted %q", err, wantErr)
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	base := "systemd:\n  units:\n    - name: a.service\nstorage:\n  directories:\n    - path: /var/a\n  links:\n    - path: /etc/a\n      target: /a\n"
+	cases := []struct {
+		name     string
+		options  *Options
+		fragment string
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "overwrite-sequence",
+			options:  &Options{},
+			fragment: "systemd:\n  units: !overwrite\n    - name: b.service\n",
+			want:     "systemd:\n  units:\n    - name: b.service\nstorage:\n  directories:\n    - path: /var/a\n  links:\n    - path: /etc/a\n      target: /a\n",
+		},
+		{
+			name:     "prepend-sequence",
+			options:  &Options{},
+			fragment: "systemd:\n  units: !prepend\n    - name: b.service\n",
+			want:     "systemd:\n  units:\n    - name: b.service\n    - name: a.service\nstorage:\n  directories:\n    - path: /var/a\n  links:\n    - path: /etc/a\n      target: /a\n",
+		},
+		{
+			name:     "append-over-policy",
+			options:  &Options{DefaultOverWrite: true},
+			fragment: "systemd:\n  units: !append\n    - name: b.service\nstorage:\n  directories:\n    - path: /var/b\n",
+			want:     "systemd:\n  units:\n    - name: a.service\n    - name: b.service\nstorage:\n  directories:\n    - path: /var/b\n  links:\n    - path: /etc/a\n      target: /a\n",
+		},
+		{
+			name:     "mapping",
+			options:  &Options{},
+			fragment: "storage: !overwrite\n  directories:\n    - path: /var/b\n  links:\n    - path: /etc/b\n      target: /b\n",
+			want:     "systemd:\n  units:\n    - name: a.service\nstorage:\n  directories:\n    - path: /var/b\n  links:\n    - path: /etc/b\n      target: /b\n",
+		},
+		{
+			name:     "over-marker",
+			options:  &Options{StrategyKey: "x-merge"},
+			fragment: "storage:\n  x-merge: overwrite\n  directories: !append\n    - path: /var/b\n  links:\n    - path: /etc/b\n      target: /b\n",
+			want:     "systemd:\n  units:\n    - name: a.service\nstorage:\n  directories:\n    - path: /var/a\n    - path: /var/b\n  links:\n    - path: /etc/b\n      target: /b\n",
+		},
+		{
+			name:     "within-sequence",
+			options:  &Options{},
+			fragment: "systemd:\n  units:\n    - name: b.service\n      dropins: !overwrite\n        - name: b.conf\n",
+			want:     "systemd:\n  units:\n    - name: a.service\n    - name: b.service\n      dropins:\n        - name: b.conf\nstorage:\n  directories:\n    - path: /var/a\n  links:\n    - path: /etc/a\n      target: /a\n",
+		},
+		{
+			name:     "unknown-tag",
+			options:  &Options{},
+			fragment: "systemd:\n  units: !replace\n    - name: b.service\n",
+			wantErr:  "key[$.systemd.units] unknown merge tag !replace",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, map[string]string{
+				"base.yaml":     base,
+				"fragment.yaml": tc.fragment,
+			})
+			got, err := MergeFiles(tc.options, "base.yaml", "fragment.yaml")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+			if strings.Contains(string(got), "!") {
+				t.Errorf("MergeFiles() got tag in output: %s", got)
+			}
+		})
+	}
+}
+
+func TestStringFields(t *testing.T) {
+	input := `storage:
+  files:
+    - path: /etc/motd
+      mode: 0644
+      overwrite: true
+  filesystems:
+    - device: on
+      label: 1.0
+      wipe_filesystem: ~
+      format: '0644'
+`
+	cases := []struct {
+		name    string
+		options *Options
+		want    string
+	}{
+		{
+			name:    "strings",
+			options: &Options{StringFields: []string{"$.storage.files.mode", ".device", ".label", ".wipe_filesystem", ".format"}},
+			want:    "storage:\n    files:\n        - mode: \"0644\"\n          overwrite: true\n          path: /etc/motd\n    filesystems:\n        - device: \"on\"\n          format: \"0644\"\n          label: \"1.0\"\n          wipe_filesystem: null\n",
+		},
+		{
+			name:    "query",
+			options: &Options{StringFields: []string{`jsonpath:$.storage.files[?(@.path=="/etc/motd")].overwrite`}},
+			want:    "storage:\n    files:\n        - mode: 420\n          overwrite: \"true\"\n          path: /etc/motd\n    filesystems:\n        - device: \"on\"\n          format: \"0644\"\n          label: 1\n          wipe_filesystem: null\n",
+		},
+		{
+			name:    "default",
+			options: &Options{},
+			want:    "storage:\n    files:\n        - mode: 420\n          overwrite: true\n          path: /etc/motd\n    filesystems:\n        - device: \"on\"\n          format: \"0644\"\n          label: 1\n          wipe_filesystem: null\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, map[string]string{"input1.yaml": input})
+			got, err := MergeFiles(tc.options, "input1.yaml")
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+// TestMergeFilesConcurrent runs many merges with the same Options at once,
+// and is meant to be run with -race.
+func TestMergeFilesConcurrent(t *testing.T) {
+	var logs bytes.Buffer
+	options := &Options{
+		FilesDir:         "./resolve-path",
+		DefaultOverWrite: true,
+		ResolvePath:      []string{".local"},
+		ForceQuote:       []string{`jsonpath:$.storage.files[?(@.path=="/opt/file")].mode`},
+		Seed:             map[string]any{"variant": "fcos"},
+		Logger:           log.New(&logs, "", 0),
+	}
+	files := []string{"common/input1.yaml", "host-dir/input2.yaml"}
+	want, err := MergeFiles(options, files...)
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := MergeFiles(options, files...)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if diff := cmp.Diff(string(want), string(got)); diff != "" {
+				errs <- fmt.Errorf("got diff: -want/+got: %s", diff)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("MergeFiles() got err: %s", err)
+	}
+	if !strings.Contains(logs.String(), "Update[$.storage.files.contents.local]") {
+		t.Errorf("Logger got %q", logs.String())
+	}
+}
+
+func TestErrorNamesFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml":        "variant: fcos\n",
+		"b.yaml":        "storage:\n  files:\n    - path: /etc/motd\n",
+		"invalid.yaml":  "storage: [\n",
+		"conflict.yaml": "variant: flatcar\n",
+	})
+	cases := []struct {
+		name    string
+		files   []string
+		wantErr string
+	}{
+		{name: "missing", files: []string{"a.yaml", "missing.yaml", "b.yaml"}, wantErr: "file[missing.yaml]: error reading file: open "},
+		{name: "invalid", files: []string{"a.yaml", "invalid.yaml", "b.yaml"}, wantErr: "file[invalid.yaml]: error reading yaml: "},
+		{name: "conflict", files: []string{"a.yaml", "b.yaml", "conflict.yaml"}, wantErr: "file[conflict.yaml]: duplicate Keys(overrwrite=false): $.variant"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := MergeFiles(&Options{FilesDir: dir}, tc.files...)
+			if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Fatalf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+			}
+			// The file is named once, and no other file is.
+			if got := strings.Count(err.Error(), "file["); got != 1 {
+				t.Errorf("MergeFiles() got err %v naming %d files", err, got)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// Each file is 16 bytes.
+	dir := writeFiles(t, map[string]string{
+		"a.yaml": "variant: fcos  \n",
+		"b.yaml": "version: 1.5.0 \n",
+		"c.yaml": "storage: {}    \n",
+	})
+	files := []string{"a.yaml", "b.yaml", "c.yaml"}
+	cases := []struct {
+		name    string
+		options *Options
+		wantErr string
+	}{
+		{name: "within", options: &Options{MaxFiles: 3, MaxTotalBytes: 48}},
+		{name: "max-files", options: &Options{MaxFiles: 2}, wantErr: "3 input files are more than MaxFiles of 2"},
+		{name: "max-bytes", options: &Options{MaxTotalBytes: 40}, wantErr: "file[c.yaml]: input files total more than MaxTotalBytes of 40 bytes"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			for _, merge := range []func(...string) ([]byte, error){
+				func(path ...string) ([]byte, error) { return MergeFiles(tc.options, path...) },
+				NewMerger(tc.options).MergeFiles,
+			} {
+				_, err := merge(files...)
+				if tc.wantErr == "" {
+					if err != nil {
+						t.Errorf("MergeFiles() got err: %s", err)
+					}
+					continue
+				}
+				if err == nil || err.Error() != tc.wantErr {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestRenameKeys(t *testing.T) {
+	cases := []struct {
+		name         string
+		options      *Options
+		files        map[string]string
+		want         string
+		wantWarnings []Warning
+	}{
+		{
+			name:    "old-and-new",
+			options: &Options{RenameKeys: map[string]string{".contents.local": "file"}},
+			files: map[string]string{
+				"old.yaml": "storage:\n  files:\n    - path: /etc/motd\n      contents:\n        local: motd\n",
+				"new.yaml": "storage:\n  files:\n    - path: /etc/hosts\n      contents:\n        file: hosts\n",
+			},
+			want: "storage:\n  files:\n    - path: /etc/motd\n      contents:\n        file: motd\n    - path: /etc/hosts\n      contents:\n        file: hosts\n",
+		},
+		{
+			name:    "converge",
+			options: &Options{RenameKeys: map[string]string{"$.ignition.timeout": "timeouts"}},
+			files: map[string]string{
+				"old.yaml": "ignition:\n  timeout:\n    http_total: 10\n",
+				"new.yaml": "ignition:\n  timeouts:\n    http_response_headers: 5\n",
+			},
+			want: "ignition:\n  timeouts:\n    http_total: 10\n    http_response_headers: 5\n",
+		},
+		{
+			name:    "both-differ",
+			options: &Options{RenameKeys: map[string]string{"$.ignition.timeout": "timeouts"}},
+			files: map[string]string{
+				"old.yaml": "ignition:\n  timeout:\n    http_total: 10\n  timeouts:\n    http_total: 20\n",
+				"new.yaml": "ignition:\n  timeout:\n    http_total: 20\n  timeouts:\n    http_total: 20\n",
+			},
+			want:         "ignition:\n  timeouts:\n    http_total: 20\n",
+			wantWarnings: []Warning{{File: "old.yaml", Path: "$.ignition.timeout", Message: "is renamed to timeouts, which has a different value that is kept"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, tc.files)
+			got, err := MergeFilesResult(tc.options, "old.yaml", "new.yaml")
+			if err != nil {
+				t.Fatalf("MergeFilesResult() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got.Output)); diff != "" {
+				t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+			}
+			if diff := cmp.Diff(tc.wantWarnings, got.Warnings); diff != "" {
+				t.Errorf("MergeFilesResult() got warnings diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSkipDuplicateInputs(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "variant: fcos\nversion: 1.5.0\n",
+		"users.yaml":   "passwd:\n  users:\n    - name: core\n      ssh_authorized_keys: [key1]\n",
+		"a/motd.yaml":  "storage:\n  files:\n    - path: /etc/motd\n      contents:\n        local: motd\n",
+		"b/motd.yaml":  "storage:\n  files:\n    - path: /etc/motd\n      contents:\n        local: motd\n",
+		"users-2.yaml": "# The same users.\npasswd:\n  users:\n    - ssh_authorized_keys: [key1]\n      name: core\n",
+	})
+	options := &Options{FilesDir: dir, SkipDuplicateInputs: true}
+	once, err := MergeFiles(options, "base.yaml", "users.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	got, err := MergeFilesResult(options, "base.yaml", "users.yaml", "users.yaml", "users-2.yaml")
+	if err != nil {
+		t.Fatalf("MergeFilesResult() got err: %s", err)
+	}
+	if diff := cmp.Diff(string(once), string(got.Output)); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+	wantWarnings := []Warning{
+		{File: "users.yaml", Path: "$", Message: "has the same content as users.yaml and is skipped"},
+		{File: "users-2.yaml", Path: "$", Message: "has the same content as users.yaml and is skipped"},
+	}
+	if diff := cmp.Diff(wantWarnings, got.Warnings); diff != "" {
+		t.Errorf("MergeFilesResult() got warnings diff: -want/+got: %s", diff)
+	}
+
+	// Once resolved, the same fragment in two directories differs.
+	options.ResolvePath = []string{".local"}
+	out, err := MergeFiles(options, "a/motd.yaml", "b/motd.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	want := "storage:\n    files:\n        - contents:\n            local: a/motd\n          path: /etc/motd\n        - contents:\n            local: b/motd\n          path: /etc/motd\n"
+	if diff := cmp.Diff(want, string(out)); diff != "" {
+		t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestDefaultSequencePolicy(t *testing.T) {
+	files := map[string]string{
+		"base.yaml":    "variant: fcos\nkernel_arguments:\n  should_exist: [quiet]\n",
+		"overlay.yaml": "kernel_arguments:\n  should_exist: [debug]\n",
+		"same.yaml":    "kernel_arguments:\n  should_exist: [quiet]\n",
+		"variant.yaml": "variant: flatcar\n",
+	}
+	cases := []struct {
+		name    string
+		options *Options
+		files   []string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "append-over-overwrite",
+			options: &Options{DefaultOverWrite: true, DefaultSequencePolicy: SequenceAppend},
+			files:   []string{"base.yaml", "overlay.yaml", "variant.yaml"},
+			want:    "kernel_arguments:\n    should_exist:\n        - quiet\n        - debug\nvariant: flatcar\n",
+		},
+		{
+			name:    "append-scalar-error",
+			options: &Options{DefaultSequencePolicy: SequenceAppend},
+			files:   []string{"base.yaml", "overlay.yaml", "variant.yaml"},
+			wantErr: "file[variant.yaml]: duplicate Keys(overrwrite=false): $.variant",
+		},
+		{
+			name:    "prepend",
+			options: &Options{DefaultSequencePolicy: SequencePrepend},
+			files:   []string{"base.yaml", "overlay.yaml"},
+			want:    "kernel_arguments:\n    should_exist:\n        - debug\n        - quiet\nvariant: fcos\n",
+		},
+		{
+			name:    "overwrite",
+			options: &Options{DefaultSequencePolicy: SequenceOverwrite},
+			files:   []string{"base.yaml", "overlay.yaml"},
+			want:    "kernel_arguments:\n    should_exist:\n        - debug\nvariant: fcos\n",
+		},
+		{
+			name:    "error",
+			options: &Options{DefaultOverWrite: true, DefaultSequencePolicy: SequenceError},
+			files:   []string{"base.yaml", "overlay.yaml"},
+			wantErr: "file[overlay.yaml]: duplicate Keys(overrwrite=false): $.kernel_arguments.should_exist",
+		},
+		{
+			name:    "error-equal",
+			options: &Options{DefaultSequencePolicy: SequenceError},
+			files:   []string{"base.yaml", "same.yaml"},
+			want:    "kernel_arguments:\n    should_exist:\n        - quiet\nvariant: fcos\n",
+		},
+		{
+			name:    "pattern-over-default",
+			options: &Options{DefaultSequencePolicy: SequenceError, Append: []string{".should_exist"}},
+			files:   []string{"base.yaml", "overlay.yaml"},
+			want:    "kernel_arguments:\n    should_exist:\n        - quiet\n        - debug\nvariant: fcos\n",
+		},
+		{
+			name:    "unknown",
+			options: &Options{DefaultSequencePolicy: "merge"},
+			files:   []string{"base.yaml"},
+			wantErr: `unknown DefaultSequencePolicy: "merge"`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, files)
+			got, err := MergeFiles(tc.options, tc.files...)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml": "variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n    - path: /etc/motd\n",
+	})
+	cases := []struct {
+		name    string
+		options *Options
+		want    string
+		wantErr string
+	}{
+		{
+			name: "nested-missing",
+			options: &Options{Set: map[string]any{
+				"$.storage.files":                   []any{map[string]any{"path": "/etc/hostname", "contents": map[string]any{"inline": "host-a"}}},
+				"$.ignition.config.replace.source":  "https://example.com/config.ign",
+				`$.metadata.example\.com/generated`: true,
+			}},
+			want: "ignition:\n    config:\n        replace:\n            source: https://example.com/config.ign\nmetadata:\n    example.com/generated: true\nstorage:\n    files:\n        - contents:\n            inline: host-a\n          path: /etc/hostname\nvariant: fcos\nversion: 1.5.0\n",
+		},
+		{
+			name: "func",
+			options: &Options{SetFunc: map[string]func() (any, error){
+				"$.version": func() (any, error) { return "1.6.0", nil },
+			}},
+			want: "storage:\n    files:\n        - path: /etc/motd\nvariant: fcos\nversion: 1.6.0\n",
+		},
+		{
+			name: "func-error",
+			options: &Options{SetFunc: map[string]func() (any, error){
+				"$.version": func() (any, error) { return nil, errors.New("no version") },
+			}},
+			wantErr: "key[$.version]: no version",
+		},
+		{
+			name:    "not-a-mapping",
+			options: &Options{Set: map[string]any{"$.variant.name": "fcos"}},
+			wantErr: "key[$.variant] is string, not a mapping to set $.variant.name in",
+		},
+		{
+			name:    "relative",
+			options: &Options{Set: map[string]any{".version": "1.6.0"}},
+			wantErr: `Set path ".version" is not an absolute context path`,
+		},
+		{
+			name: "both",
+			options: &Options{
+				Set:     map[string]any{"$.version": "1.6.0"},
+				SetFunc: map[string]func() (any, error){"$.version": func() (any, error) { return "1.6.0", nil }},
+			},
+			wantErr: `Set path "$.version" is also in SetFunc`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			got, err := MergeFiles(tc.options, "base.yaml")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestTopLevelMapping(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":   "variant: fcos\nversion: 1.5.0\n",
+		"empty.yaml":  "",
+		"null.yaml":   "~\n",
+		"null.json":   "null\n",
+		"string.yaml": "fcos\n",
+		"seq.yaml":    "# comment\n- variant: fcos\n",
+		"scalar.json": "\"fcos\"\n",
+		"seq.json":    "[{\"variant\": \"fcos\"}]\n",
+	})
+	cases := []struct {
+		name    string
+		files   []string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "empty-first",
+			files: []string{"empty.yaml", "base.yaml"},
+			want:  "variant: fcos\nversion: 1.5.0\n",
+		},
+		{
+			name:  "null-first",
+			files: []string{"null.yaml", "null.json", "base.yaml"},
+			want:  "variant: fcos\nversion: 1.5.0\n",
+		},
+		{
+			name:    "scalar-first",
+			files:   []string{"string.yaml", "base.yaml"},
+			wantErr: "file[string.yaml]: line 1: the top level is a scalar, not a mapping",
+		},
+		{
+			name:    "sequence",
+			files:   []string{"base.yaml", "seq.yaml"},
+			wantErr: "file[seq.yaml]: line 2: the top level is a sequence, not a mapping",
+		},
+		{
+			name:    "json-scalar",
+			files:   []string{"scalar.json", "base.yaml"},
+			wantErr: "file[scalar.json]: the top level is a scalar, not a mapping",
+		},
+		{
+			name:    "json-sequence",
+			files:   []string{"base.yaml", "seq.json"},
+			wantErr: "file[seq.json]: the top level is a sequence, not a mapping",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MergeFiles(&Options{FilesDir: dir}, tc.files...)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestStrictUnmarshal(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "variant: fcos\nversion: 1.5.0\n",
+		"unknown.yaml": "storage:\n  filez:\n    - path: /etc/motd\n",
+		"two.yaml":     "storage: {}\n---\npasswd: {}\n",
+		"front.yaml":   "meta:\n  owner: core\n---\nstorage: {}\n",
+		"front3.yaml":  "meta:\n  owner: core\n---\nstorage: {}\n---\npasswd: {}\n",
+		"empty.yaml":   "",
+		"two.json":     "{\"storage\": {}}\n{\"passwd\": {}}\n",
+		"one.json":     "{\"storage\": {}}\n",
+	})
+	fcos := Options{Variant: "fcos", Version: "1.5.0", StrictUnmarshal: true}
+	cases := []struct {
+		name    string
+		options Options
+		files   []string
+		wantErr string
+	}{
+		{
+			name:    "unknown-field",
+			options: fcos,
+			files:   []string{"base.yaml", "unknown.yaml"},
+			wantErr: `key[$.storage.filez] is not a known field in unknown.yaml, did you mean "files"?`,
+		},
+		{
+			name:    "unknown-field-not-strict",
+			options: Options{Variant: "fcos", Version: "1.5.0"},
+			files:   []string{"base.yaml", "unknown.yaml"},
+		},
+		{
+			// Without a schema no key is unknown.
+			name:    "unknown-field-no-schema",
+			options: Options{StrictUnmarshal: true},
+			files:   []string{"base.yaml", "unknown.yaml"},
+		},
+		{
+			name:    "documents",
+			options: Options{StrictUnmarshal: true},
+			files:   []string{"base.yaml", "two.yaml"},
+			wantErr: "file[two.yaml]: line 2: more than one document",
+		},
+		{
+			name:    "documents-not-strict",
+			options: Options{},
+			files:   []string{"base.yaml", "two.yaml"},
+		},
+		{
+			name:    "front-matter",
+			options: Options{StrictUnmarshal: true, MetaKey: "meta"},
+			files:   []string{"front.yaml", "empty.yaml"},
+		},
+		{
+			name:    "front-matter-documents",
+			options: Options{StrictUnmarshal: true, MetaKey: "meta"},
+			files:   []string{"front3.yaml"},
+			wantErr: "file[front3.yaml]: line 5: more than one document",
+		},
+		{
+			name:    "json-values",
+			options: Options{StrictUnmarshal: true},
+			files:   []string{"one.json", "two.json"},
+			wantErr: "file[two.json]: more than one top-level value",
+		},
+		{
+			name:    "json-values-not-strict",
+			options: Options{},
+			files:   []string{"one.json", "two.json"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			_, err := MergeFiles(&tc.options, tc.files...)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("MergeFiles() got err: %s", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestErrorOnDuplicateKeys(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"storage.yaml": "variant: fcos\nstorage:\n  files:\n    - path: /etc/a\nstorage:\n  files:\n    - path: /etc/b\n",
+		"element.yaml": "storage:\n  files:\n    - path: /etc/a\n      mode: 420\n      mode: 384\n",
+		"front.yaml":   "meta:\n  owner: core\n  owner: root\n---\nstorage: {}\n",
+		"storage.json": `{"storage": {"files": [{"path": "/etc/a"}]}, "storage": {"files": [{"path": "/etc/b"}]}}`,
+		"element.json": `{"storage": {"files": [{"path": "/etc/a", "mode": 420, "mode": 384}]}}`,
+		"unique.json":  `{"storage": {"files": [{"path": "/etc/a"}, {"path": "/etc/a"}]}}`,
+	})
+	cases := []struct {
+		name       string
+		options    Options
+		files      []string
+		wantErr    string
+		wantOutput string
+	}{
+		{
+			name:    "yaml",
+			options: Options{ErrorOnDuplicateKeys: true},
+			files:   []string{"storage.yaml"},
+			wantErr: "file[storage.yaml]: line 5: key[$.storage] is already defined at line 2",
+		},
+		{
+			name:    "yaml-element",
+			options: Options{ErrorOnDuplicateKeys: true},
+			files:   []string{"element.yaml"},
+			wantErr: "file[element.yaml]: line 5: key[$.storage.files.mode] is already defined at line 4",
+		},
+		{
+			name:    "yaml-front-matter",
+			options: Options{ErrorOnDuplicateKeys: true, MetaKey: "meta"},
+			files:   []string{"front.yaml"},
+			wantErr: "file[front.yaml]: line 3: key[$.meta.owner] is already defined at line 2",
+		},
+		{
+			// yaml.v3 rejects the key regardless, without its path.
+			name:    "yaml-default",
+			files:   []string{"storage.yaml"},
+			wantErr: `file[storage.yaml]: error reading yaml: yaml: unmarshal errors:`,
+		},
+		{
+			name:    "json",
+			options: Options{ErrorOnDuplicateKeys: true},
+			files:   []string{"storage.json"},
+			wantErr: "file[storage.json]: key[$.storage] is already defined",
+		},
+		{
+			name:    "json-element",
+			options: Options{ErrorOnDuplicateKeys: true},
+			files:   []string{"element.json"},
+			wantErr: "file[element.json]: key[$.storage.files.mode] is already defined",
+		},
+		{
+			// Equal elements of a sequence are not repeated keys.
+			name:       "json-unique",
+			options:    Options{ErrorOnDuplicateKeys: true, OutputFormat: FormatJSON},
+			files:      []string{"unique.json"},
+			wantOutput: "{\n  \"storage\": {\n    \"files\": [\n      {\n        \"path\": \"/etc/a\"\n      },\n      {\n        \"path\": \"/etc/a\"\n      }\n    ]\n  }\n}\n",
+		},
+		{
+			// encoding/json keeps the last value.
+			name:       "json-default",
+			options:    Options{OutputFormat: FormatJSON},
+			files:      []string{"storage.json"},
+			wantOutput: "{\n  \"storage\": {\n    \"files\": [\n      {\n        \"path\": \"/etc/b\"\n      }\n    ]\n  }\n}\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			got, err := MergeFiles(&tc.options, tc.files...)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("MergeFiles() got err: %s", err)
+			case tc.wantErr != "":
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if diff := cmp.Diff(tc.wantOutput, string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestGzipInputs(t *testing.T) {
+	gz := func(path string) string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("error reading input file: %s", err)
+		}
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatalf("error compressing input file: %s", err)
+		}
+		return buf.String()
+	}
+	dir := writeFiles(t, map[string]string{
+		"common/input1.yaml.gz":   gz("resolve-path/common/input1.yaml"),
+		"host-dir/input2.yaml.gz": gz("resolve-path/host-dir/input2.yaml"),
+		"host-dir/input2.yaml":    gz("resolve-path/host-dir/input2.yaml"),
+		"input.json.gz":           gz("json/input2.json"),
+		"corrupt.yaml.gz":         "\x1f\x8bnot gzip",
+		"large.yaml":              "variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n" + strings.Repeat("    - path: /etc/motd\n", 100),
+	})
+	large := gz(filepath.Join(dir, "large.yaml"))
+	if err := os.WriteFile(filepath.Join(dir, "large.yaml.gz"), []byte(large), 0o644); err != nil {
+		t.Fatalf("error writing file: %s", err)
+	}
+	options := func(dir string) *Options {
+		return &Options{DefaultOverWrite: true, FilesDir: dir, ResolvePath: []string{".local"}}
+	}
+	cases := []struct {
+		name     string
+		dir      string
+		plain    []string
+		files    []string
+		maxBytes int64
+		wantErr  string
+	}{
+		{
+			name:  "gz-extension",
+			dir:   "resolve-path",
+			plain: []string{"common/input1.yaml", "host-dir/input2.yaml"},
+			files: []string{"common/input1.yaml.gz", "host-dir/input2.yaml.gz"},
+		},
+		{
+			// The content is detected, whatever the extension.
+			name:  "magic",
+			dir:   "resolve-path",
+			plain: []string{"common/input1.yaml", "host-dir/input2.yaml"},
+			files: []string{"common/input1.yaml.gz", "host-dir/input2.yaml"},
+		},
+		{
+			name:  "json",
+			dir:   "json",
+			plain: []string{"input2.json"},
+			files: []string{"input.json.gz"},
+		},
+		{
+			name:    "corrupt",
+			files:   []string{"corrupt.yaml.gz"},
+			wantErr: "file[corrupt.yaml.gz]: error reading gzip: ",
+		},
+		{
+			// The limit is on the decompressed size.
+			name:     "max-bytes",
+			files:    []string{"large.yaml.gz"},
+			maxBytes: int64(len(large)) * 2,
+			wantErr:  "file[large.yaml.gz]: input files total more than MaxTotalBytes of ",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := options(dir)
+			o.MaxTotalBytes = tc.maxBytes
+			got, err := MergeFiles(o, tc.files...)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			want, err := MergeFiles(options(tc.dir), tc.plain...)
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(string(want), string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestNormalizeModes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml": `storage:
+  directories:
+    - path: /etc/app
+      mode: 493
+  files:
+    - path: /etc/a
+      mode: 420
+    - path: /etc/b
+      mode: 0600
+    - path: /etc/c
+      mode: "0640"
+    - path: /etc/d
+      mode: 0o755
+`,
+		"overlay.yaml": `storage:
+  files:
+    - path: /etc/e
+      mode: 644
+    - path: /etc/f
+      mode: "644"
+    - path: /etc/g
+      mode: rw-r--r--
+  links:
+    - path: /etc/h
+      target: /etc/a
+`,
+	})
+	options := &Options{FilesDir: dir, NormalizeModes: true}
+	got, err := MergeFilesResult(options, "base.yaml", "overlay.yaml")
+	if err != nil {
+		t.Fatalf("MergeFilesResult() got err: %s", err)
+	}
+	want := `storage:
+    directories:
+        - mode: 0755
+          path: /etc/app
+    files:
+        - mode: 0644
+          path: /etc/a
+        - mode: 0600
+          path: /etc/b
+        - mode: 0640
+          path: /etc/c
+        - mode: 0755
+          path: /etc/d
+        - mode: 01204
+          path: /etc/e
+        - mode: "644"
+          path: /etc/f
+        - mode: rw-r--r--
+          path: /etc/g
+    links:
+        - path: /etc/h
+          target: /etc/a
+`
+	if diff := cmp.Diff(want, string(got.Output)); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+	wantWarnings := []Warning{
+		{Path: "$.storage.files[path=/etc/e].mode", Message: "mode 644 is 01204 in octal; write 0644 if it was meant as octal"},
+		{Path: "$.storage.files[path=/etc/f].mode", Message: `mode "644" is a string; write 0644 or 644 for the octal or decimal mode`},
+		{Path: "$.storage.files[path=/etc/g].mode", Message: `mode "rw-r--r--" is not a file mode`},
+	}
+	if diff := cmp.Diff(wantWarnings, got.Warnings); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+
+	options.OutputFormat = FormatJSON
+	out, err := MergeFiles(options, "base.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	var config map[string]any
+	if err := json.Unmarshal(out, &config); err != nil {
+		t.Fatalf("error reading json: %s", err)
+	}
+	var modes []any
+	for _, f := range config["storage"].(map[string]any)["files"].([]any) {
+		modes = append(modes, f.(map[string]any)["mode"])
+	}
+	if diff := cmp.Diff([]any{420.0, 384.0, 416.0, 493.0}, modes); diff != "" {
+		t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestPatternAliases(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"host/base.yaml":    "passwd:\n  users:\n    - name: core\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 420\n      contents:\n        local: motd.txt\n",
+		"host/overlay.yaml": "passwd:\n  users:\n    - name: admin\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 384\n",
+	})
+	aliases := map[string]string{"@files": "$.storage.files", "@users": "$.passwd.users"}
+	cases := []struct {
+		name    string
+		options Options
+		want    string
+		wantErr string
+	}{
+		{
+			name: "expanded",
+			options: Options{
+				PatternAliases:        aliases,
+				MergeBy:               map[string]string{"@files": "path"},
+				Overwrite:             []string{"@files.mode"},
+				Append:                []string{"@users", "@files"},
+				ResolvePath:           []string{"@files.contents.local"},
+				DefaultSequencePolicy: SequenceError,
+			},
+			want: "passwd:\n  users:\n    - name: core\n    - name: admin\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 384\n      contents:\n        local: host/motd.txt\n",
+		},
+		{
+			name: "undefined",
+			options: Options{
+				PatternAliases: aliases,
+				Overwrite:      []string{"@file.mode"},
+			},
+			wantErr: `pattern "@file.mode" uses the undefined alias @file`,
+		},
+		{
+			name: "bad-name",
+			options: Options{
+				PatternAliases: map[string]string{"files": "$.storage.files"},
+			},
+			wantErr: `alias "files" must start with @ and hold no . or [`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			tc.options.Logger = log.New(io.Discard, "", 0)
+			got, err := MergeFiles(&tc.options, "host/base.yaml", "host/overlay.yaml")
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+
+	// A FileSpec has the aliases of its own Options.
+	spec := FileSpec{Path: "host/overlay.yaml", Options: &Options{Overwrite: []string{"@files.mode"}}}
+	_, err := MergeFileSpecs(&Options{FilesDir: dir, PatternAliases: aliases}, FileSpec{Path: "host/base.yaml"}, spec)
+	wantErr := `file[host/overlay.yaml]: pattern "@files.mode" uses the undefined alias @files`
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("MergeFileSpecs() got err %v wanted %q", err, wantErr)
+	}
+	spec.Options.PatternAliases = aliases
+	if _, err := MergeFileSpecs(&Options{FilesDir: dir}, FileSpec{Path: "host/base.yaml"}, spec); err != nil {
+		t.Errorf("MergeFileSpecs() got err: %s", err)
+	}
+
+	// The pattern of Contributors is expanded too.
+	options := &Options{FilesDir: dir, PatternAliases: aliases, MergeBy: map[string]string{"@files": "path"}, Overwrite: []string{"@files.mode"}}
+	files, err := Contributors(options, "@files.mode", "host/base.yaml", "host/overlay.yaml")
+	if err != nil {
+		t.Fatalf("Contributors() got err: %s", err)
+	}
+	if diff := cmp.Diff([]string{"host/base.yaml", "host/overlay.yaml"}, files); diff != "" {
+		t.Errorf("Contributors() got diff: -want/+got: %s", diff)
+	}
+	_, err = Contributors(options, "@file.mode", "host/base.yaml", "host/overlay.yaml")
+	wantErr = `pattern "@file.mode" uses the undefined alias @file`
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("Contributors() got err %v wanted %q", err, wantErr)
+	}
+}
+
+func TestSnippets(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":        "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n",
+		"docker.yaml":      "systemd:\n  units:\n    - name: docker.service\n      enabled: true\n",
+		"exporter.yaml":    "systemd:\n  units:\n    - name: node-exporter.service\n      enabled: true\n",
+		"docker-env.yaml":  "systemd:\n  units:\n    - name: docker.service\n      dropins:\n        - name: 10-proxy.conf\n          contents: |\n            [Service]\n            Environment=HTTP_PROXY=http://proxy\n",
+		"docker-off.yaml":  "systemd:\n  units:\n    - name: docker.service\n      enabled: false\n",
+		"motd-a.yaml":      "storage:\n  files:\n    - path: /etc/motd.d/a\n",
+		"motd-b.yaml":      "storage:\n  files:\n    - path: /etc/motd.d/b\n",
+		"docker-copy.yaml": "systemd:\n  units:\n    - name: docker.service\n      enabled: true\n",
+	})
+	cases := []struct {
+		name    string
+		options Options
+		files   []string
+		want    string
+		wantErr string
+	}{
+		{
+			// Each snippet creates the mappings above its sequence, or
+			// appends to the sequence another created.
+			name:  "append",
+			files: []string{"base.yaml", "docker.yaml", "motd-a.yaml", "exporter.yaml", "motd-b.yaml"},
+			want:  "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\nstorage:\n  files:\n    - path: /etc/motd.d/a\n    - path: /etc/motd.d/b\nsystemd:\n  units:\n    - name: docker.service\n      enabled: true\n    - name: node-exporter.service\n      enabled: true\n",
+		},
+		{
+			// Without a key, the same unit is added twice.
+			name:  "append-duplicate",
+			files: []string{"docker.yaml", "docker-copy.yaml"},
+			want:  "systemd:\n  units:\n    - name: docker.service\n      enabled: true\n    - name: docker.service\n      enabled: true\n",
+		},
+		{
+			name:    "merge-by",
+			options: Options{MergeBy: map[string]string{"$.systemd.units": "name"}},
+			files:   []string{"docker.yaml", "exporter.yaml", "docker-copy.yaml", "docker-env.yaml"},
+			want:    "systemd:\n  units:\n    - name: docker.service\n      enabled: true\n      dropins:\n        - name: 10-proxy.conf\n          contents: |\n            [Service]\n            Environment=HTTP_PROXY=http://proxy\n    - name: node-exporter.service\n      enabled: true\n",
+		},
+		{
+			// The schema keys units by name.
+			name:    "schema",
+			options: Options{Variant: "fcos", Version: "1.5.0"},
+			files:   []string{"base.yaml", "docker-env.yaml", "docker.yaml", "exporter.yaml", "docker-copy.yaml", "docker-env.yaml"},
+			want:    "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\nsystemd:\n  units:\n    - name: docker.service\n      enabled: true\n      dropins:\n        - name: 10-proxy.conf\n          contents: |\n            [Service]\n            Environment=HTTP_PROXY=http://proxy\n    - name: node-exporter.service\n      enabled: true\n",
+		},
+		{
+			name:    "schema-conflict",
+			options: Options{Variant: "fcos", Version: "1.5.0"},
+			files:   []string{"docker.yaml", "exporter.yaml", "docker-off.yaml"},
+			wantErr: "file[docker-off.yaml]: duplicate Keys(overrwrite=false): $.systemd.units[name=docker\\.service].enabled",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			got, err := MergeFiles(&tc.options, tc.files...)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestConcatInline(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml": "storage:\n  files:\n    - path: /etc/profile.d/env.sh\n      contents:\n        inline: |\n          export A=1\n    - path: /etc/motd\n      contents:\n        inline: hello\n",
+		"b.yaml": "storage:\n  files:\n    - path: /etc/profile.d/env.sh\n      contents:\n        inline: |\n          export B=2\n    - path: /etc/motd\n      contents:\n        inline: world\n",
+		"c.yaml": "storage:\n  files:\n    - path: /etc/issue\n      contents:\n        inline: issue\n",
+	})
+	cases := []struct {
+		name    string
+		options Options
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "merge-by",
+			options: Options{MergeBy: map[string]string{"$.storage.files": "path"}, ConcatInline: []string{".contents.inline"}},
+			want:    "storage:\n  files:\n    - path: /etc/profile.d/env.sh\n      contents:\n        inline: \"export A=1\\nexport B=2\\n\"\n    - path: /etc/motd\n      contents:\n        inline: \"hello\\nworld\"\n    - path: /etc/issue\n      contents:\n        inline: issue\n",
+		},
+		{
+			name:    "conflict",
+			options: Options{MergeBy: map[string]string{"$.storage.files": "path"}},
+			wantErr: "duplicate Keys(overrwrite=false): $.storage.files[path=",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			got, err := MergeFiles(&tc.options, "a.yaml", "b.yaml", "c.yaml")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestDefaultHeader(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "variant: flatcar\nversion: 1.1.0\n",
+		"snippet.yaml": "systemd:\n  units:\n    - name: docker.service\n      enabled: true\n",
+	})
+	snippet := "systemd:\n  units:\n    - name: docker.service\n      enabled: true\n"
+	cases := []struct {
+		name         string
+		options      Options
+		files        []string
+		want         string
+		wantWarnings []Warning
+	}{
+		{
+			name:    "injected",
+			options: Options{DefaultVariant: "fcos", DefaultVersion: "1.5.0"},
+			files:   []string{"snippet.yaml"},
+			want:    "variant: fcos\nversion: 1.5.0\n" + snippet,
+		},
+		{
+			name:    "present",
+			options: Options{DefaultVariant: "fcos", DefaultVersion: "1.5.0"},
+			files:   []string{"base.yaml", "snippet.yaml"},
+			want:    "variant: flatcar\nversion: 1.1.0\n" + snippet,
+		},
+		{
+			name:         "missing-version",
+			options:      Options{DefaultVariant: "fcos"},
+			files:        []string{"snippet.yaml"},
+			want:         "variant: fcos\n" + snippet,
+			wantWarnings: []Warning{{Path: "$.version", Message: "is not set by any file or default, so Butane rejects the config"}},
+		},
+		{
+			// Without any header option the config need not be Butane.
+			name:  "none",
+			files: []string{"snippet.yaml"},
+			want:  snippet,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			got, err := MergeFilesResult(&tc.options, tc.files...)
+			if err != nil {
+				t.Fatalf("MergeFilesResult() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got.Output)); diff != "" {
+				t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+			}
+			if diff := cmp.Diff(tc.wantWarnings, got.Warnings); diff != "" {
+				t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestMergeConfigDoesNotModifyInput(t *testing.T) {
+	config := map[string]any{
+		"x-owner": "alice",
+		"storage": map[string]any{
+			"files": []any{
+				map[string]any{
+					"path":     "/opt/file",
+					"contents": map[string]any{"local": "input-file.txt"},
+				},
+			},
+		},
+	}
+	want := deepCopy(config)
+	m, err := newMerge(&Options{
+		ResolvePath: []string{".local"},
+		Ignore:      []string{"$.x-owner"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("newMerge() got err: %s", err)
+	}
+	m.mergePolicy = m.policy
+	for i := 0; i < 2; i++ {
+		if err := m.mergeConfig("host-dir", config); err != nil {
+			t.Fatalf("mergeConfig() got err: %s", err)
+		}
+	}
+	if diff := cmp.Diff(want, config); diff != "" {
+		t.Errorf("mergeConfig() modified input: -want/+got: %s", diff)
+	}
+	files := m.root["storage"].(map[string]any)["files"].([]any)
+	if len(files) != 2 {
+		t.Fatalf("mergeConfig() got %d files wanted 2", len(files))
+	}
+	files[0].(map[string]any)["path"] = "/opt/changed"
+	if files[1].(map[string]any)["path"] != "/opt/file" {
+		t.Errorf("mergeConfig() root shares values between merged files")
+	}
+}
+
+func TestSealDepth(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml": `
+passwd:
+  users:
+    - name: user1
+storage:
+  files:
+    - path: /opt/file
+`,
+		"systemd.yaml": `
+systemd:
+  units:
+    - name: docker.service
+`,
+		"directories.yaml": `
+storage:
+  directories:
+    - path: /opt/dir
+`,
+		"users.yaml": `
+passwd:
+  users:
+    - name: user2
+`,
+	})
+	cases := []struct {
+		name    string
+		options *Options
+		files   []string
+		wantErr string
+	}{
+		{
+			name:    "unsealed",
+			options: &Options{},
+			files:   []string{"base.yaml", "systemd.yaml", "directories.yaml"},
+		},
+		{
+			name:    "top-level/new-section",
+			options: &Options{SealDepth: 1},
+			files:   []string{"base.yaml", "systemd.yaml"},
+			wantErr: "key[$.systemd] is not present in the base config",
+		},
+		{
+			name:    "top-level/nested-key",
+			options: &Options{SealDepth: 1},
+			files:   []string{"base.yaml", "directories.yaml", "users.yaml"},
+		},
+		{
+			name:    "top-level/allowed",
+			options: &Options{SealDepth: 1, AllowedNewKeys: []string{"$.systemd"}},
+			files:   []string{"base.yaml", "systemd.yaml"},
+		},
+		{
+			name:    "depth-2/nested-key",
+			options: &Options{SealDepth: 2},
+			files:   []string{"base.yaml", "users.yaml", "directories.yaml"},
+			wantErr: "key[$.storage.directories] is not present in the base config",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			_, err := MergeFiles(tc.options, tc.files...)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("MergeFiles() got err: %s", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestUniqueBy(t *testing.T) {
+	options := &Options{
+		FilesDir: "./overwrite",
+		UniqueBy: map[string]string{
+			"$.storage.files": "path",
+		},
+	}
+	_, err := MergeFiles(options, "input1.yaml", "input2.yaml")
+	wantErr := "key[$.storage.files] duplicate path /opt/file: in input1.yaml and input2.yaml"
+	if err == nil || !strings.Contains(err.Error(), wantErr) {
+		t.Errorf("MergeFiles() got err %v wanted %q", err, wantErr)
+	}
+
+	if _, err := MergeFiles(options, "input1.yaml"); err != nil {
+		t.Errorf("MergeFiles() got err: %s", err)
+	}
+	if _, err := MergeFiles(&Options{FilesDir: "./simple", UniqueBy: options.UniqueBy}, "input1.yaml", "input2.yaml"); err != nil {
+		t.Errorf("MergeFiles() got err: %s", err)
+	}
+}
+
+func TestMaxSequenceLen(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "storage:\n  files:\n    - path: /etc/a\n    - path: /etc/b\npasswd:\n  users:\n    - name: core\n",
+		"overlay.yaml": "storage:\n  files:\n    - path: /etc/c\npasswd:\n  users:\n    - name: admin\n    - name: guest\n",
+	})
+	options := &Options{
+		FilesDir:       dir,
+		MaxSequenceLen: map[string]int{"$.storage.files": 3, ".users": 2},
+	}
+	if _, err := MergeFiles(options, "base.yaml"); err != nil {
+		t.Errorf("MergeFiles() got err: %s", err)
+	}
+	_, err := MergeFiles(options, "base.yaml", "overlay.yaml")
+	wantErr := "file[overlay.yaml]: key[$.passwd.users] has 3 elements, more than its MaxSequenceLen of 2"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("MergeFiles() got err %v wanted %q", err, wantErr)
+	}
+
+	options.MaxSequenceLen[".users"] = 3
+	if _, err := MergeFiles(options, "base.yaml", "overlay.yaml"); err != nil {
+		t.Errorf("MergeFiles() got err: %s", err)
+	}
+	options.MaxSequenceLen["$.storage.files"] = 1
+	_, err = MergeFiles(options, "base.yaml", "overlay.yaml")
+	wantErr = "file[base.yaml]: key[$.storage.files] has 2 elements, more than its MaxSequenceLen of 1"
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("MergeFiles() got err %v wanted %q", err, wantErr)
+	}
+}
+
+func TestSortSequences(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n      ssh_authorized_keys: [key-c, key-a]\n    - name: admin\nstorage:\n  files:\n    - path: /etc/b\nsystemd:\n  units:\n    - name: z.service\n",
+		"overlay.yaml": "passwd:\n  users:\n    - name: backup\n      ssh_authorized_keys: [key-b]\nstorage:\n  files:\n    - path: /etc/a\nsystemd:\n  units:\n    - name: y.service\n",
+	})
+	options := &Options{
+		FilesDir:      dir,
+		SortSequences: []string{".ssh_authorized_keys", "$.passwd.users", "$.storage.files", "$.systemd.units"},
+		MergeBy:       map[string]string{"$.passwd.users": "name"},
+		UniqueBy:      map[string]string{"$.storage.files": "path"},
+		Variant:       "fcos",
+		Version:       "1.5.0",
+	}
+	got, err := MergeFilesResult(options, "base.yaml", "overlay.yaml")
+	if err != nil {
+		t.Fatalf("MergeFilesResult() got err: %s", err)
+	}
+	// Users are keyed by MergeBy, files by UniqueBy and units by the schema.
+	want := "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: admin\n    - name: backup\n      ssh_authorized_keys: [key-b]\n    - name: core\n      ssh_authorized_keys: [key-a, key-c]\nstorage:\n  files:\n    - path: /etc/a\n    - path: /etc/b\nsystemd:\n  units:\n    - name: y.service\n    - name: z.service\n"
+	if diff := cmp.Diff(mustUnmarshal(t, []byte(want)), mustUnmarshal(t, got.Output)); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+	if len(got.Warnings) != 0 {
+		t.Errorf("MergeFilesResult() got warnings %v", got.Warnings)
+	}
+
+	options = &Options{FilesDir: dir, SortSequences: []string{"$.passwd.users", ".ssh_authorized_keys"}}
+	got, err = MergeFilesResult(options, "base.yaml", "overlay.yaml")
+	if err != nil {
+		t.Fatalf("MergeFilesResult() got err: %s", err)
+	}
+	want = "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n      ssh_authorized_keys: [key-a, key-c]\n    - name: admin\n    - name: backup\n      ssh_authorized_keys: [key-b]\nstorage:\n  files:\n    - path: /etc/b\n    - path: /etc/a\nsystemd:\n  units:\n    - name: z.service\n    - name: y.service\n"
+	if diff := cmp.Diff(mustUnmarshal(t, []byte(want)), mustUnmarshal(t, got.Output)); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+	wantWarnings := []Warning{{Path: "$.passwd.users", Message: "is not sorted, as its mappings have no key field"}}
+	if diff := cmp.Diff(wantWarnings, got.Warnings); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		options *Options
+		file    string
+		wantErr string
+	}{
+		{
+			name:    "missing-data",
+			options: &Options{FilesDir: "./template"},
+			file:    "host/input2.yaml",
+			wantErr: "key[$.storage.files.contents.template]: error rendering template",
+		},
+		{
+			name: "missing-template",
+			options: &Options{
+				FilesDir: writeFiles(t, map[string]string{
+					"input.yaml": "storage:\n  files:\n    - contents:\n        template: missing.tmpl\n",
+				}),
+			},
+			file:    "input.yaml",
+			wantErr: "key[$.storage.files.contents.template]: error reading template",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := MergeFiles(tc.options, tc.file)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestAnnotateSource(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "variant: fcos\nstorage:\n  files:\n    - path: /etc/motd\n  disks:\n    - device: /dev/sda\n",
+		"overlay.yaml": "version: 1.5.0\nstorage:\n  files:\n    - path: /etc/issue\n",
+	})
+	options := &Options{FilesDir: dir, Overwrite: []string{"$.storage.files"}, AnnotateSource: true}
+	got, err := MergeFiles(options, "base.yaml", "overlay.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	want := `storage: # from base.yaml
+    disks:
+        - device: /dev/sda
+    files: # from overlay.yaml
+        - path: /etc/issue
+variant: fcos # from base.yaml
+version: 1.5.0 # from overlay.yaml
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+	}
+
+	options.OutputFormat = FormatJSON
+	got, err = MergeFiles(options, "base.yaml", "overlay.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	if strings.Contains(string(got), "from") {
+		t.Errorf("MergeFiles() got annotated json: %s", got)
+	}
+}
@@ -0,0 +1,90 @@
+package butanex
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// modeSequences are the sequences of the Butane spec whose elements have a
+// file mode.
+var modeSequences = []string{"$.storage.directories", "$.storage.files"}
+
+// isModeField returns whether the key at ctxpath is a file mode.
+func isModeField(ctxpath string) bool {
+	ctxpath, _ = stripSelectors(ctxpath)
+	for _, seq := range modeSequences {
+		if ctxpath == joinPath(seq, "mode") {
+			return true
+		}
+	}
+	return false
+}
+
+// formatMode returns mode in octal with a leading zero, as in `0644`.
+func formatMode(mode int) string {
+	return fmt.Sprintf("0%03o", mode)
+}
+
+// normalizeModes rewrites every file mode of the merged config to an
+// integer, with a warning for each mode whose meaning is unclear.
+func (m *merge) normalizeModes() {
+	for _, seq := range modeSequences {
+		keys, _ := splitKeys(seq)
+		var v any = m.root
+		for _, key := range keys {
+			parent, _ := v.(map[string]any)
+			v = parent[key]
+		}
+		elements, _ := v.([]any)
+		for _, e := range elements {
+			em, ok := e.(map[string]any)
+			if !ok || em["mode"] == nil {
+				continue
+			}
+			mode, ok, warning := parseMode(em["mode"])
+			if ok {
+				em["mode"] = mode
+			}
+			if warning != "" {
+				ctxpath := seq
+				if path, ok := em["path"]; ok {
+					ctxpath = elementPath(seq, "path", path)
+				}
+				m.warnings = append(m.warnings, Warning{Path: joinPath(ctxpath, "mode"), Message: warning})
+			}
+		}
+	}
+}
+
+// parseMode returns the file mode v means, and whether it means one, along
+// with a warning if its meaning is unclear.
+func parseMode(v any) (int, bool, string) {
+	switch v := v.(type) {
+	case int:
+		if v < 0 || v > 0o7777 {
+			return 0, false, fmt.Sprintf("mode %d is not a file mode", v)
+		}
+		if v > 0o777 && strings.Trim(strconv.Itoa(v), "01234567") == "" {
+			return v, true, fmt.Sprintf("mode %d is %s in octal; write 0%d if it was meant as octal", v, formatMode(v), v)
+		}
+		return v, true, ""
+	case string:
+		s := strings.TrimSpace(v)
+		digits, octal := strings.CutPrefix(strings.ToLower(s), "0o")
+		if !octal && len(s) > 1 && s[0] == '0' {
+			digits, octal = s[1:], true
+		}
+		n, err := strconv.ParseUint(digits, 8, 16)
+		switch {
+		case s == "0":
+			return 0, true, ""
+		case err != nil || n > 0o7777:
+			return 0, false, fmt.Sprintf("mode %q is not a file mode", v)
+		case !octal:
+			return 0, false, fmt.Sprintf("mode %q is a string; write 0%s or %s for the octal or decimal mode", v, s, s)
+		}
+		return int(n), true, ""
+	}
+	return 0, false, fmt.Sprintf("mode %v is not a file mode", v)
+}
@@ -0,0 +1,220 @@
+package butanex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format is a serialization format for the merged config.
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+)
+
+// marshal serializes the merged config in the given format. YAML output is
+// first encoded into a yaml.Node so that the policy can control how individual
+// values are emitted, and so that keys can be annotated with their sources.
+func marshal(root map[string]any, policy *mergePolicy, sources map[string]string, format Format) ([]byte, error) {
+	switch format {
+	case "", FormatYAML:
+	case FormatJSON:
+		d, err := json.MarshalIndent(root, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("error encoding json: %w", err)
+		}
+		return append(d, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unknown output format: %q", format)
+	}
+	doc, err := encodeNode(root, policy, sources)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// encodeNode encodes the merged config into a document node styled according
+// to the policy. If sources is non-nil, keys are annotated with the file they
+// came from.
+func encodeNode(root map[string]any, policy *mergePolicy, sources map[string]string) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := doc.Encode(root); err != nil {
+		return nil, fmt.Errorf("error encoding yaml: %w", err)
+	}
+	styleNode(&doc, "$", policy)
+	if sources != nil {
+		annotateNode(&doc, "$", "", sources)
+	}
+	return &doc, nil
+}
+
+// annotateNode adds a line comment to each key whose source differs from
+// parent, the source of the enclosing key.
+func annotateNode(n *yaml.Node, ctxpath, parent string, sources map[string]string) {
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			annotateNode(c, ctxpath, parent, sources)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			cpath := joinPath(ctxpath, n.Content[i].Value)
+			source, ok := sources[cpath]
+			if !ok {
+				source = parent
+			}
+			if source != parent {
+				n.Content[i].LineComment = "from " + source
+			}
+			annotateNode(n.Content[i+1], cpath, source, sources)
+		}
+	}
+}
+
+// styleNode walks the node tree rooted at n and sets the style of each scalar
+// according to the policy.
+func styleNode(n *yaml.Node, ctxpath string, policy *mergePolicy) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			styleNode(c, ctxpath, policy)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			policy.scope.push(ctxpath, i, c)
+			styleNode(c, ctxpath, policy)
+			policy.scope.pop()
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			styleNode(n.Content[i+1], joinPath(ctxpath, n.Content[i].Value), policy)
+		}
+	case yaml.ScalarNode:
+		if policy.octalModes && n.Tag == "!!int" && isModeField(ctxpath) {
+			if mode, err := strconv.Atoi(n.Value); err == nil {
+				n.Value = formatMode(mode)
+				return
+			}
+		}
+		if quote, ok := policy.quoteStyle(ctxpath); ok && n.Tag != "!!null" {
+			if quote {
+				n.Tag = "!!str"
+				n.Style = yaml.DoubleQuotedStyle
+			} else if !strings.Contains(n.Value, "\n") {
+				// Without a tag the plain value is resolved when parsed.
+				n.Tag = ""
+				n.Style = 0
+			}
+			return
+		}
+		if n.Tag != "!!str" {
+			return
+		}
+		if strings.Contains(n.Value, "\n") || policy.isLiteralStyle(ctxpath) {
+			n.Style = yaml.LiteralStyle
+		}
+	}
+}
+
+// decodeJSON parses a JSON config. Numbers are decoded to int where possible so
+// that values compare equal to the same values parsed from YAML. If strict is
+// true anything after the config is an error rather than ignored, and if
+// duplicateKeys is true so is a key repeated within an object.
+func decodeJSON(data []byte, strict, duplicateKeys bool) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("error reading json: %w", err)
+	}
+	if duplicateKeys {
+		// The value decoded, so only a repeated key can be an error.
+		if err := checkJSONKeys(json.NewDecoder(bytes.NewReader(data)), "$"); err != nil {
+			return nil, err
+		}
+	}
+	if strict {
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, fmt.Errorf("more than one top-level value")
+		}
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		return convertNumbers(v).(map[string]any), nil
+	case nil:
+		return map[string]any{}, nil
+	case []any:
+		return nil, fmt.Errorf("the top level is a sequence, not a mapping")
+	}
+	return nil, fmt.Errorf("the top level is a scalar, not a mapping")
+}
+
+// checkJSONKeys reads the next value from dec, which is at ctxpath, and
+// returns an error for the first key repeated within an object of it.
+func checkJSONKeys(dec *json.Decoder, ctxpath string) error {
+	t, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("error reading json: %w", err)
+	}
+	switch t {
+	case json.Delim('{'):
+		seen := map[string]bool{}
+		for dec.More() {
+			t, err := dec.Token()
+			if err != nil {
+				return fmt.Errorf("error reading json: %w", err)
+			}
+			key := t.(string)
+			cpath := joinPath(ctxpath, key)
+			if seen[key] {
+				return fmt.Errorf("key[%s] is already defined", cpath)
+			}
+			seen[key] = true
+			if err := checkJSONKeys(dec, cpath); err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		for dec.More() {
+			if err := checkJSONKeys(dec, ctxpath); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	// The closing delimiter.
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("error reading json: %w", err)
+	}
+	return nil
+}
+
+func convertNumbers(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, vi := range v {
+			v[k] = convertNumbers(vi)
+		}
+	case []any:
+		for i, vi := range v {
+			v[i] = convertNumbers(vi)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	}
+	return v
+}
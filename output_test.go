@@ -0,0 +1,235 @@
+package butanex
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	yaml "gopkg.in/yaml.v3"
+	"strings"
+	"testing"
+)
+
+func TestMarshalLiteralStyle(t *testing.T) {
+	root := map[string]any{
+		"storage": map[string]any{
+			"files": []any{
+				map[string]any{
+					"path": "/opt/script.sh",
+					"contents": map[string]any{
+						"inline": "#!/bin/sh\necho \"hello\"\n",
+					},
+				},
+				map[string]any{
+					"path": "/opt/one-line.sh",
+					"contents": map[string]any{
+						"inline": "echo hello",
+					},
+				},
+			},
+		},
+	}
+	cases := []struct {
+		name    string
+		options *Options
+		want    string
+	}{
+		{
+			name:    "multiline-only",
+			options: &Options{},
+			want: `storage:
+    files:
+        - contents:
+            inline: |
+                #!/bin/sh
+                echo "hello"
+          path: /opt/script.sh
+        - contents:
+            inline: echo hello
+          path: /opt/one-line.sh
+`,
+		},
+		{
+			name: "pattern",
+			options: &Options{
+				LiteralStyle: []string{".contents.inline"},
+			},
+			want: `storage:
+    files:
+        - contents:
+            inline: |
+                #!/bin/sh
+                echo "hello"
+          path: /opt/script.sh
+        - contents:
+            inline: |-
+                echo hello
+          path: /opt/one-line.sh
+`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := marshal(root, buildPolicy(tc.options), nil, FormatYAML)
+			if err != nil {
+				t.Fatalf("marshal() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("marshal() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestOutputFormatJSON(t *testing.T) {
+	got, err := MergeFiles(&Options{FilesDir: "./json", OutputFormat: FormatJSON}, "input1.yaml", "input2.json")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	want := `{
+  "passwd": {
+    "users": [
+      {
+        "name": "user1",
+        "ssh_authorized_keys": [
+          "key1"
+        ]
+      }
+    ]
+  },
+  "storage": {
+    "files": [
+      {
+        "contents": {
+          "inline": "Hello, world!"
+        },
+        "mode": 420,
+        "path": "/opt/file"
+      }
+    ]
+  },
+  "variant": "fcos",
+  "version": "1.5.0"
+}
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestMarshalQuoting(t *testing.T) {
+	input := []byte(`
+version: 1.5.0
+storage:
+  files:
+    - path: /etc/motd
+      mode: "0644"
+      user:
+        id: 1000
+`)
+	cases := []struct {
+		name    string
+		options *Options
+		want    string
+	}{
+		{
+			name:    "default",
+			options: &Options{},
+			want: `storage:
+    files:
+        - mode: "0644"
+          path: /etc/motd
+          user:
+            id: 1000
+version: 1.5.0
+`,
+		},
+		{
+			name: "force-quote",
+			options: &Options{
+				ForceQuote: []string{"$.version", ".mode", ".user.id"},
+			},
+			want: `storage:
+    files:
+        - mode: "0644"
+          path: /etc/motd
+          user:
+            id: "1000"
+version: "1.5.0"
+`,
+		},
+		{
+			name: "force-unquote",
+			options: &Options{
+				ForceUnquote: []string{".mode"},
+			},
+			want: `storage:
+    files:
+        - mode: 0644
+          path: /etc/motd
+          user:
+            id: 1000
+version: 1.5.0
+`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := mustUnmarshal(t, input)
+			got, err := marshal(root, buildPolicy(tc.options), nil, FormatYAML)
+			if err != nil {
+				t.Fatalf("marshal() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("marshal() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestMarshaler(t *testing.T) {
+	twoSpaces := func(root map[string]any) ([]byte, error) {
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(root); err != nil {
+			return nil, err
+		}
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	options := &Options{FilesDir: "./simple", Marshaler: twoSpaces, OutputFormat: FormatJSON}
+	got, err := MergeFiles(options, "input1.yaml", "input2.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	want := `passwd:
+  users:
+    - name: user1
+      ssh_authorized_keys:
+        - key1
+storage:
+  files:
+    - contents:
+        inline: Hello, world!
+      path: /opt/file
+variant: fcos
+version: 1.5.0
+`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+	}
+
+	options.Marshaler = func(map[string]any) ([]byte, error) {
+		return nil, errors.New("no output")
+	}
+	_, err = MergeFiles(options, "input1.yaml", "input2.yaml")
+	if wantErr := "error encoding output: no output"; err == nil || err.Error() != wantErr {
+		t.Errorf("MergeFiles() got err %v wanted %q", err, wantErr)
+	}
+	options.EmitConflictMarkers, options.OutputFormat = true, ""
+	if _, err := MergeFiles(options, "input1.yaml"); err == nil || !strings.Contains(err.Error(), "Marshaler") {
+		t.Errorf("MergeFiles() got err %v wanted one naming the Marshaler", err)
+	}
+}
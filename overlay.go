@@ -0,0 +1,39 @@
+package butanex
+
+import (
+	"fmt"
+)
+
+// ApplyOverlay merges overlay into a copy of base, as MergeFiles merges a
+// second file into the first, and returns the result. Neither base nor
+// overlay is modified, and nothing is read or written: only the merge policy
+// of options applies, not what prepares each file, such as Ignore,
+// ResolvePath and templates, nor what follows the merge, such as PruneEmpty
+// and Set. Options.Seed, if set, is merged onto as it is by MergeFiles, so base
+// merges onto a copy of it as if it were an earlier file. The configs hold
+// values as decoded from YAML into a map[string]any. Errors name them as the
+// files base and overlay.
+func ApplyOverlay(options *Options, base, overlay map[string]any) (map[string]any, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	m, err := newMerge(options, nil)
+	if err != nil {
+		return nil, err
+	}
+	m.mergePolicy = m.policy
+	if m.root == nil {
+		m.root = map[string]any{}
+	}
+	for _, c := range []struct {
+		file   string
+		config map[string]any
+	}{{"base", base}, {"overlay", overlay}} {
+		m.file = c.file
+		if err := m.mergeMapping(m.root, deepCopy(c.config).(map[string]any), "$", 1); err != nil {
+			return nil, fmt.Errorf("file[%s]: %w", c.file, err)
+		}
+		m.count++
+	}
+	return m.root, nil
+}
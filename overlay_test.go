@@ -0,0 +1,100 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"strings"
+	"testing"
+)
+
+func TestApplyOverlay(t *testing.T) {
+	base := `variant: fcos
+version: 1.5.0
+passwd:
+  users:
+    - name: core
+      ssh_authorized_keys: [key1]
+storage:
+  files:
+    - path: /etc/motd
+      mode: 420
+`
+	cases := []struct {
+		name    string
+		options *Options
+		overlay string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "append",
+			overlay: "passwd:\n  users:\n    - name: admin\nstorage:\n  links:\n    - path: /etc/a\n      target: /a\n",
+			want:    "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n      ssh_authorized_keys: [key1]\n    - name: admin\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 420\n  links:\n    - path: /etc/a\n      target: /a\n",
+		},
+		{
+			name:    "merge-by",
+			options: &Options{MergeBy: map[string]string{"$.passwd.users": "name"}},
+			overlay: "passwd:\n  users:\n    - name: core\n      ssh_authorized_keys: [key2]\n",
+			want:    "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n      ssh_authorized_keys: [key1, key2]\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 420\n",
+		},
+		{
+			name:    "overwrite",
+			options: &Options{Overwrite: []string{"$.version", "$.storage.files"}},
+			overlay: "version: 1.6.0\nstorage:\n  files:\n    - path: /etc/hosts\n",
+			want:    "variant: fcos\nversion: 1.6.0\npasswd:\n  users:\n    - name: core\n      ssh_authorized_keys: [key1]\nstorage:\n  files:\n    - path: /etc/hosts\n",
+		},
+		{
+			name:    "empty-overlay",
+			overlay: "",
+			want:    base,
+		},
+		{
+			name:    "seed",
+			options: &Options{Seed: map[string]any{"systemd": map[string]any{"units": []any{map[string]any{"name": "a.service"}}}}},
+			overlay: "systemd:\n  units:\n    - name: b.service\n",
+			want:    base + "systemd:\n  units:\n    - name: a.service\n    - name: b.service\n",
+		},
+		{
+			name:    "seed-conflict",
+			options: &Options{Seed: map[string]any{"version": "1.4.0"}},
+			overlay: "",
+			wantErr: "file[base]: duplicate Keys(overrwrite=false): $.version",
+		},
+		{
+			name:    "conflict",
+			overlay: "version: 1.6.0\n",
+			wantErr: "file[overlay]: duplicate Keys(overrwrite=false): $.version",
+		},
+		{
+			name:    "schema",
+			options: &Options{Variant: "fcos", Version: "1.5.0"},
+			overlay: "storage:\n  files: /etc/hosts\n",
+			wantErr: "file[overlay]: key[$.storage.files]",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := mustUnmarshal(t, []byte(base))
+			o := mustUnmarshal(t, []byte(tc.overlay))
+			wantBase, wantOverlay := deepCopy(b), deepCopy(o)
+			got, err := ApplyOverlay(tc.options, b, o)
+			if tc.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+					t.Errorf("ApplyOverlay() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyOverlay() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), got); diff != "" {
+				t.Errorf("ApplyOverlay() got diff: -want/+got: %s", diff)
+			}
+			if diff := cmp.Diff(wantBase, any(b)); diff != "" {
+				t.Errorf("ApplyOverlay() modified base: -want/+got: %s", diff)
+			}
+			if diff := cmp.Diff(wantOverlay, any(o)); diff != "" {
+				t.Errorf("ApplyOverlay() modified overlay: -want/+got: %s", diff)
+			}
+		})
+	}
+}
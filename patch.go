@@ -0,0 +1,264 @@
+package butanex
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// patchKey is the directive key of a strategic patch.
+const patchKey = "$patch"
+
+// ApplyPatch merges the files like MergeFiles and then applies the file patch
+// to the result as a strategic patch, in the style of Kubernetes strategic
+// merge patches. Unlike the files merged, the patch is not subject to the
+// merge policy: its structure mirrors the config and each of its values
+// replaces the merged one, except that
+//
+//   - a mapping is patched key by key, and a null value deletes its key;
+//   - a mapping holding `$patch: delete` deletes its key, and one holding
+//     `$patch: replace` replaces the merged mapping instead of patching it;
+//   - a sequence whose elements are keyed by MergeBy, or by the schema,
+//     patches the merged element of the same key and appends the others. An
+//     element holding `$patch: delete` deletes the merged element of its key,
+//     and one holding `$patch: replace` replaces it;
+//   - any other sequence replaces the merged one.
+//
+// A sequence holding an element of only `$patch: replace` replaces the merged
+// sequence with its other elements, even if keyed, and a patch holding
+// `$patch: replace` itself replaces the whole merged config. The patch is read
+// like the other files, and goes through the same phases.
+func ApplyPatch(options *Options, patch string, path ...string) ([]byte, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	m, err := newMerge(options, nil)
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]FileSpec, len(path))
+	for i, p := range path {
+		specs[i] = FileSpec{Path: p}
+	}
+	if err := m.mergeSpecs(context.Background(), specs); err != nil {
+		return nil, err
+	}
+	if err := m.applyPatch(context.Background(), patch); err != nil {
+		return nil, fmt.Errorf("file[%s]: %w", patch, err)
+	}
+	return m.output(options.OutputFormat)
+}
+
+// applyPatch reads the file named path and applies it to the root.
+func (m *merge) applyPatch(ctx context.Context, path string) error {
+	local, config, err := m.readSource(ctx, path)
+	if err != nil {
+		return err
+	}
+	config = deepCopy(config).(map[string]any)
+	if m.metaKey != "" {
+		delete(config, m.metaKey)
+	}
+	if m.priorityKey != "" {
+		delete(config, m.priorityKey)
+	}
+	if m.afterKey != "" {
+		delete(config, m.afterKey)
+	}
+	m.file = path
+	m.mergePolicy = m.policy
+	m.strategies = map[string]mergeMode{}
+	if err := m.runPhases(filepath.Dir(local), config); err != nil {
+		return err
+	}
+	directive, err := patchDirective(config, "$")
+	if err != nil {
+		return err
+	}
+	if directive == "replace" {
+		v, err := stripPatch(config, "$")
+		if err != nil {
+			return err
+		}
+		m.root = v.(map[string]any)
+		return nil
+	}
+	return m.patchMapping(m.root, config, "$")
+}
+
+// patchMapping applies the mapping patch, which is at ctxpath, to dst.
+func (m *merge) patchMapping(dst, patch map[string]any, ctxpath string) error {
+	for key, pv := range patch {
+		if key == patchKey {
+			continue
+		}
+		cpath := joinPath(ctxpath, key)
+		switch pv := pv.(type) {
+		case nil:
+			delete(dst, key)
+		case map[string]any:
+			directive, err := patchDirective(pv, cpath)
+			if err != nil {
+				return err
+			}
+			dv, isMap := dst[key].(map[string]any)
+			switch {
+			case directive == "delete":
+				delete(dst, key)
+			case directive == "replace" || !isMap:
+				v, err := stripPatch(pv, cpath)
+				if err != nil {
+					return err
+				}
+				dst[key] = v
+				m.setSource(cpath)
+			default:
+				if err := m.patchMapping(dv, pv, cpath); err != nil {
+					return err
+				}
+			}
+		case []any:
+			dv, _ := dst[key].([]any)
+			seq, err := m.patchSequence(dv, pv, cpath)
+			if err != nil {
+				return err
+			}
+			dst[key] = seq
+			// The elements no longer line up with the files that added them.
+			delete(m.elementFiles, cpath)
+			m.setSource(cpath)
+		default:
+			dst[key] = pv
+			m.setSource(cpath)
+		}
+	}
+	return nil
+}
+
+// patchSequence returns dst with the sequence patch, which is at ctxpath,
+// applied.
+func (m *merge) patchSequence(dst, patch []any, ctxpath string) ([]any, error) {
+	replace := false
+	var elements []any
+	for _, e := range patch {
+		if em, ok := e.(map[string]any); ok && len(em) == 1 && em[patchKey] == "replace" {
+			replace = true
+			continue
+		}
+		elements = append(elements, e)
+	}
+	field, ok := m.mergeByField(ctxpath)
+	if !ok {
+		field, ok = m.schema.mergeByField(ctxpath)
+	}
+	if replace || !ok {
+		v, err := stripPatch(elements, ctxpath)
+		if err != nil {
+			return nil, err
+		}
+		return v.([]any), nil
+	}
+
+	seq := make([]any, len(dst))
+	copy(seq, dst)
+	for _, e := range elements {
+		key, ok := elementKey(e, field)
+		if !ok {
+			v, err := stripPatch(e, ctxpath)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+		em := e.(map[string]any)
+		directive, err := patchDirective(em, ctxpath)
+		if err != nil {
+			return nil, err
+		}
+		i := 0
+		for i < len(seq) {
+			if v, ok := elementKey(seq[i], field); ok && v == key {
+				break
+			}
+			i++
+		}
+		switch {
+		case directive == "delete":
+			if i < len(seq) {
+				seq = append(seq[:i], seq[i+1:]...)
+			}
+		case directive == "replace" || i == len(seq):
+			v, err := stripPatch(em, ctxpath)
+			if err != nil {
+				return nil, err
+			}
+			if i == len(seq) {
+				seq = append(seq, v)
+			} else {
+				seq[i] = v
+			}
+		default:
+			epath := elementPath(ctxpath, field, key)
+			m.mergePolicy.scope.push(ctxpath, i, seq[i])
+			err := m.patchMapping(seq[i].(map[string]any), em, epath)
+			m.mergePolicy.scope.pop()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return seq, nil
+}
+
+// patchDirective returns the directive of the mapping patch at ctxpath, or
+// "" if it has none.
+func patchDirective(patch map[string]any, ctxpath string) (string, error) {
+	v, ok := patch[patchKey]
+	if !ok {
+		return "", nil
+	}
+	switch v {
+	case "delete", "replace":
+		return v.(string), nil
+	}
+	return "", fmt.Errorf("key[%s] unknown patch directive: %v", joinPath(ctxpath, patchKey), v)
+}
+
+// stripPatch returns v, part of a patch at ctxpath, without the directives
+// that only make sense when patching. A directive to replace is dropped, as v
+// replaces the merged value anyway, and a directive to delete an element is
+// an error where there is no element to delete.
+func stripPatch(v any, ctxpath string) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		directive, err := patchDirective(v, ctxpath)
+		if err != nil {
+			return nil, err
+		}
+		if directive == "delete" {
+			return nil, fmt.Errorf("key[%s] has nothing to delete", ctxpath)
+		}
+		out := make(map[string]any, len(v))
+		for k, vi := range v {
+			if k == patchKey {
+				continue
+			}
+			if out[k], err = stripPatch(vi, joinPath(ctxpath, k)); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case []any:
+		out := make([]any, 0, len(v))
+		for _, vi := range v {
+			vi, err := stripPatch(vi, ctxpath)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, vi)
+		}
+		return out, nil
+	}
+	return v, nil
+}
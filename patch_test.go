@@ -0,0 +1,105 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"strings"
+	"testing"
+)
+
+func TestApplyPatch(t *testing.T) {
+	base := `variant: fcos
+version: 1.5.0
+passwd:
+  users:
+    - name: core
+      groups: [wheel]
+      ssh_authorized_keys: [key1]
+    - name: admin
+storage:
+  files:
+    - path: /etc/motd
+      mode: 420
+      contents:
+        inline: hello
+  links:
+    - path: /etc/a
+      target: /a
+`
+	cases := []struct {
+		name    string
+		options *Options
+		patch   string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "merge",
+			options: &Options{MergeBy: map[string]string{"$.passwd.users": "name"}},
+			patch:   "passwd:\n  users:\n    - name: core\n      ssh_authorized_keys: [key2]\n    - name: guest\nstorage:\n  files:\n    - path: /etc/hosts\n",
+			want:    "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n      groups: [wheel]\n      ssh_authorized_keys: [key2]\n    - name: admin\n    - name: guest\nstorage:\n  files:\n    - path: /etc/hosts\n  links:\n    - path: /etc/a\n      target: /a\n",
+		},
+		{
+			name:    "delete",
+			options: &Options{MergeBy: map[string]string{"$.passwd.users": "name"}},
+			patch:   "passwd:\n  users:\n    - name: admin\n      $patch: delete\nstorage:\n  links:\n    $patch: delete\n  files: ~\n",
+			want:    "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n      groups: [wheel]\n      ssh_authorized_keys: [key1]\nstorage: {}\n",
+		},
+		{
+			name:    "replace-mapping",
+			options: &Options{},
+			patch:   "storage:\n  $patch: replace\n  directories:\n    - path: /var/a\n",
+			want:    "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n      groups: [wheel]\n      ssh_authorized_keys: [key1]\n    - name: admin\nstorage:\n  directories:\n    - path: /var/a\n",
+		},
+		{
+			name:    "replace-element",
+			options: &Options{MergeBy: map[string]string{"$.passwd.users": "name"}},
+			patch:   "passwd:\n  users:\n    - name: core\n      $patch: replace\n      groups: [docker]\n",
+			want:    "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n      groups: [docker]\n    - name: admin\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 420\n      contents:\n        inline: hello\n  links:\n    - path: /etc/a\n      target: /a\n",
+		},
+		{
+			name:    "replace-sequence",
+			options: &Options{MergeBy: map[string]string{"$.passwd.users": "name"}},
+			patch:   "passwd:\n  users:\n    - $patch: replace\n    - name: guest\n",
+			want:    "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: guest\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 420\n      contents:\n        inline: hello\n  links:\n    - path: /etc/a\n      target: /a\n",
+		},
+		{
+			name:    "replace-root",
+			options: &Options{},
+			patch:   "$patch: replace\nvariant: fcos\nversion: 1.6.0\n",
+			want:    "variant: fcos\nversion: 1.6.0\n",
+		},
+		{
+			name:    "unknown-directive",
+			options: &Options{},
+			patch:   "storage:\n  $patch: merge\n",
+			wantErr: "key[$.storage.$patch] unknown patch directive: merge",
+		},
+		{
+			name:    "delete-in-replacement",
+			options: &Options{},
+			patch:   "storage:\n  $patch: replace\n  files:\n    - path: /etc/motd\n      $patch: delete\n",
+			wantErr: "key[$.storage.files] has nothing to delete",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, map[string]string{
+				"base.yaml":  base,
+				"patch.yaml": tc.patch,
+			})
+			got, err := ApplyPatch(tc.options, "patch.yaml", "base.yaml")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("ApplyPatch() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyPatch() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("ApplyPatch() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package butanex
+
+import (
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"slices"
+	"strings"
+)
+
+// pathEscaper escapes the characters of a key that are significant in a
+// context path.
+var pathEscaper = strings.NewReplacer(`\`, `\\`, `.`, `\.`, `[`, `\[`)
+
+// selectorEscaper escapes the characters of a selector value that are
+// significant in a context path.
+var selectorEscaper = strings.NewReplacer(`\`, `\\`, `.`, `\.`, `]`, `\]`)
+
+// joinPath returns the context path of key within the mapping at ctxpath. Dots
+// within the key are escaped so that `a.b` nested under `$` becomes `$.a\.b`
+// and cannot be confused with key `b` nested under key `a`. So is `[`, which
+// starts the selector of an element path.
+func joinPath(ctxpath, key string) string {
+	return ctxpath + "." + pathEscaper.Replace(key)
+}
+
+// splitKeys returns the keys of the absolute context path ctxpath, such as
+// `storage` and `files` for `$.storage.files`, with their escapes removed. It
+// returns false if ctxpath is not an absolute path of one or more keys.
+func splitKeys(ctxpath string) ([]string, bool) {
+	segments := splitPath(ctxpath)
+	if segments[0] != "$" || len(segments) == 1 {
+		return nil, false
+	}
+	keys := segments[1:]
+	for i, segment := range keys {
+		if segment == "" {
+			return nil, false
+		}
+		var b strings.Builder
+		for j := 0; j < len(segment); j++ {
+			if segment[j] == '\\' && j+1 < len(segment) {
+				j++
+			}
+			b.WriteByte(segment[j])
+		}
+		keys[i] = b.String()
+	}
+	return keys, true
+}
+
+// elementPath returns the context path of the element of the sequence at
+// ctxpath whose field has value, such as `$.storage.files[path=/etc/foo]`.
+// Policies match the path of an element as if the selector were not there.
+func elementPath(ctxpath, field string, value any) string {
+	return fmt.Sprintf("%s[%s=%s]", ctxpath, selectorEscaper.Replace(field), selectorEscaper.Replace(fmt.Sprint(value)))
+}
+
+// stripSelectors returns ctxpath without the selectors of elementPath, and
+// whether it had any.
+func stripSelectors(ctxpath string) (string, bool) {
+	if !strings.Contains(ctxpath, "[") {
+		return ctxpath, false
+	}
+	var b strings.Builder
+	found := false
+	inSelector := false
+	for i := 0; i < len(ctxpath); i++ {
+		c := ctxpath[i]
+		switch {
+		case c == '\\' && i+1 < len(ctxpath):
+			if !inSelector {
+				b.WriteString(ctxpath[i : i+2])
+			}
+			i++
+			continue
+		case c == '[' && !inSelector:
+			inSelector, found = true, true
+			continue
+		case c == ']' && inSelector:
+			inSelector = false
+			continue
+		}
+		if !inSelector {
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), found
+}
+
+// splitPath splits a context path into its segments. Escaped characters are
+// left escaped, so splitting `$.a\.b.c` returns `$`, `a\.b` and `c`.
+func splitPath(ctxpath string) []string {
+	var segments []string
+	start := 0
+	for i := 0; i < len(ctxpath); i++ {
+		switch ctxpath[i] {
+		case '\\':
+			i++
+		case '.':
+			segments = append(segments, ctxpath[start:i])
+			start = i + 1
+		}
+	}
+	return append(segments, ctxpath[start:])
+}
+
+// ContextPaths returns the sorted context path of every leaf value in a YAML
+// config, the same paths that Options patterns are matched against.
+//
+// Elements of a sequence share the context path of the sequence itself, so a
+// config with several `storage.files` entries yields `$.storage.files.path`
+// once. Empty mappings and sequences are reported as leaves.
+func ContextPaths(data []byte) ([]string, error) {
+	config := map[string]any{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error reading yaml: %w", err)
+	}
+	var paths []string
+	w := &walker{visit: func(ctxpath string, v any) (any, bool, error) {
+		switch v := v.(type) {
+		case map[string]any:
+			if len(v) > 0 {
+				return nil, false, nil
+			}
+		case []any:
+			if len(v) > 0 {
+				return nil, false, nil
+			}
+		}
+		paths = append(paths, ctxpath)
+		return nil, false, nil
+	}, maxDepth: DefaultMaxDepth}
+	if err := w.mapping(config, "$"); err != nil {
+		return nil, err
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths), nil
+}
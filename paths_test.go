@@ -0,0 +1,162 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestContextPaths(t *testing.T) {
+	data, err := os.ReadFile("resolve-path/common/input1.yaml")
+	if err != nil {
+		t.Fatalf("error reading input file: %s", err)
+	}
+	got, err := ContextPaths(data)
+	if err != nil {
+		t.Fatalf("ContextPaths() got err: %s", err)
+	}
+	want := []string{
+		"$.passwd.users.name",
+		"$.passwd.users.ssh_authorized_keys",
+		"$.storage.files.contents.local",
+		"$.storage.files.path",
+		"$.variant",
+		"$.version",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ContextPaths() got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestDottedKeys(t *testing.T) {
+	input1 := `
+metadata:
+  example.com/owner: alice
+  example:
+    com/owner: bob
+`
+	input2 := `
+metadata:
+  example.com/owner: carol
+  example:
+    com/owner: dave
+`
+	paths, err := ContextPaths([]byte(input1))
+	if err != nil {
+		t.Fatalf("ContextPaths() got err: %s", err)
+	}
+	wantPaths := []string{
+		`$.metadata.example.com/owner`,
+		`$.metadata.example\.com/owner`,
+	}
+	if diff := cmp.Diff(wantPaths, paths); diff != "" {
+		t.Errorf("ContextPaths() got diff: -want/+got: %s", diff)
+	}
+
+	cases := []struct {
+		name      string
+		overwrite []string
+		want      string
+	}{
+		{
+			name:      "escaped-absolute",
+			overwrite: []string{`$.metadata.example\.com/owner`, `$.metadata.example.com/owner`},
+			want: `
+metadata:
+  example.com/owner: carol
+  example:
+    com/owner: dave
+`,
+		},
+		{
+			name:      "escaped-relative",
+			overwrite: []string{`.example\.com/owner`, `$.metadata.example.com/owner`},
+			want: `
+metadata:
+  example.com/owner: carol
+  example:
+    com/owner: dave
+`,
+		},
+	}
+	dir := writeFiles(t, map[string]string{
+		"input1.yaml": input1,
+		"input2.yaml": input2,
+	})
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := MergeFiles(&Options{FilesDir: dir, Overwrite: tc.overwrite}, "input1.yaml", "input2.yaml")
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+
+	_, err = MergeFiles(&Options{FilesDir: dir, Overwrite: []string{`$.metadata.example\.com/owner`}}, "input1.yaml", "input2.yaml")
+	if err == nil || !strings.Contains(err.Error(), "$.metadata.example.com/owner") {
+		t.Errorf("MergeFiles() got err %v wanted duplicate key $.metadata.example.com/owner", err)
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	cases := []struct {
+		ctxpath string
+		want    []string
+	}{
+		{ctxpath: "$", want: []string{"$"}},
+		{ctxpath: "$.storage.files", want: []string{"$", "storage", "files"}},
+		{ctxpath: ".contents.local", want: []string{"", "contents", "local"}},
+		{ctxpath: `$.metadata.example\.com/owner`, want: []string{"$", "metadata", `example\.com/owner`}},
+		{ctxpath: `$.a\\.b`, want: []string{"$", `a\\`, "b"}},
+	}
+	for _, tc := range cases {
+		if diff := cmp.Diff(tc.want, splitPath(tc.ctxpath)); diff != "" {
+			t.Errorf("splitPath(%q) got diff: -want/+got: %s", tc.ctxpath, diff)
+		}
+	}
+}
+
+func TestStripSelectors(t *testing.T) {
+	cases := []struct {
+		ctxpath string
+		want    string
+		wantOK  bool
+	}{
+		{ctxpath: "$.storage.files.mode", want: "$.storage.files.mode"},
+		{ctxpath: "$.storage.files[path=/etc/foo].mode", want: "$.storage.files.mode", wantOK: true},
+		{ctxpath: elementPath("$.storage.files", "path", "/etc/a.conf") + ".mode", want: "$.storage.files.mode", wantOK: true},
+		{ctxpath: elementPath("$.systemd.units", "name", "a].service") + ".dropins[name=b.conf]", want: "$.systemd.units.dropins", wantOK: true},
+		{ctxpath: joinPath("$", "a[0]"), want: `$.a\[0]`},
+	}
+	for _, tc := range cases {
+		got, ok := stripSelectors(tc.ctxpath)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("stripSelectors(%q) got %q, %t, want %q, %t", tc.ctxpath, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestSplitKeys(t *testing.T) {
+	cases := []struct {
+		ctxpath string
+		want    []string
+		wantOK  bool
+	}{
+		{ctxpath: "$.storage.files", want: []string{"storage", "files"}, wantOK: true},
+		{ctxpath: `$.metadata.example\.com/owner`, want: []string{"metadata", "example.com/owner"}, wantOK: true},
+		{ctxpath: `$.a\\.b`, want: []string{`a\`, "b"}, wantOK: true},
+		{ctxpath: "$"},
+		{ctxpath: ".contents.local"},
+		{ctxpath: "$..mode"},
+	}
+	for _, tc := range cases {
+		got, ok := splitKeys(tc.ctxpath)
+		if diff := cmp.Diff(tc.want, got); diff != "" || ok != tc.wantOK {
+			t.Errorf("splitKeys(%q) got %q, %t, want %q, %t", tc.ctxpath, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
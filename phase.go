@@ -0,0 +1,78 @@
+package butanex
+
+import (
+	"fmt"
+)
+
+// Phase is a step each input file goes through after it is read and before it
+// is merged. Phases run in order over a private copy of the file's config, so
+// they may modify it in place.
+type Phase struct {
+	Name string
+	// Run transforms the config read from file. It is nil for the built-in
+	// phases, which are implemented by the merge itself.
+	Run func(file string, config map[string]any) error
+}
+
+// The built-in phases, each configured by Options.
+var (
+	// PhaseIgnore removes the keys matched by Options.Ignore.
+	PhaseIgnore = Phase{Name: "ignore"}
+	// PhaseStrategy extracts the inline strategy markers named by
+	// Options.StrategyKey.
+	PhaseStrategy = Phase{Name: "strategy"}
+	// PhaseResolve resolves the paths matched by Options.ResolvePath.
+	PhaseResolve = Phase{Name: "resolve"}
+	// PhaseTemplate renders contents.template files.
+	PhaseTemplate = Phase{Name: "template"}
+)
+
+// DefaultPhases returns the phases run when Options.Phases is nil.
+func DefaultPhases() []Phase {
+	return []Phase{PhaseIgnore, PhaseStrategy, PhaseResolve, PhaseTemplate}
+}
+
+// checkPhases returns an error if a phase is neither built in nor has a Run
+// function.
+func checkPhases(phases []Phase) error {
+	for _, p := range phases {
+		if p.Run != nil {
+			continue
+		}
+		switch p.Name {
+		case PhaseIgnore.Name, PhaseStrategy.Name, PhaseResolve.Name, PhaseTemplate.Name:
+		default:
+			return fmt.Errorf("unknown phase %q", p.Name)
+		}
+	}
+	return nil
+}
+
+// runPhases runs each phase over the config of the file being merged.
+func (m *merge) runPhases(fileRoot string, config map[string]any) error {
+	for _, p := range m.phases {
+		var err error
+		if p.Run != nil {
+			err = p.Run(m.file, config)
+		} else {
+			switch p.Name {
+			case PhaseIgnore.Name:
+				removeIgnored(config, "$", m.mergePolicy)
+			case PhaseStrategy.Name:
+				if m.strategyKey != "" {
+					err = m.extractStrategies(config, "$", true)
+				}
+			case PhaseResolve.Name:
+				if fileRoot != "" {
+					err = m.resolvePaths(config, fileRoot)
+				}
+			case PhaseTemplate.Name:
+				err = m.renderTemplates(config, fileRoot)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("phase[%s]: %w", p.Name, err)
+		}
+	}
+	return nil
+}
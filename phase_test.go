@@ -0,0 +1,94 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPhases(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"host/input.yaml": "storage:\n  files:\n    - contents:\n        local: ${NAME}.txt\n",
+	})
+	expand := Phase{
+		Name: "expand",
+		Run: func(file string, config map[string]any) error {
+			Walk(config, func(ctxpath string, v any) (any, bool) {
+				s, ok := v.(string)
+				if !ok {
+					return nil, false
+				}
+				return os.Expand(s, func(string) string { return "motd" }), true
+			})
+			return nil
+		},
+	}
+	stamp := Phase{
+		Name: "stamp",
+		Run: func(file string, config map[string]any) error {
+			config["stamp"] = file
+			return nil
+		},
+	}
+	cases := []struct {
+		name    string
+		phases  []Phase
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "default",
+			phases: nil,
+			want:   "storage:\n    files:\n        - contents:\n            local: host/${NAME}.txt\n",
+		},
+		{
+			name:   "expand-before-resolve",
+			phases: []Phase{expand, PhaseResolve},
+			want:   "storage:\n    files:\n        - contents:\n            local: host/motd.txt\n",
+		},
+		{
+			name:   "without-resolve",
+			phases: []Phase{expand},
+			want:   "storage:\n    files:\n        - contents:\n            local: motd.txt\n",
+		},
+		{
+			name:   "stamp-before-ignore",
+			phases: []Phase{stamp, PhaseIgnore},
+			want:   "storage:\n    files:\n        - contents:\n            local: ${NAME}.txt\n",
+		},
+		{
+			name:   "stamp-after-ignore",
+			phases: []Phase{PhaseIgnore, stamp},
+			want:   "stamp: host/input.yaml\nstorage:\n    files:\n        - contents:\n            local: ${NAME}.txt\n",
+		},
+		{
+			name:    "unknown",
+			phases:  []Phase{{Name: "validate"}},
+			wantErr: `unknown phase "validate"`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := &Options{
+				FilesDir:    dir,
+				ResolvePath: []string{".contents.local"},
+				Ignore:      []string{"$.stamp"},
+				Phases:      tc.phases,
+			}
+			got, err := MergeFiles(options, "host/input.yaml")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
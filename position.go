@@ -0,0 +1,103 @@
+package butanex
+
+import (
+	"bytes"
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"io"
+)
+
+// Position is a location in an input file.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+// IsValid reports whether the position is known.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// positions holds the position of each key of every file merged, keyed by file
+// and then by context path. Keys within the elements of a sequence merged by
+// key are also kept under the element's path, as in
+// `$.storage.files[path=/etc/foo].mode`. Otherwise keys within sequence
+// elements share the context path of the sequence, so only the first of them
+// is kept.
+type positions map[string]map[string]Position
+
+// read records the positions of the keys of the file named path, whose
+// content, decompressed, is data. keyField returns the field the elements of
+// the sequence at a context path are merged by, if any.
+func (p positions) read(data []byte, path, metaKey string, keyField func(ctxpath string) (string, bool)) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	var doc yaml.Node
+	if err := dec.Decode(&doc); err != nil && err != io.EOF {
+		return fmt.Errorf("error reading yaml: %w", err)
+	}
+	if metaKey != "" && hasKey(&doc, metaKey) {
+		// Use the config following front-matter, if there is one.
+		var next yaml.Node
+		if err := dec.Decode(&next); err == nil {
+			doc = next
+		}
+	}
+	keys := map[string]Position{}
+	addPositions(keys, &doc, "$", path, keyField)
+	p[path] = keys
+	return nil
+}
+
+// lookup returns the position of the key at ctxpath in file, if known.
+func (p positions) lookup(file, ctxpath string) Position {
+	return p[file][ctxpath]
+}
+
+// addPositions records the position of each key within n, which is at
+// ctxpath.
+func addPositions(keys map[string]Position, n *yaml.Node, ctxpath, file string, keyField func(string) (string, bool)) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			addPositions(keys, c, ctxpath, file, keyField)
+		}
+	case yaml.SequenceNode:
+		field, keyed := keyField(ctxpath)
+		for _, c := range n.Content {
+			addPositions(keys, c, ctxpath, file, keyField)
+			if value, ok := nodeKey(c, field); keyed && ok {
+				addPositions(keys, c, elementPath(ctxpath, field, value), file, keyField)
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			cpath := joinPath(ctxpath, key.Value)
+			if _, ok := keys[cpath]; !ok {
+				keys[cpath] = Position{File: file, Line: key.Line, Column: key.Column}
+			}
+			addPositions(keys, n.Content[i+1], cpath, file, keyField)
+		}
+	}
+}
+
+// hasKey reports whether the document n is a mapping holding key.
+func hasKey(n *yaml.Node, key string) bool {
+	if n.Kind == yaml.DocumentNode && len(n.Content) == 1 {
+		n = n.Content[0]
+	}
+	if n.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package butanex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/google/go-cmp/cmp"
+	"strings"
+	"testing"
+)
+
+func TestTrackPositions(t *testing.T) {
+	overlay := "x-meta:\n  priority: 1\n---\nstorage:\n  luks:\n    root:\n      device: /dev/sdb4\n"
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(overlay))
+	if err := w.Close(); err != nil {
+		t.Fatalf("error compressing input file: %s", err)
+	}
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":       "variant: fcos\nstorage:\n  files:\n    - path: /etc/hostname\n  luks:\n    root:\n      device: /dev/sda4\n",
+		"overlay.yaml":    overlay,
+		"overlay.yaml.gz": gz.String(),
+		"mismatch.yaml":   "\nstorage:\n    luks: []\n",
+		"files-a.yaml":    "storage:\n  files:\n    - path: /etc/bar\n    - path: /etc/foo\n      mode: 420\n",
+		"files-b.yaml":    "storage:\n  files:\n    - path: /etc/foo\n      contents:\n        inline: foo\n      mode: 384\n",
+	})
+	cases := []struct {
+		name    string
+		mergeBy map[string]string
+		files   []string
+		wantErr string
+	}{
+		{
+			name:    "scalar",
+			files:   []string{"base.yaml", "overlay.yaml"},
+			wantErr: "overlay.yaml:7:7: duplicate Keys(overrwrite=false): $.storage.luks.root.device (previously set at base.yaml:7:7)",
+		},
+		{
+			name:    "gzip",
+			files:   []string{"base.yaml", "overlay.yaml.gz"},
+			wantErr: "overlay.yaml.gz:7:7: duplicate Keys(overrwrite=false): $.storage.luks.root.device (previously set at base.yaml:7:7)",
+		},
+		{
+			name:    "mismatch",
+			files:   []string{"base.yaml", "mismatch.yaml"},
+			wantErr: "mismatch.yaml:3:5: key[$.storage.luks] mismatch: src([]interface {}) vs dst(map[string]interface {}) (previously set at base.yaml:5:3)",
+		},
+		{
+			name:    "merge-by",
+			mergeBy: map[string]string{"$.storage.files": "path"},
+			files:   []string{"files-a.yaml", "files-b.yaml"},
+			wantErr: "files-b.yaml:6:7: duplicate Keys(overrwrite=false): $.storage.files[path=/etc/foo].mode (previously set at files-a.yaml:5:7)",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := &Options{FilesDir: dir, MetaKey: "x-meta", TrackPositions: true, MergeBy: tc.mergeBy}
+			_, err := MergeFiles(options, tc.files...)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	ok, conflicts := CanMerge(&Options{FilesDir: dir, MetaKey: "x-meta", TrackPositions: true}, "base.yaml", "overlay.yaml")
+	if ok || len(conflicts) != 1 {
+		t.Fatalf("CanMerge() got %t, %v", ok, conflicts)
+	}
+	want := []Position{{File: "base.yaml", Line: 7, Column: 7}, {File: "overlay.yaml", Line: 7, Column: 7}}
+	got := []Position{conflicts[0].ExistingPos, conflicts[0].IncomingPos}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CanMerge() got diff: -want/+got: %s", diff)
+	}
+
+	options := &Options{FilesDir: dir, TrackPositions: true, MergeBy: map[string]string{"$.storage.files": "path"}}
+	ok, conflicts = CanMerge(options, "files-a.yaml", "files-b.yaml")
+	if ok || len(conflicts) != 1 {
+		t.Fatalf("CanMerge() got %t, %v", ok, conflicts)
+	}
+	want = []Position{{File: "files-a.yaml", Line: 5, Column: 7}, {File: "files-b.yaml", Line: 6, Column: 7}}
+	got = []Position{conflicts[0].ExistingPos, conflicts[0].IncomingPos}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CanMerge() got diff: -want/+got: %s", diff)
+	}
+}
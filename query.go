@@ -0,0 +1,557 @@
+package butanex
+
+import (
+	"cmp"
+	"fmt"
+	yaml "gopkg.in/yaml.v3"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// queryPrefix marks a pattern as a JSONPath query instead of a context path,
+// for example:
+//
+//	jsonpath:$.storage.files[?(@.path=="/etc/hosts")].mode
+//
+// A query starts with `$` and is followed by any of these steps:
+//
+//	.name or ['name']  the key name
+//	..name             the key name at any depth
+//	.* or [*]          any key or any sequence element
+//	[2]                the sequence element at index 2
+//	[1:3]              the sequence elements at index 1 and 2; either bound may be omitted
+//	[?(@.f)]           the sequence elements that are mappings with the key f
+//	[?(@.f==value)]    the sequence elements whose key f is equal to value
+//
+// A filter compares with ==, !=, <, <=, > or >=, and its value is a quoted
+// string, a number, true, false or null. The key of a filter may be nested,
+// as in @.contents.source.
+//
+// Unlike a context path, a query addresses each sequence element with a step
+// of its own, so `$.storage.files.mode` is written
+// `jsonpath:$.storage.files[*].mode`. Policies that apply to whole keys, such
+// as Overwrite, see a sequence but not its elements, so they only apply to a
+// query that selects a key outside any sequence element; a query that selects
+// within an element applies to policies such as ResolvePath, Ignore,
+// LiteralStyle and ForceQuote.
+const queryPrefix = "jsonpath:"
+
+// query is a compiled JSONPath query.
+type query struct {
+	steps []queryStep
+}
+
+type stepKind int
+
+const (
+	stepKey stepKind = iota
+	stepDescend
+	stepWildcard
+	stepIndex
+	stepSlice
+	stepFilter
+)
+
+type queryStep struct {
+	kind stepKind
+	// name is the key of a stepKey or stepDescend.
+	name string
+	// start and end bound a stepIndex or stepSlice. An end of -1 has no
+	// bound.
+	start, end int
+	filter     *queryFilter
+}
+
+// queryFilter selects the elements whose field compares to value with op. An
+// empty op selects the elements that have the field.
+type queryFilter struct {
+	field []string
+	op    string
+	value any
+}
+
+// isQuery returns whether pattern is a JSONPath query.
+func isQuery(pattern string) bool {
+	return strings.HasPrefix(pattern, queryPrefix)
+}
+
+// compileQuery compiles a pattern with the query prefix.
+func compileQuery(pattern string) (*query, error) {
+	s := strings.TrimPrefix(pattern, queryPrefix)
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("query %q does not start with `$`", pattern)
+	}
+	s = s[1:]
+	q := &query{}
+	for s != "" {
+		step, rest, err := parseStep(s)
+		if err != nil {
+			return nil, fmt.Errorf("query %q: %w", pattern, err)
+		}
+		q.steps = append(q.steps, step)
+		s = rest
+	}
+	if len(q.steps) == 0 {
+		return nil, fmt.Errorf("query %q is empty", pattern)
+	}
+	return q, nil
+}
+
+// parseStep parses the step at the start of s and returns the rest of s.
+func parseStep(s string) (queryStep, string, error) {
+	switch {
+	case strings.HasPrefix(s, ".."):
+		name, rest := cutName(s[2:])
+		if name == "" || name == "*" {
+			return queryStep{}, "", fmt.Errorf("`..` is not followed by a key")
+		}
+		return queryStep{kind: stepDescend, name: name}, rest, nil
+	case strings.HasPrefix(s, "."):
+		name, rest := cutName(s[1:])
+		switch name {
+		case "":
+			return queryStep{}, "", fmt.Errorf("`.` is not followed by a key")
+		case "*":
+			return queryStep{kind: stepWildcard}, rest, nil
+		}
+		return queryStep{kind: stepKey, name: name}, rest, nil
+	case strings.HasPrefix(s, "[?("):
+		end := strings.Index(s, ")]")
+		if end < 0 {
+			return queryStep{}, "", fmt.Errorf("filter %q is not closed", s)
+		}
+		filter, err := parseFilter(s[len("[?("):end])
+		if err != nil {
+			return queryStep{}, "", err
+		}
+		return queryStep{kind: stepFilter, filter: filter}, s[end+len(")]"):], nil
+	case strings.HasPrefix(s, "['"), strings.HasPrefix(s, `["`):
+		quote := s[1:2]
+		end := strings.Index(s[2:], quote+"]")
+		if end < 0 {
+			return queryStep{}, "", fmt.Errorf("key %q is not closed", s)
+		}
+		return queryStep{kind: stepKey, name: s[2 : 2+end]}, s[2+end+2:], nil
+	case strings.HasPrefix(s, "["):
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return queryStep{}, "", fmt.Errorf("subscript %q is not closed", s)
+		}
+		step, err := parseSubscript(s[1:end])
+		return step, s[end+1:], err
+	}
+	return queryStep{}, "", fmt.Errorf("unexpected %q", s)
+}
+
+// cutName returns the key at the start of s, which ends at the next `.` or
+// `[`, and the rest of s.
+func cutName(s string) (string, string) {
+	i := strings.IndexAny(s, ".[")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// parseSubscript parses an index, a slice or `*`.
+func parseSubscript(s string) (queryStep, error) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return queryStep{kind: stepWildcard}, nil
+	}
+	bound := func(b string, def int) (int, error) {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid index %q", b)
+		}
+		return n, nil
+	}
+	first, last, isSlice := strings.Cut(s, ":")
+	if !isSlice {
+		if first == "" {
+			return queryStep{}, fmt.Errorf("empty subscript")
+		}
+		n, err := bound(first, 0)
+		return queryStep{kind: stepIndex, start: n, end: n + 1}, err
+	}
+	start, err := bound(first, 0)
+	if err != nil {
+		return queryStep{}, err
+	}
+	end, err := bound(last, -1)
+	if err != nil {
+		return queryStep{}, err
+	}
+	return queryStep{kind: stepSlice, start: start, end: end}, nil
+}
+
+// parseFilter parses the expression of a filter, such as @.path=="/etc/hosts".
+func parseFilter(s string) (*queryFilter, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "@.") {
+		return nil, fmt.Errorf("filter %q does not start with `@.`", s)
+	}
+	s = s[len("@."):]
+	i := strings.IndexAny(s, "=!<> ")
+	if i < 0 {
+		i = len(s)
+	}
+	f := &queryFilter{field: strings.Split(s[:i], ".")}
+	for _, name := range f.field {
+		if name == "" || strings.ContainsFunc(name, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-'
+		}) {
+			return nil, fmt.Errorf("filter %q has an invalid key", s)
+		}
+	}
+	s = strings.TrimSpace(s[i:])
+	if s == "" {
+		return f, nil
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(s, op) {
+			f.op = op
+			break
+		}
+	}
+	if f.op == "" {
+		return nil, fmt.Errorf("filter %q has an unknown operator", s)
+	}
+	value, err := parseLiteral(strings.TrimSpace(s[len(f.op):]))
+	if err != nil {
+		return nil, err
+	}
+	f.value = value
+	return f, nil
+}
+
+// parseLiteral parses the value of a filter.
+func parseLiteral(s string) (any, error) {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1], nil
+	}
+	var v any
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil || s == "" {
+		return nil, fmt.Errorf("invalid value %q", s)
+	}
+	switch v.(type) {
+	case nil, bool, int, float64:
+		return v, nil
+	}
+	return nil, fmt.Errorf("invalid value %q: strings must be quoted", s)
+}
+
+// checkQueries returns an error if any pattern of options is an invalid query.
+func checkQueries(options *Options) error {
+	for _, patterns := range patternLists(options) {
+		for _, pattern := range *patterns {
+			if isQuery(pattern) {
+				if _, err := compileQuery(pattern); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, fields := range []map[string]string{options.UniqueBy, options.MergeBy, options.RenameKeys} {
+		for pattern := range fields {
+			if isQuery(pattern) {
+				if _, err := compileQuery(pattern); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for pattern := range options.MaxSequenceLen {
+		if isQuery(pattern) {
+			if _, err := compileQuery(pattern); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// patternLists returns the lists of patterns of options.
+func patternLists(options *Options) []*[]string {
+	return []*[]string{
+		&options.Overwrite, &options.Append, &options.Prepend, &options.DeleteIfNull,
+		&options.AllowedNewKeys, &options.ResolvePath, &options.Ignore,
+		&options.ReplaceSubtree, &options.CoerceScalarToSequence, &options.ListFields,
+		&options.LiteralStyle, &options.ForceQuote, &options.ForceUnquote,
+		&options.KeepEmpty, &options.SortSequences, &options.StringFields,
+		&options.ConcatInline,
+	}
+}
+
+// expandAliases returns a copy of options with each pattern starting with the
+// name of one of its PatternAliases, such as `@files.mode`, expanded to start
+// with the pattern the alias stands for.
+func expandAliases(options *Options) (*Options, error) {
+	for name := range options.PatternAliases {
+		if !strings.HasPrefix(name, "@") || strings.ContainsAny(name, ".[") {
+			return nil, fmt.Errorf("alias %q must start with @ and hold no . or [", name)
+		}
+	}
+	expand := func(pattern string) (string, error) {
+		return expandAlias(options.PatternAliases, pattern)
+	}
+	c := *options
+	for _, patterns := range patternLists(&c) {
+		if *patterns == nil {
+			continue
+		}
+		expanded := make([]string, len(*patterns))
+		for i, pattern := range *patterns {
+			var err error
+			if expanded[i], err = expand(pattern); err != nil {
+				return nil, err
+			}
+		}
+		*patterns = expanded
+	}
+	var err error
+	for _, fields := range []*map[string]string{&c.UniqueBy, &c.MergeBy, &c.RenameKeys} {
+		if *fields, err = expandKeys(*fields, expand); err != nil {
+			return nil, err
+		}
+	}
+	if c.MaxSequenceLen, err = expandKeys(c.MaxSequenceLen, expand); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// expandAlias returns pattern expanded to start with the pattern its alias
+// stands for, if it starts with the name of one of aliases.
+func expandAlias(aliases map[string]string, pattern string) (string, error) {
+	if !strings.HasPrefix(pattern, "@") {
+		return pattern, nil
+	}
+	name, rest := pattern, ""
+	if i := strings.IndexAny(pattern, ".["); i >= 0 {
+		name, rest = pattern[:i], pattern[i:]
+	}
+	alias, ok := aliases[name]
+	if !ok {
+		return "", fmt.Errorf("pattern %q uses the undefined alias %s", pattern, name)
+	}
+	return alias + rest, nil
+}
+
+// expandKeys returns a copy of patterns with each key expanded.
+func expandKeys[T any](patterns map[string]T, expand func(string) (string, error)) (map[string]T, error) {
+	if patterns == nil {
+		return nil, nil
+	}
+	expanded := make(map[string]T, len(patterns))
+	for pattern, v := range patterns {
+		key, err := expand(pattern)
+		if err != nil {
+			return nil, err
+		}
+		expanded[key] = v
+	}
+	return expanded, nil
+}
+
+// locationStep is a single step of the location of a value: either a key or a
+// sequence element.
+type locationStep struct {
+	key       string
+	isElement bool
+	element   scopeElement
+}
+
+// match reports whether the query selects the value at contextPath, which is
+// within the sequence elements of sc.
+func (q *query) match(contextPath string, sc *scope, equal func(a, b string) bool) bool {
+	plain, _ := stripSelectors(contextPath)
+	segments := splitPath(plain)
+	var elements []scopeElement
+	if sc != nil {
+		elements = sc.elements
+	}
+	location := make([]locationStep, 0, len(segments)+len(elements))
+	for i, segment := range segments {
+		if i > 0 {
+			location = append(location, locationStep{key: segment})
+		}
+		for len(elements) > 0 && elements[0].segments == i+1 {
+			location = append(location, locationStep{isElement: true, element: elements[0]})
+			elements = elements[1:]
+		}
+	}
+	return q.matchSteps(q.steps, location, equal)
+}
+
+func (q *query) matchSteps(steps []queryStep, location []locationStep, equal func(a, b string) bool) bool {
+	if len(steps) == 0 {
+		return len(location) == 0
+	}
+	step := steps[0]
+	if step.kind == stepDescend {
+		for i, l := range location {
+			if !l.isElement && equal(l.key, step.name) && q.matchSteps(steps[1:], location[i+1:], equal) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(location) == 0 {
+		return false
+	}
+	l := location[0]
+	switch step.kind {
+	case stepKey:
+		if l.isElement || !equal(l.key, step.name) {
+			return false
+		}
+	case stepIndex, stepSlice:
+		index := l.element.index
+		if !l.isElement || index < step.start || (step.end >= 0 && index >= step.end) {
+			return false
+		}
+	case stepFilter:
+		if !l.isElement || !step.filter.match(l.element.value) {
+			return false
+		}
+	}
+	return q.matchSteps(steps[1:], location[1:], equal)
+}
+
+// match reports whether the filter selects element.
+func (f *queryFilter) match(element any) bool {
+	v, ok := lookupField(element, f.field)
+	if !ok {
+		return false
+	}
+	switch f.op {
+	case "":
+		return true
+	case "==":
+		return equalValues(v, f.value)
+	case "!=":
+		return !equalValues(v, f.value)
+	}
+	c, ok := compareValues(v, f.value)
+	if !ok {
+		return false
+	}
+	switch f.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// lookupField returns the value of the nested key field within v, which is
+// either a config value or a YAML node.
+func lookupField(v any, field []string) (any, bool) {
+	for _, name := range field {
+		switch vv := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = vv[name]; !ok {
+				return nil, false
+			}
+		case *yaml.Node:
+			if vv.Kind != yaml.MappingNode {
+				return nil, false
+			}
+			found := false
+			for i := 0; i+1 < len(vv.Content); i += 2 {
+				if vv.Content[i].Value == name {
+					v, found = vv.Content[i+1], true
+					break
+				}
+			}
+			if !found {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	if n, ok := v.(*yaml.Node); ok {
+		var value any
+		if n.Kind != yaml.ScalarNode || n.Decode(&value) != nil {
+			return nil, true
+		}
+		return value, true
+	}
+	return v, true
+}
+
+// equalValues reports whether a equals b, comparing numbers by value.
+func equalValues(a, b any) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues compares two numbers or two strings.
+func compareValues(a, b any) (int, bool) {
+	if as, ok := a.(string); ok {
+		bs, ok := b.(string)
+		return strings.Compare(as, bs), ok
+	}
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	if !aok || !bok {
+		return 0, false
+	}
+	return cmp.Compare(af, bf), true
+}
+
+func toFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// scope holds the sequence elements enclosing the value being matched,
+// outermost first, so that a query can select elements by index or by the
+// value of a field. It is nil for a policy without queries.
+type scope struct {
+	elements []scopeElement
+}
+
+type scopeElement struct {
+	// segments is the number of segments of the context path of the
+	// sequence.
+	segments int
+	index    int
+	// value is the element, a config value or a YAML node.
+	value any
+}
+
+// push enters the element at index of the sequence at ctxpath.
+func (s *scope) push(ctxpath string, index int, value any) {
+	if s == nil {
+		return
+	}
+	s.elements = append(s.elements, scopeElement{segments: len(splitPath(ctxpath)), index: index, value: value})
+}
+
+// pop leaves the innermost element.
+func (s *scope) pop() {
+	if s == nil {
+		return
+	}
+	s.elements = s.elements[:len(s.elements)-1]
+}
@@ -0,0 +1,163 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"strings"
+	"testing"
+)
+
+func TestQueryMatch(t *testing.T) {
+	files := []any{
+		map[string]any{"path": "/etc/motd", "mode": 420},
+		map[string]any{"path": "/etc/hosts", "mode": 420, "contents": map[string]any{"source": "https://example.com/hosts"}},
+		map[string]any{"path": "/etc/issue", "mode": 384},
+	}
+	cases := []struct {
+		name  string
+		query string
+		// want holds the indices of the elements of files whose mode the
+		// query selects.
+		want []int
+	}{
+		{name: "wildcard", query: "jsonpath:$.storage.files[*].mode", want: []int{0, 1, 2}},
+		{name: "dot-wildcard", query: "jsonpath:$.storage.files.*.mode", want: []int{0, 1, 2}},
+		{name: "index", query: "jsonpath:$.storage.files[1].mode", want: []int{1}},
+		{name: "slice", query: "jsonpath:$.storage.files[1:].mode", want: []int{1, 2}},
+		{name: "slice-end", query: "jsonpath:$.storage.files[:2].mode", want: []int{0, 1}},
+		{name: "filter-equal", query: `jsonpath:$.storage.files[?(@.path=="/etc/hosts")].mode`, want: []int{1}},
+		{name: "filter-single-quote", query: `jsonpath:$.storage.files[?(@.path == '/etc/hosts')].mode`, want: []int{1}},
+		{name: "filter-not-equal", query: `jsonpath:$.storage.files[?(@.path!="/etc/hosts")].mode`, want: []int{0, 2}},
+		{name: "filter-number", query: "jsonpath:$.storage.files[?(@.mode<420)].mode", want: []int{2}},
+		{name: "filter-exists", query: "jsonpath:$.storage.files[?(@.contents)].mode", want: []int{1}},
+		{name: "filter-nested", query: `jsonpath:$.storage.files[?(@.contents.source=="https://example.com/hosts")].mode`, want: []int{1}},
+		{name: "bracket-key", query: "jsonpath:$['storage'].files[*]['mode']", want: []int{0, 1, 2}},
+		{name: "descend", query: `jsonpath:$..files[?(@.path=="/etc/issue")].mode`, want: []int{2}},
+		{name: "descend-key", query: "jsonpath:$..mode", want: []int{0, 1, 2}},
+		{name: "no-element", query: "jsonpath:$.storage.files.mode", want: nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := compileQuery(tc.query)
+			if err != nil {
+				t.Fatalf("compileQuery() got err: %s", err)
+			}
+			var got []int
+			sc := &scope{}
+			for i, file := range files {
+				sc.push("$.storage.files", i, file)
+				if q.match("$.storage.files.mode", sc, func(a, b string) bool { return a == b }) {
+					got = append(got, i)
+				}
+				sc.pop()
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("match() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestCompileQueryErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		query   string
+		wantErr string
+	}{
+		{name: "no-root", query: "jsonpath:storage.files", wantErr: "does not start with `$`"},
+		{name: "empty", query: "jsonpath:$", wantErr: "is empty"},
+		{name: "unclosed-filter", query: `jsonpath:$.files[?(@.path=="a"]`, wantErr: "is not closed"},
+		{name: "bad-filter", query: `jsonpath:$.files[?(path=="a")]`, wantErr: "does not start with `@.`"},
+		{name: "bad-operator", query: `jsonpath:$.files[?(@.path =~ "a")]`, wantErr: "unknown operator"},
+		{name: "bad-key", query: `jsonpath:$.files[?(@.path~"a")]`, wantErr: "invalid key"},
+		{name: "unquoted-string", query: `jsonpath:$.files[?(@.path==a)]`, wantErr: "strings must be quoted"},
+		{name: "negative-index", query: "jsonpath:$.files[-1]", wantErr: "invalid index"},
+		{name: "empty-key", query: "jsonpath:$.storage..", wantErr: "is not followed by a key"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := compileQuery(tc.query)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("compileQuery() got err %v wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueryPatterns(t *testing.T) {
+	input := `storage:
+  files:
+    - path: /etc/hosts
+      mode: 420
+      contents:
+        local: hosts
+    - path: /etc/motd
+      mode: 420
+      contents:
+        local: motd
+`
+	cases := []struct {
+		name    string
+		options *Options
+		files   []string
+		want    string
+	}{
+		{
+			name: "resolve-one-element",
+			options: &Options{
+				ResolvePath: []string{`jsonpath:$.storage.files[?(@.path=="/etc/hosts")].contents.local`},
+			},
+			files: []string{"fragments/input1.yaml"},
+			want:  "storage:\n    files:\n        - contents:\n            local: fragments/hosts\n          mode: 420\n          path: /etc/hosts\n        - contents:\n            local: motd\n          mode: 420\n          path: /etc/motd\n",
+		},
+		{
+			name: "quote-one-element",
+			options: &Options{
+				ForceQuote: []string{`jsonpath:$.storage.files[?(@.path=="/etc/motd")].mode`},
+			},
+			files: []string{"fragments/input1.yaml"},
+			want:  "storage:\n    files:\n        - contents:\n            local: hosts\n          mode: 420\n          path: /etc/hosts\n        - contents:\n            local: motd\n          mode: \"420\"\n          path: /etc/motd\n",
+		},
+		{
+			name: "ignore-by-index",
+			options: &Options{
+				Ignore: []string{"jsonpath:$.storage.files[1].contents"},
+			},
+			files: []string{"fragments/input1.yaml"},
+			want:  "storage:\n    files:\n        - contents:\n            local: hosts\n          mode: 420\n          path: /etc/hosts\n        - mode: 420\n          path: /etc/motd\n",
+		},
+		{
+			name: "overwrite-key",
+			options: &Options{
+				Overwrite: []string{"jsonpath:$['storage'].files"},
+			},
+			files: []string{"fragments/input1.yaml", "input2.yaml"},
+			want:  "storage:\n    files:\n        - contents:\n            local: hosts\n          mode: 420\n          path: /etc/hosts\n        - contents:\n            local: motd\n          mode: 420\n          path: /etc/motd\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = writeFiles(t, map[string]string{
+				"fragments/input1.yaml": input,
+				"input2.yaml":           input,
+			})
+			got, err := MergeFiles(tc.options, tc.files...)
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestQueryPatternsInvalid(t *testing.T) {
+	_, err := MergeFiles(&Options{Overwrite: []string{"jsonpath:$.storage[?(@.x"}})
+	if err == nil || !strings.Contains(err.Error(), "is not closed") {
+		t.Errorf("MergeFiles() got err %v wanted %q", err, "is not closed")
+	}
+	_, err = ParsePolicySpec("ignore=jsonpath:storage")
+	if err == nil || !strings.Contains(err.Error(), "does not start with `$`") {
+		t.Errorf("ParsePolicySpec() got err %v wanted %q", err, "does not start with `$`")
+	}
+}
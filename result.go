@@ -0,0 +1,287 @@
+package butanex
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// MergeResult is a merged config along with what was found while merging it.
+type MergeResult struct {
+	// Output is the merged config, as returned by MergeFiles.
+	Output []byte
+	// Warnings describe problems that did not fail the merge.
+	Warnings []Warning
+	// Findings are the findings of Options.LintRules, in the order found.
+	Findings []LintFinding
+	// Decisions are, with Options.ExplainPolicy, the policies that decided
+	// how each key merged, ordered by context path.
+	Decisions []PolicyDecision
+	// Files are the local paths of the files read, the input files and the
+	// templates they name, in the order first read, such as for watching
+	// them for changes.
+	Files []string
+}
+
+// PolicyDecision is the policy that applied to a context path of the files
+// merged. A key merged under different policies, say by a FileSpec with its
+// own Options, has a decision for each.
+type PolicyDecision struct {
+	ContextPath string
+	// Policy is "append", "prepend" or "overwrite" for the merge mode of the
+	// key, "error" for a sequence that conflicts by DefaultSequencePolicy,
+	// or "resolve" for a string made relative by a ResolvePath pattern.
+	Policy string
+	// MatchedPattern is the pattern that applied, if any.
+	MatchedPattern string
+	// Source is what decided the policy: "pattern" for MatchedPattern,
+	// "inline" for a strategy marker or merge tag in the file, or "default"
+	// for DefaultOverWrite or DefaultSequencePolicy.
+	Source string
+}
+
+// Warning describes a problem found while merging that did not fail it, such
+// as a policy pattern that never applied.
+type Warning struct {
+	// File is the file the warning is about, if any.
+	File string
+	// Path is the context path or pattern the warning is about.
+	Path    string
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.File != "" {
+		return fmt.Sprintf("file[%s]: key[%s] %s", w.File, w.Path, w.Message)
+	}
+	return fmt.Sprintf("key[%s] %s", w.Path, w.Message)
+}
+
+// MergeFilesResult is like MergeFiles but also returns the warnings found
+// while merging, and the findings of any lint rules.
+//
+// Every Overwrite, Append, Prepend and ResolvePath pattern that never applied
+// to a key is reported: an Overwrite pattern must decide the policy of some
+// key, an Append or Prepend pattern that of some sequence, and a ResolvePath
+// pattern must match some string. Such a pattern is usually a typo or stale.
+func MergeFilesResult(options *Options, path ...string) (*MergeResult, error) {
+	specs := make([]FileSpec, len(path))
+	for i, p := range path {
+		specs[i] = FileSpec{Path: p}
+	}
+	return MergeFileSpecsResult(context.Background(), options, specs...)
+}
+
+// MergeFileSpecsResult is like MergeFileSpecsContext but also returns the
+// warnings found while merging, as MergeFilesResult. The patterns of a
+// FileSpec's Options are reported with the file.
+func MergeFileSpecsResult(ctx context.Context, options *Options, specs ...FileSpec) (*MergeResult, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	m, err := newMerge(options, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.mergeSpecs(ctx, specs); err != nil {
+		return nil, err
+	}
+	out, err := m.output(options.OutputFormat)
+	if err != nil {
+		return nil, err
+	}
+	result := &MergeResult{Output: out, Warnings: m.warnings, Findings: m.findings, Files: m.read}
+	if m.decisions != nil {
+		result.Decisions = *m.decisions
+	}
+	return result, nil
+}
+
+// markModes records the mode entries that apply to the keys of config.
+func (m *mergePolicy) markModes(config map[string]any) {
+	if len(m.modes) == 0 {
+		return
+	}
+	w := &walker{visit: func(ctxpath string, v any) (any, bool, error) {
+		if kind, ok := kindOf(v); ok {
+			m.markMode(ctxpath, kind)
+		}
+		return nil, false, nil
+	}, scope: m.scope}
+	// visit never returns an error.
+	_ = w.mapping(config, "$")
+}
+
+// markMode records that the entry deciding the mode of the key at contextPath,
+// whose value is of the given kind, applied.
+func (m *mergePolicy) markMode(contextPath string, kind nodeKind) {
+	mode, entry, ok := m.resolve(contextPath)
+	if ok && (mode == modeOverwrite || kind == kindSequence) {
+		m.used[modeNames[mode]+entry.pattern] = true
+	}
+}
+
+// explain records the policy deciding how v, the value at ctxpath in the file
+// being merged, merges.
+func (m *merge) explain(ctxpath string, v any) {
+	d := PolicyDecision{ContextPath: ctxpath}
+	mode, entry, ok := m.mergePolicy.resolve(ctxpath)
+	switch inline, isInline := m.strategies[ctxpath]; {
+	case isInline:
+		d.Policy, d.Source = modeNames[inline], "inline"
+	case ok:
+		d.Policy, d.MatchedPattern, d.Source = modeNames[mode], entry.pattern, "pattern"
+	default:
+		d.Policy, d.Source = modeNames[mode], "default"
+		if _, isSeq := v.([]any); isSeq && m.mergePolicy.defaultSequence != "" {
+			d.Policy = string(m.mergePolicy.defaultSequence)
+		}
+	}
+	m.addDecision(d)
+}
+
+// explainResolve records that a ResolvePath pattern resolved the string at
+// ctxpath.
+func (m *merge) explainResolve(ctxpath string) {
+	for _, entry := range m.mergePolicy.resolvePaths {
+		if entry.match(ctxpath) {
+			m.addDecision(PolicyDecision{ContextPath: ctxpath, Policy: "resolve", MatchedPattern: entry.pattern, Source: "pattern"})
+			return
+		}
+	}
+}
+
+// addDecision records d unless it is already recorded, keeping the decisions
+// ordered.
+func (m *merge) addDecision(d PolicyDecision) {
+	compare := func(a, b PolicyDecision) int {
+		return cmp.Or(
+			cmp.Compare(a.ContextPath, b.ContextPath),
+			cmp.Compare(a.Policy, b.Policy),
+			cmp.Compare(a.MatchedPattern, b.MatchedPattern),
+			cmp.Compare(a.Source, b.Source))
+	}
+	i, found := slices.BinarySearchFunc(*m.decisions, d, compare)
+	if !found {
+		*m.decisions = slices.Insert(*m.decisions, i, d)
+	}
+}
+
+// markResolvePath records that the entries matching contextPath applied.
+func (m *mergePolicy) markResolvePath(contextPath string) {
+	for _, entry := range m.resolvePaths {
+		if entry.match(contextPath) {
+			m.used["resolve"+entry.pattern] = true
+		}
+	}
+}
+
+var modeNames = map[mergeMode]string{
+	modeAppend:    "append",
+	modeOverwrite: "overwrite",
+	modePrepend:   "prepend",
+}
+
+// unused returns a warning for each pattern that never applied.
+func (m *mergePolicy) unused(file string) []Warning {
+	var warnings []Warning
+	for _, entry := range m.modes {
+		name := modeNames[entry.policy]
+		if m.used[name+entry.pattern] {
+			continue
+		}
+		what := "sequence"
+		if entry.policy == modeOverwrite {
+			what = "key"
+		}
+		warnings = append(warnings, Warning{File: file, Path: entry.pattern, Message: fmt.Sprintf("%s pattern matched no %s", name, what)})
+	}
+	for _, entry := range m.resolvePaths {
+		if !m.used["resolve"+entry.pattern] {
+			warnings = append(warnings, Warning{File: file, Path: entry.pattern, Message: "resolve pattern matched no string"})
+		}
+	}
+	return warnings
+}
+
+// touch records that a file set the value at a context path.
+type touch struct {
+	file, ctxpath string
+}
+
+// touch records, when listing contributors, that the file being merged set v
+// at ctxpath, along with every value within v.
+func (m *merge) touch(ctxpath string, v any) {
+	if m.touched == nil {
+		return
+	}
+	*m.touched = append(*m.touched, touch{file: m.file, ctxpath: ctxpath})
+	switch v := v.(type) {
+	case []any:
+		for _, vi := range v {
+			m.touch(ctxpath, vi)
+		}
+	case map[string]any:
+		for k, vi := range v {
+			m.touch(joinPath(ctxpath, k), vi)
+		}
+	}
+}
+
+// Contributors merges the files like MergeFiles and returns, in the order they
+// were merged, the files that set, appended to, overwrote or deleted a value
+// matching pattern or within such a value. Like any pattern, pattern may be
+// relative, such as `.contents.local`, and the elements of a sequence share
+// its context path, so `$.passwd.users.name` matches the name of every user.
+// It may also start with the name of one of the PatternAliases of options. A
+// value a file repeats unchanged is not counted, and jsonpath queries are not
+// supported.
+func Contributors(options *Options, pattern string, path ...string) ([]string, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	pattern, err := expandAlias(options.PatternAliases, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if isQuery(pattern) {
+		return nil, fmt.Errorf("pattern %q: queries are not supported", pattern)
+	}
+	if err := validatePattern(pattern); err != nil {
+		return nil, err
+	}
+	m, err := newMerge(options, nil)
+	if err != nil {
+		return nil, err
+	}
+	var touched []touch
+	m.touched = &touched
+	specs := make([]FileSpec, len(path))
+	for i, p := range path {
+		specs[i] = FileSpec{Path: p}
+	}
+	if err := m.mergeSpecs(context.Background(), specs); err != nil {
+		return nil, err
+	}
+	entries := addPolicy(nil, pattern, true)
+	if options.CaseInsensitivePatterns {
+		foldCase(entries)
+	}
+	var files []string
+	for _, t := range touched {
+		if slices.Contains(files, t.file) {
+			continue
+		}
+		// A value within a value that matches is within the subtree.
+		segments := splitPath(t.ctxpath)
+		for n := len(segments); n > 1; n-- {
+			if entries[0].match(strings.Join(segments[:n], ".")) {
+				files = append(files, t.file)
+				break
+			}
+		}
+	}
+	return files, nil
+}
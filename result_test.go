@@ -0,0 +1,202 @@
+package butanex
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"slices"
+	"testing"
+)
+
+func TestMergeResultUnusedPatterns(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "storage:\n  files:\n    - path: /etc/motd\n      mode: 0644\n      contents:\n        local: motd.txt\n",
+		"overlay.yaml": "storage:\n  files:\n    - path: /etc/issue\n      mode: 0600\n",
+	})
+	options := &Options{
+		FilesDir:    dir,
+		Overwrite:   []string{".path", ".user.name"},
+		Append:      []string{"$.storage.files", ".mode"},
+		Prepend:     []string{".should_exist"},
+		ResolvePath: []string{".local", ".contents.source"},
+	}
+	got, err := MergeFilesResult(options, "base.yaml", "overlay.yaml")
+	if err != nil {
+		t.Fatalf("MergeFilesResult() got err: %s", err)
+	}
+	want := []string{
+		"key[.user.name] overwrite pattern matched no key",
+		"key[.mode] append pattern matched no sequence",
+		"key[.should_exist] prepend pattern matched no sequence",
+		"key[.contents.source] resolve pattern matched no string",
+	}
+	var warnings []string
+	for _, w := range got.Warnings {
+		warnings = append(warnings, w.String())
+	}
+	if diff := cmp.Diff(want, warnings); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+
+	output, err := MergeFiles(options, "base.yaml", "overlay.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	if diff := cmp.Diff(string(output), string(got.Output)); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestMergeResultFileSpecPatterns(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "kernel_arguments:\n  should_exist: [quiet]\n",
+		"overlay.yaml": "kernel_arguments:\n  should_exist: [debug]\n",
+	})
+	specs := []FileSpec{
+		{Path: "base.yaml", Options: &Options{}},
+		{Path: "overlay.yaml", Options: &Options{Prepend: []string{".should_exist", ".should_not_exist"}}},
+	}
+	got, err := MergeFileSpecsResult(context.Background(), &Options{FilesDir: dir, Overwrite: []string{".unused"}}, specs...)
+	if err != nil {
+		t.Fatalf("MergeFileSpecsResult() got err: %s", err)
+	}
+	want := []Warning{
+		{File: "overlay.yaml", Path: ".should_not_exist", Message: "prepend pattern matched no sequence"},
+	}
+	if diff := cmp.Diff(want, got.Warnings); diff != "" {
+		t.Errorf("MergeFileSpecsResult() got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestMergeResultFiles(t *testing.T) {
+	options := &Options{
+		FilesDir:     "./template",
+		TemplateData: map[string]string{"Hostname": "host-a"},
+	}
+	got, err := MergeFilesResult(options, "input1.yaml", "host/input2.yaml", "input1.yaml")
+	if err != nil {
+		t.Fatalf("MergeFilesResult() got err: %s", err)
+	}
+	want := []string{"template/input1.yaml", "template/host/input2.yaml", "template/host/motd.tmpl"}
+	if diff := cmp.Diff(want, got.Files); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+}
+
+func TestMergeResultOverwrites(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml": "a: 1\nb: x\nlist: [1, 2]\nnested:\n  c: true\n",
+		"b.yaml": "a: 2\nb: x\nlist: [3]\nnested:\n  c: false\n  d: new\n",
+		"c.yaml": "a: 3\nlist: [3]\nb: [x]\n",
+	})
+	options := &Options{FilesDir: dir, DefaultOverWrite: true, WarnOnOverwrite: true}
+	got, err := MergeFilesResult(options, "a.yaml", "b.yaml", "c.yaml")
+	if err != nil {
+		t.Fatalf("MergeFilesResult() got err: %s", err)
+	}
+	want := []string{
+		"file[b.yaml]: key[$.a] is overwritten: 1 from a.yaml is replaced by 2",
+		"file[b.yaml]: key[$.list] is overwritten: [1 2] from a.yaml is replaced by [3]",
+		"file[b.yaml]: key[$.nested.c] is overwritten: true from a.yaml is replaced by false",
+		"file[c.yaml]: key[$.a] is overwritten: 2 from b.yaml is replaced by 3",
+		"file[c.yaml]: key[$.b] is overwritten: x from a.yaml is replaced by [x]",
+	}
+	var warnings []string
+	for _, w := range got.Warnings {
+		warnings = append(warnings, w.String())
+	}
+	// The keys of a file are merged in no particular order.
+	slices.Sort(warnings)
+	if diff := cmp.Diff(want, warnings); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+
+	options.WarnOnOverwrite = false
+	got, err = MergeFilesResult(options, "a.yaml", "b.yaml", "c.yaml")
+	if err != nil {
+		t.Fatalf("MergeFilesResult() got err: %s", err)
+	}
+	if len(got.Warnings) != 0 {
+		t.Errorf("MergeFilesResult() got warnings %v wanted none", got.Warnings)
+	}
+}
+
+func TestContributors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":   "variant: fcos\nversion: 1.5.0\npasswd:\n  users:\n    - name: core\n",
+		"users.yaml":  "passwd:\n  users:\n    - name: admin\n      groups: [wheel]\n",
+		"keys.yaml":   "passwd:\n  users:\n    - ssh_authorized_keys: [key1]\n",
+		"motd.yaml":   "storage:\n  files:\n    - path: /etc/motd\n",
+		"repeat.yaml": "variant: fcos\n",
+		"bump.yaml":   "version: 1.6.0\n",
+	})
+	files := []string{"base.yaml", "users.yaml", "keys.yaml", "motd.yaml", "repeat.yaml", "bump.yaml"}
+	cases := []struct {
+		name    string
+		pattern string
+		want    []string
+	}{
+		{name: "element-field", pattern: "$.passwd.users.name", want: []string{"base.yaml", "users.yaml"}},
+		{name: "subtree", pattern: "$.passwd", want: []string{"base.yaml", "users.yaml", "keys.yaml"}},
+		{name: "relative", pattern: ".groups", want: []string{"users.yaml"}},
+		{name: "overwritten", pattern: "$.version", want: []string{"base.yaml", "bump.yaml"}},
+		{name: "repeated", pattern: "$.variant", want: []string{"base.yaml"}},
+		{name: "none", pattern: "$.systemd", want: nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := &Options{FilesDir: dir, Overwrite: []string{"$.version"}}
+			got, err := Contributors(options, tc.pattern, files...)
+			if err != nil {
+				t.Fatalf("Contributors() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Contributors() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+	if _, err := Contributors(&Options{FilesDir: dir}, "jsonpath:$.passwd", files...); err == nil {
+		t.Errorf("Contributors() got nil error for a query")
+	}
+}
+
+func TestExplainPolicy(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":    "variant: fcos\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 420\n      contents:\n        local: motd.txt\n",
+		"overlay.yaml": "variant: fcos\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 384\n  links: !prepend\n    - path: /etc/a\npasswd:\n  users: []\n",
+	})
+	options := &Options{
+		FilesDir:              dir,
+		ExplainPolicy:         true,
+		Overwrite:             []string{".mode"},
+		Append:                []string{"$.storage.files"},
+		ResolvePath:           []string{".local"},
+		MergeBy:               map[string]string{"$.storage.files": "path"},
+		DefaultSequencePolicy: SequenceError,
+	}
+	got, err := MergeFilesResult(options, "base.yaml", "overlay.yaml")
+	if err != nil {
+		t.Fatalf("MergeFilesResult() got err: %s", err)
+	}
+	want := []PolicyDecision{
+		{ContextPath: "$.passwd", Policy: "append", Source: "default"},
+		{ContextPath: "$.passwd.users", Policy: "error", Source: "default"},
+		{ContextPath: "$.storage", Policy: "append", Source: "default"},
+		{ContextPath: "$.storage.files", Policy: "append", MatchedPattern: "$.storage.files", Source: "pattern"},
+		{ContextPath: "$.storage.files.contents.local", Policy: "resolve", MatchedPattern: ".local", Source: "pattern"},
+		{ContextPath: "$.storage.files[path=/etc/motd].mode", Policy: "overwrite", MatchedPattern: ".mode", Source: "pattern"},
+		{ContextPath: "$.storage.files[path=/etc/motd].path", Policy: "append", Source: "default"},
+		{ContextPath: "$.storage.links", Policy: "prepend", Source: "inline"},
+		{ContextPath: "$.variant", Policy: "append", Source: "default"},
+	}
+	if diff := cmp.Diff(want, got.Decisions); diff != "" {
+		t.Errorf("MergeFilesResult() got diff: -want/+got: %s", diff)
+	}
+
+	got, err = MergeFilesResult(&Options{FilesDir: dir}, "base.yaml")
+	if err != nil {
+		t.Fatalf("MergeFilesResult() got err: %s", err)
+	}
+	if got.Decisions != nil {
+		t.Errorf("MergeFilesResult() got decisions %v without ExplainPolicy", got.Decisions)
+	}
+}
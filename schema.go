@@ -0,0 +1,410 @@
+package butanex
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// nodeKind is the kind of a YAML value as far as merging is concerned.
+type nodeKind int
+
+const (
+	kindScalar nodeKind = iota
+	kindMapping
+	kindSequence
+)
+
+func (k nodeKind) String() string {
+	switch k {
+	case kindMapping:
+		return "mapping"
+	case kindSequence:
+		return "sequence"
+	}
+	return "scalar"
+}
+
+// kindOf returns the kind of v. A null value has no kind.
+func kindOf(v any) (nodeKind, bool) {
+	switch v.(type) {
+	case nil:
+		return 0, false
+	case map[string]any:
+		return kindMapping, true
+	case []any:
+		return kindSequence, true
+	}
+	return kindScalar, true
+}
+
+// schema maps the absolute context path of every known field to the kind of
+// its value. The fields of a sequence's elements share the context path of the
+// sequence, as everywhere else.
+type schema map[string]nodeKind
+
+// lookupSchema returns the schema of a Butane spec version, or nil when variant
+// and version are both unset.
+func lookupSchema(variant, version string) (schema, error) {
+	if variant == "" && version == "" {
+		return nil, nil
+	}
+	versions, ok := schemas[variant]
+	if !ok {
+		return nil, fmt.Errorf("unsupported variant: %q", variant)
+	}
+	s, ok := versions[version]
+	if !ok {
+		return nil, fmt.Errorf("unsupported version for variant %s: %q", variant, version)
+	}
+	return s, nil
+}
+
+// schemas holds the embedded schema of each supported variant and version.
+var schemas = map[string]map[string]schema{
+	"fcos": {
+		"1.4.0": fcosSchema.without(fcos15Fields...),
+		"1.5.0": fcosSchema,
+	},
+}
+
+// fcos15Fields lists the fields added to the Fedora CoreOS variant in 1.5.0.
+var fcos15Fields = []string{
+	"$.grub",
+	"$.boot_device.luks.discard",
+	"$.storage.luks.discard",
+	"$.storage.luks.open_options",
+	"$.passwd.users.should_exist",
+	"$.passwd.groups.should_exist",
+}
+
+// check returns an error if v is not of the kind the schema expects at ctxpath.
+func (s schema) check(ctxpath string, v any, file string) error {
+	plain, _ := stripSelectors(ctxpath)
+	want, known := s[plain]
+	got, ok := kindOf(v)
+	if !known || !ok || got == want {
+		return nil
+	}
+	return fmt.Errorf("key[%s] expects a %s, got a %s in %s", ctxpath, want, got, file)
+}
+
+// singularFields lists the mappings of a Butane spec that are replaced whole
+// rather than merged key by key, as a merge of two of them would name neither.
+// A second, different value conflicts unless the key is overwritten.
+var singularFields = map[string]bool{
+	"$.ignition.config.replace": true,
+}
+
+// keyedSequences maps the sequences of a Butane spec whose elements are merged
+// by key when no MergeBy pattern applies to the field identifying an element.
+var keyedSequences = map[string]string{
+	"$.ignition.config.merge": "source",
+	"$.systemd.units":         "name",
+	"$.systemd.units.dropins": "name",
+}
+
+// isSingular returns whether the mapping at ctxpath is replaced whole.
+func (s schema) isSingular(ctxpath string) bool {
+	return s != nil && singularFields[ctxpath]
+}
+
+// mergeByField returns the field that elements of the sequence at ctxpath are
+// merged by, if the spec has one. The selectors of the elements merged by key
+// on the way to ctxpath are ignored, so a sequence within a keyed element,
+// such as the dropins of a unit, is keyed too.
+func (s schema) mergeByField(ctxpath string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	plain, _ := stripSelectors(ctxpath)
+	field, ok := keyedSequences[plain]
+	return field, ok
+}
+
+// checkKeys returns an error naming each key within config that is not a
+// field of the schema, along with the closest field it may have meant. Keys
+// within an unknown key are not reported.
+func (s schema) checkKeys(config map[string]any, file string) error {
+	var unknown []string
+	w := &walker{visit: func(ctxpath string, v any) (any, bool, error) {
+		plain, _ := stripSelectors(ctxpath)
+		if _, ok := s[plain]; ok {
+			return nil, false, nil
+		}
+		segments := splitPath(plain)
+		parent := strings.Join(segments[:len(segments)-1], ".")
+		if _, ok := s[parent]; !ok && parent != "$" {
+			return nil, false, nil
+		}
+		msg := fmt.Sprintf("key[%s] is not a known field in %s", ctxpath, file)
+		if field, ok := s.closestField(parent, segments[len(segments)-1]); ok {
+			msg += fmt.Sprintf(", did you mean %q?", field)
+		}
+		unknown = append(unknown, msg)
+		return nil, false, nil
+	}}
+	if err := w.mapping(config, "$"); err != nil {
+		return err
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	slices.Sort(unknown)
+	return errors.New(strings.Join(unknown, "\n"))
+}
+
+// closestField returns the field of the mapping at parent with the smallest
+// edit distance to key, if any is close enough to be a likely typo.
+func (s schema) closestField(parent, key string) (string, bool) {
+	best, bestDistance := "", -1
+	for path := range s {
+		field, ok := strings.CutPrefix(path, parent+".")
+		if !ok || strings.Contains(field, ".") {
+			continue
+		}
+		d := editDistance(key, field)
+		if bestDistance < 0 || d < bestDistance || (d == bestDistance && field < best) {
+			best, bestDistance = field, d
+		}
+	}
+	if bestDistance < 0 || bestDistance > max(1, len(key)/2) {
+		return "", false
+	}
+	return best, true
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// resourceSchema lists the fields of a Butane resource relative to the
+// resource.
+var resourceSchema = schema{
+	".source":             kindScalar,
+	".inline":             kindScalar,
+	".local":              kindScalar,
+	".compression":        kindScalar,
+	".http_headers":       kindSequence,
+	".http_headers.name":  kindScalar,
+	".http_headers.value": kindScalar,
+	".verification":       kindMapping,
+	".verification.hash":  kindScalar,
+}
+
+// fcosSchema is the schema of the Fedora CoreOS variant.
+var fcosSchema = buildSchema(
+	schema{
+		"$.variant":          kindScalar,
+		"$.version":          kindScalar,
+		"$.ignition":         kindMapping,
+		"$.storage":          kindMapping,
+		"$.systemd":          kindMapping,
+		"$.passwd":           kindMapping,
+		"$.kernel_arguments": kindMapping,
+		"$.boot_device":      kindMapping,
+		"$.grub":             kindMapping,
+
+		"$.ignition.config":                               kindMapping,
+		"$.ignition.config.merge":                         kindSequence,
+		"$.ignition.config.replace":                       kindMapping,
+		"$.ignition.timeouts":                             kindMapping,
+		"$.ignition.timeouts.http_response_headers":       kindScalar,
+		"$.ignition.timeouts.http_total":                  kindScalar,
+		"$.ignition.security":                             kindMapping,
+		"$.ignition.security.tls":                         kindMapping,
+		"$.ignition.security.tls.certificate_authorities": kindSequence,
+		"$.ignition.proxy":                                kindMapping,
+		"$.ignition.proxy.http_proxy":                     kindScalar,
+		"$.ignition.proxy.https_proxy":                    kindScalar,
+		"$.ignition.proxy.no_proxy":                       kindSequence,
+
+		"$.storage.disks":                                 kindSequence,
+		"$.storage.disks.device":                          kindScalar,
+		"$.storage.disks.wipe_table":                      kindScalar,
+		"$.storage.disks.partitions":                      kindSequence,
+		"$.storage.disks.partitions.label":                kindScalar,
+		"$.storage.disks.partitions.number":               kindScalar,
+		"$.storage.disks.partitions.size_mib":             kindScalar,
+		"$.storage.disks.partitions.start_mib":            kindScalar,
+		"$.storage.disks.partitions.type_guid":            kindScalar,
+		"$.storage.disks.partitions.guid":                 kindScalar,
+		"$.storage.disks.partitions.wipe_partition_entry": kindScalar,
+		"$.storage.disks.partitions.should_exist":         kindScalar,
+		"$.storage.disks.partitions.resize":               kindScalar,
+		"$.storage.raid":                                  kindSequence,
+		"$.storage.raid.name":                             kindScalar,
+		"$.storage.raid.level":                            kindScalar,
+		"$.storage.raid.devices":                          kindSequence,
+		"$.storage.raid.spares":                           kindScalar,
+		"$.storage.raid.options":                          kindSequence,
+		"$.storage.filesystems":                           kindSequence,
+		"$.storage.filesystems.device":                    kindScalar,
+		"$.storage.filesystems.format":                    kindScalar,
+		"$.storage.filesystems.path":                      kindScalar,
+		"$.storage.filesystems.wipe_filesystem":           kindScalar,
+		"$.storage.filesystems.label":                     kindScalar,
+		"$.storage.filesystems.uuid":                      kindScalar,
+		"$.storage.filesystems.options":                   kindSequence,
+		"$.storage.filesystems.mount_options":             kindSequence,
+		"$.storage.filesystems.with_mount_unit":           kindScalar,
+		"$.storage.files":                                 kindSequence,
+		"$.storage.files.path":                            kindScalar,
+		"$.storage.files.overwrite":                       kindScalar,
+		"$.storage.files.contents":                        kindMapping,
+		"$.storage.files.append":                          kindSequence,
+		"$.storage.files.mode":                            kindScalar,
+		"$.storage.files.user":                            kindMapping,
+		"$.storage.files.user.id":                         kindScalar,
+		"$.storage.files.user.name":                       kindScalar,
+		"$.storage.files.group":                           kindMapping,
+		"$.storage.files.group.id":                        kindScalar,
+		"$.storage.files.group.name":                      kindScalar,
+		"$.storage.directories":                           kindSequence,
+		"$.storage.directories.path":                      kindScalar,
+		"$.storage.directories.overwrite":                 kindScalar,
+		"$.storage.directories.mode":                      kindScalar,
+		"$.storage.directories.user":                      kindMapping,
+		"$.storage.directories.user.id":                   kindScalar,
+		"$.storage.directories.user.name":                 kindScalar,
+		"$.storage.directories.group":                     kindMapping,
+		"$.storage.directories.group.id":                  kindScalar,
+		"$.storage.directories.group.name":                kindScalar,
+		"$.storage.links":                                 kindSequence,
+		"$.storage.links.path":                            kindScalar,
+		"$.storage.links.overwrite":                       kindScalar,
+		"$.storage.links.user":                            kindMapping,
+		"$.storage.links.user.id":                         kindScalar,
+		"$.storage.links.user.name":                       kindScalar,
+		"$.storage.links.group":                           kindMapping,
+		"$.storage.links.group.id":                        kindScalar,
+		"$.storage.links.group.name":                      kindScalar,
+		"$.storage.links.target":                          kindScalar,
+		"$.storage.links.hard":                            kindScalar,
+		"$.storage.luks":                                  kindSequence,
+		"$.storage.luks.name":                             kindScalar,
+		"$.storage.luks.label":                            kindScalar,
+		"$.storage.luks.uuid":                             kindScalar,
+		"$.storage.luks.device":                           kindScalar,
+		"$.storage.luks.key_file":                         kindMapping,
+		"$.storage.luks.options":                          kindSequence,
+		"$.storage.luks.wipe_volume":                      kindScalar,
+		"$.storage.luks.discard":                          kindScalar,
+		"$.storage.luks.open_options":                     kindSequence,
+		"$.storage.luks.clevis":                           kindMapping,
+		"$.storage.luks.clevis.tang":                      kindSequence,
+		"$.storage.luks.clevis.tang.url":                  kindScalar,
+		"$.storage.luks.clevis.tang.thumbprint":           kindScalar,
+		"$.storage.luks.clevis.tang.advertisement":        kindScalar,
+		"$.storage.luks.clevis.tpm2":                      kindScalar,
+		"$.storage.luks.clevis.threshold":                 kindScalar,
+		"$.storage.luks.clevis.custom":                    kindMapping,
+		"$.storage.luks.clevis.custom.pin":                kindScalar,
+		"$.storage.luks.clevis.custom.config":             kindScalar,
+		"$.storage.luks.clevis.custom.needs_network":      kindScalar,
+		"$.storage.trees":                                 kindSequence,
+		"$.storage.trees.local":                           kindScalar,
+		"$.storage.trees.path":                            kindScalar,
+
+		"$.systemd.units":                        kindSequence,
+		"$.systemd.units.name":                   kindScalar,
+		"$.systemd.units.enabled":                kindScalar,
+		"$.systemd.units.mask":                   kindScalar,
+		"$.systemd.units.contents":               kindScalar,
+		"$.systemd.units.contents_local":         kindScalar,
+		"$.systemd.units.dropins":                kindSequence,
+		"$.systemd.units.dropins.name":           kindScalar,
+		"$.systemd.units.dropins.contents":       kindScalar,
+		"$.systemd.units.dropins.contents_local": kindScalar,
+
+		"$.passwd.users":                           kindSequence,
+		"$.passwd.users.name":                      kindScalar,
+		"$.passwd.users.password_hash":             kindScalar,
+		"$.passwd.users.ssh_authorized_keys":       kindSequence,
+		"$.passwd.users.ssh_authorized_keys_local": kindSequence,
+		"$.passwd.users.uid":                       kindScalar,
+		"$.passwd.users.gecos":                     kindScalar,
+		"$.passwd.users.home_dir":                  kindScalar,
+		"$.passwd.users.no_create_home":            kindScalar,
+		"$.passwd.users.primary_group":             kindScalar,
+		"$.passwd.users.groups":                    kindSequence,
+		"$.passwd.users.no_user_group":             kindScalar,
+		"$.passwd.users.no_log_init":               kindScalar,
+		"$.passwd.users.shell":                     kindScalar,
+		"$.passwd.users.should_exist":              kindScalar,
+		"$.passwd.users.system":                    kindScalar,
+		"$.passwd.groups":                          kindSequence,
+		"$.passwd.groups.name":                     kindScalar,
+		"$.passwd.groups.gid":                      kindScalar,
+		"$.passwd.groups.password_hash":            kindScalar,
+		"$.passwd.groups.should_exist":             kindScalar,
+		"$.passwd.groups.system":                   kindScalar,
+
+		"$.kernel_arguments.should_exist":     kindSequence,
+		"$.kernel_arguments.should_not_exist": kindSequence,
+
+		"$.boot_device.layout":                  kindScalar,
+		"$.boot_device.luks":                    kindMapping,
+		"$.boot_device.luks.tang":               kindSequence,
+		"$.boot_device.luks.tang.url":           kindScalar,
+		"$.boot_device.luks.tang.thumbprint":    kindScalar,
+		"$.boot_device.luks.tang.advertisement": kindScalar,
+		"$.boot_device.luks.tpm2":               kindScalar,
+		"$.boot_device.luks.threshold":          kindScalar,
+		"$.boot_device.luks.discard":            kindScalar,
+		"$.boot_device.mirror":                  kindMapping,
+		"$.boot_device.mirror.devices":          kindSequence,
+
+		"$.grub.users":               kindSequence,
+		"$.grub.users.name":          kindScalar,
+		"$.grub.users.password_hash": kindScalar,
+	},
+	"$.ignition.config.merge",
+	"$.ignition.config.replace",
+	"$.ignition.security.tls.certificate_authorities",
+	"$.storage.files.contents",
+	"$.storage.files.append",
+	"$.storage.luks.key_file",
+)
+
+// buildSchema adds the fields of a resource under each of the resource paths.
+func buildSchema(s schema, resources ...string) schema {
+	for _, path := range resources {
+		for field, kind := range resourceSchema {
+			s[path+field] = kind
+		}
+	}
+	return s
+}
+
+// without returns a copy of the schema without the fields at ctxpaths and
+// their children.
+func (s schema) without(ctxpaths ...string) schema {
+	c := make(schema, len(s))
+	for path, kind := range s {
+		if !slices.ContainsFunc(ctxpaths, func(ctxpath string) bool {
+			return path == ctxpath || strings.HasPrefix(path, ctxpath+".")
+		}) {
+			c[path] = kind
+		}
+	}
+	return c
+}
@@ -0,0 +1,325 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"strings"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml": `
+variant: fcos
+version: 1.5.0
+storage:
+  files:
+    - path: /opt/file
+`,
+		"host.yaml": `
+storage:
+  files:
+    path: /opt/other
+`,
+		"users.yaml": `
+passwd:
+  - name: user1
+`,
+		"grub.yaml": `
+grub:
+  users:
+    - name: root
+`,
+	})
+	cases := []struct {
+		name    string
+		options *Options
+		files   []string
+		wantErr string
+	}{
+		{
+			name:    "no-schema",
+			options: &Options{},
+			files:   []string{"base.yaml", "host.yaml"},
+			wantErr: "key[$.storage.files] mismatch",
+		},
+		{
+			name:    "overlay-mismatch",
+			options: &Options{Variant: "fcos", Version: "1.5.0"},
+			files:   []string{"base.yaml", "host.yaml"},
+			wantErr: "key[$.storage.files] expects a sequence, got a mapping in host.yaml",
+		},
+		{
+			name:    "first-file-mismatch",
+			options: &Options{Variant: "fcos", Version: "1.5.0"},
+			files:   []string{"users.yaml"},
+			wantErr: "key[$.passwd] expects a mapping, got a sequence in users.yaml",
+		},
+		{
+			name:    "valid",
+			options: &Options{Variant: "fcos", Version: "1.5.0"},
+			files:   []string{"base.yaml", "grub.yaml"},
+		},
+		{
+			name:    "unsupported-version",
+			options: &Options{Variant: "fcos", Version: "0.1.0"},
+			files:   []string{"base.yaml"},
+			wantErr: `unsupported version for variant fcos: "0.1.0"`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			_, err := MergeFiles(tc.options, tc.files...)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("MergeFiles() got err: %s", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchemaVersions(t *testing.T) {
+	s, err := lookupSchema("fcos", "1.4.0")
+	if err != nil {
+		t.Fatalf("lookupSchema() got err: %s", err)
+	}
+	for _, field := range []string{"$.grub", "$.grub.users", "$.storage.luks.discard", "$.passwd.users.should_exist"} {
+		if _, ok := s[field]; ok {
+			t.Errorf("lookupSchema(fcos, 1.4.0) got %s, which was added in 1.5.0", field)
+		}
+	}
+	if _, ok := s["$.storage.files.contents.inline"]; !ok {
+		t.Errorf("lookupSchema(fcos, 1.4.0) missing $.storage.files.contents.inline")
+	}
+}
+
+func TestStrictKeys(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml":     "variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n    - path: /opt/file\n      contents:\n        inline: hello\n",
+		"typo.yaml":     "storag:\n  files:\n    - path: /opt/other\n",
+		"nested.yaml":   "storage:\n  files:\n    - path: /opt/other\n      contnts:\n        inline: hello\n",
+		"unknown.yaml":  "storage:\n  zzzzzzzz: true\n",
+		"grub.yaml":     "grub:\n  users:\n    - name: root\n",
+		"luks.yaml":     "storage:\n  luks:\n    - name: root\n      device: /dev/sda4\n      discard: true\n",
+		"multiple.yaml": "systemd:\n  unit: []\npasswd:\n  user: []\n",
+	})
+	strict := &Options{Variant: "fcos", Version: "1.5.0", StrictKeys: true}
+	cases := []struct {
+		name    string
+		options *Options
+		files   []string
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			options: strict,
+			files:   []string{"base.yaml"},
+		},
+		{
+			name:    "not-strict",
+			options: &Options{Variant: "fcos", Version: "1.5.0"},
+			files:   []string{"base.yaml", "typo.yaml"},
+		},
+		{
+			name:    "top-level-typo",
+			options: strict,
+			files:   []string{"base.yaml", "typo.yaml"},
+			wantErr: `key[$.storag] is not a known field in typo.yaml, did you mean "storage"?`,
+		},
+		{
+			name:    "typo-in-sequence",
+			options: strict,
+			files:   []string{"base.yaml", "nested.yaml"},
+			wantErr: `key[$.storage.files.contnts] is not a known field in nested.yaml, did you mean "contents"?`,
+		},
+		{
+			name:    "no-suggestion",
+			options: strict,
+			files:   []string{"unknown.yaml"},
+			wantErr: "key[$.storage.zzzzzzzz] is not a known field in unknown.yaml\n",
+		},
+		{
+			name:    "multiple",
+			options: strict,
+			files:   []string{"multiple.yaml"},
+			wantErr: "key[$.passwd.user] is not a known field in multiple.yaml, did you mean \"users\"?\nkey[$.systemd.unit] is not a known field in multiple.yaml, did you mean \"units\"?",
+		},
+		{
+			name:    "version-without-field",
+			options: &Options{Variant: "fcos", Version: "1.4.0", StrictKeys: true},
+			files:   []string{"grub.yaml"},
+			wantErr: "key[$.grub] is not a known field in grub.yaml",
+		},
+		{
+			name:    "version-without-nested-field",
+			options: &Options{Variant: "fcos", Version: "1.4.0", StrictKeys: true},
+			files:   []string{"luks.yaml"},
+			wantErr: "key[$.storage.luks.discard] is not a known field in luks.yaml",
+		},
+		{
+			name:    "version-with-nested-field",
+			options: strict,
+			files:   []string{"luks.yaml"},
+		},
+		{
+			name:    "no-schema",
+			options: &Options{StrictKeys: true},
+			files:   []string{"base.yaml"},
+			wantErr: "StrictKeys requires a Variant and Version",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := *tc.options
+			options.FilesDir = dir
+			_, err := MergeFiles(&options, tc.files...)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("MergeFiles() got err: %s", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error()+"\n", tc.wantErr)):
+				t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestIgnitionConfig(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"merge1.yaml":   "ignition:\n  config:\n    merge:\n      - source: https://example.com/a.ign\n      - source: https://example.com/b.ign\n",
+		"merge2.yaml":   "ignition:\n  config:\n    merge:\n      - source: https://example.com/b.ign\n        verification:\n          hash: sha512-b\n      - source: https://example.com/c.ign\n",
+		"merge3.yaml":   "ignition:\n  config:\n    merge:\n      - source: https://example.com/b.ign\n        verification:\n          hash: sha512-other\n",
+		"replace1.yaml": "ignition:\n  config:\n    replace:\n      source: https://example.com/a.ign\n      verification:\n        hash: sha512-a\n",
+		"replace2.yaml": "ignition:\n  config:\n    replace:\n      source: https://example.com/b.ign\n",
+	})
+	fcos := Options{Variant: "fcos", Version: "1.5.0"}
+	cases := []struct {
+		name    string
+		options Options
+		files   []string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "merge-by-source",
+			options: fcos,
+			files:   []string{"merge1.yaml", "merge2.yaml"},
+			want:    "ignition:\n  config:\n    merge:\n      - source: https://example.com/a.ign\n      - source: https://example.com/b.ign\n        verification:\n          hash: sha512-b\n      - source: https://example.com/c.ign\n",
+		},
+		{
+			name:    "merge-conflicting-hash",
+			options: fcos,
+			files:   []string{"merge2.yaml", "merge3.yaml"},
+			wantErr: `duplicate Keys(overrwrite=false): $.ignition.config.merge[source=https://example\.com/b\.ign].verification.hash`,
+		},
+		{
+			name:    "merge-without-schema",
+			options: Options{},
+			files:   []string{"merge1.yaml", "merge2.yaml"},
+			want:    "ignition:\n  config:\n    merge:\n      - source: https://example.com/a.ign\n      - source: https://example.com/b.ign\n      - source: https://example.com/b.ign\n        verification:\n          hash: sha512-b\n      - source: https://example.com/c.ign\n",
+		},
+		{
+			name:    "replace-same",
+			options: fcos,
+			files:   []string{"replace1.yaml", "replace1.yaml"},
+			want:    "ignition:\n  config:\n    replace:\n      source: https://example.com/a.ign\n      verification:\n        hash: sha512-a\n",
+		},
+		{
+			name:    "replace-different",
+			options: fcos,
+			files:   []string{"replace1.yaml", "replace2.yaml"},
+			wantErr: "duplicate Keys(overrwrite=false): $.ignition.config.replace",
+		},
+		{
+			name:    "replace-overwrite",
+			options: Options{Variant: "fcos", Version: "1.5.0", Overwrite: []string{"$.ignition.config.replace"}},
+			files:   []string{"replace1.yaml", "replace2.yaml"},
+			want:    "ignition:\n  config:\n    replace:\n      source: https://example.com/b.ign\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			got, err := MergeFiles(&tc.options, tc.files...)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSystemdDropins(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"docker1.yaml":  "systemd:\n  units:\n    - name: docker.service\n      enabled: true\n      dropins:\n        - name: 10-proxy.conf\n          contents: |\n            [Service]\n            Environment=HTTP_PROXY=http://proxy\n",
+		"docker2.yaml":  "systemd:\n  units:\n    - name: docker.service\n      dropins:\n        - name: 20-limits.conf\n          contents: |\n            [Service]\n            LimitNOFILE=1048576\n    - name: containerd.service\n      enabled: true\n",
+		"same.yaml":     "systemd:\n  units:\n    - name: docker.service\n      dropins:\n        - name: 10-proxy.conf\n          contents: |\n            [Service]\n            Environment=HTTP_PROXY=http://proxy\n",
+		"conflict.yaml": "systemd:\n  units:\n    - name: docker.service\n      dropins:\n        - name: 10-proxy.conf\n          contents: |\n            [Service]\n            Environment=HTTP_PROXY=http://other\n",
+	})
+	both := "systemd:\n  units:\n    - name: docker.service\n      enabled: true\n      dropins:\n        - name: 10-proxy.conf\n          contents: |\n            [Service]\n            Environment=HTTP_PROXY=http://proxy\n        - name: 20-limits.conf\n          contents: |\n            [Service]\n            LimitNOFILE=1048576\n    - name: containerd.service\n      enabled: true\n"
+	cases := []struct {
+		name    string
+		options Options
+		files   []string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "schema",
+			options: Options{Variant: "fcos", Version: "1.5.0"},
+			files:   []string{"docker1.yaml", "docker2.yaml"},
+			want:    both,
+		},
+		{
+			name:    "merge-by",
+			options: Options{MergeBy: map[string]string{"$.systemd.units": "name", "$.systemd.units.dropins": "name"}},
+			files:   []string{"docker1.yaml", "docker2.yaml"},
+			want:    both,
+		},
+		{
+			name:    "same-contents",
+			options: Options{Variant: "fcos", Version: "1.5.0"},
+			files:   []string{"docker1.yaml", "same.yaml"},
+			want:    "systemd:\n  units:\n    - name: docker.service\n      enabled: true\n      dropins:\n        - name: 10-proxy.conf\n          contents: |\n            [Service]\n            Environment=HTTP_PROXY=http://proxy\n",
+		},
+		{
+			name:    "conflicting-contents",
+			options: Options{Variant: "fcos", Version: "1.5.0"},
+			files:   []string{"docker1.yaml", "conflict.yaml"},
+			wantErr: `duplicate Keys(overrwrite=false): $.systemd.units[name=docker\.service].dropins[name=10-proxy\.conf].contents`,
+		},
+		{
+			name:    "overwrite-contents",
+			options: Options{Variant: "fcos", Version: "1.5.0", Overwrite: []string{"$.systemd.units.dropins.contents"}},
+			files:   []string{"docker1.yaml", "conflict.yaml"},
+			want:    "systemd:\n  units:\n    - name: docker.service\n      enabled: true\n      dropins:\n        - name: 10-proxy.conf\n          contents: |\n            [Service]\n            Environment=HTTP_PROXY=http://other\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.FilesDir = dir
+			got, err := MergeFiles(&tc.options, tc.files...)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("MergeFiles() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeFiles() got err: %s", err)
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, []byte(tc.want)), mustUnmarshal(t, got)); diff != "" {
+				t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package butanex
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SourceResolver turns the name of an input file into a local path to read it
+// from. A relative path is relative to Options.FilesDir.
+type SourceResolver interface {
+	Resolve(ctx context.Context, source string) (string, error)
+}
+
+// FileResolver is the default SourceResolver, for which every source is
+// already a local path.
+type FileResolver struct{}
+
+func (FileResolver) Resolve(ctx context.Context, source string) (string, error) {
+	return source, nil
+}
+
+// RemoteResolver fetches remote sources into a local cache directory, and
+// leaves any other source to Local. Two kinds of remote source are supported,
+// in the style of go-getter:
+//
+//	git::https://example.com/repo//path/base.yaml?ref=v1
+//	https://example.com/fragments/base.yaml
+//
+// A git source is cloned at ref, or the default branch if none is given, and
+// resolves to the file at the path following `//` within the clone, so the
+// paths in the file are resolved within the clone as well. An http or https
+// source is downloaded as a single file.
+//
+// Fetched sources are kept in CacheDir, keyed by URL and ref, and reused by
+// later merges; remove them to fetch again. Fetching needs the git command for
+// git sources. A RemoteResolver is not safe for concurrent use.
+type RemoteResolver struct {
+	CacheDir string
+	// Client is used for http sources, http.DefaultClient if nil.
+	Client *http.Client
+	// Local resolves other sources, FileResolver if nil.
+	Local SourceResolver
+}
+
+func (r *RemoteResolver) Resolve(ctx context.Context, source string) (string, error) {
+	switch {
+	case strings.HasPrefix(source, "git::"):
+		return r.resolveGit(ctx, strings.TrimPrefix(source, "git::"))
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		return r.resolveHTTP(ctx, source)
+	}
+	if r.Local == nil {
+		return FileResolver{}.Resolve(ctx, source)
+	}
+	return r.Local.Resolve(ctx, source)
+}
+
+// resolveGit clones the repository of source, which has the form
+// url//path?ref=ref, and returns the path of the file within the clone.
+func (r *RemoteResolver) resolveGit(ctx context.Context, source string) (string, error) {
+	source, query, _ := strings.Cut(source, "?")
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("invalid query %q: %w", query, err)
+	}
+	ref := values.Get("ref")
+	// The path follows the first `//` after the scheme.
+	start := 0
+	if i := strings.Index(source, "://"); i >= 0 {
+		start = i + len("://")
+	}
+	i := strings.Index(source[start:], "//")
+	if i < 0 {
+		return "", fmt.Errorf("git source %q has no //path", source)
+	}
+	repo, file := source[:start+i], source[start+i+len("//"):]
+	if file == "" || path.IsAbs(file) || strings.HasPrefix(path.Clean(file), "..") {
+		return "", fmt.Errorf("git source %q has an invalid path", source)
+	}
+
+	dir := r.cachePath(repo, ref)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		args := []string{"clone", "--quiet", "--depth", "1"}
+		if ref != "" {
+			args = append(args, "--branch", ref)
+		}
+		tmp := dir + ".tmp"
+		if err := os.RemoveAll(tmp); err != nil {
+			return "", err
+		}
+		args = append(args, "--", repo, tmp)
+		if out, err := exec.CommandContext(ctx, "git", args...).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("error cloning %s: %w: %s", repo, err, strings.TrimSpace(string(out)))
+		}
+		if err := os.Rename(tmp, dir); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(file)), nil
+}
+
+// resolveHTTP downloads source and returns the path of the downloaded file,
+// which keeps the name, and so the extension, of the URL.
+func (r *RemoteResolver) resolveHTTP(ctx context.Context, source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "", fmt.Errorf("http source %q has no file name", source)
+	}
+	// The name is decoded from the URL, so it may be `..` or hold separators
+	// that would place the file outside the cache.
+	if !filepath.IsLocal(name) || filepath.Base(name) != name {
+		return "", fmt.Errorf("http source %q has an invalid file name", source)
+	}
+	file := filepath.Join(r.cachePath(source, ""), name)
+	if _, err := os.Stat(file); err == nil {
+		return file, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return "", err
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching %s: %s", source, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error fetching %s: %w", source, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// cachePath returns the directory a source is fetched into.
+func (r *RemoteResolver) cachePath(source, ref string) string {
+	sum := sha256.Sum256([]byte(source + "\x00" + ref))
+	return filepath.Join(r.CacheDir, hex.EncodeToString(sum[:8]))
+}
@@ -0,0 +1,138 @@
+package butanex
+
+import (
+	"context"
+	"errors"
+	"github.com/google/go-cmp/cmp"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteResolver(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := writeFiles(t, map[string]string{
+		"fragments/base.yaml": "variant: fcos\nstorage:\n  files:\n    - path: /etc/motd\n      contents:\n        local: motd.txt\n",
+	})
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "base"},
+		{"tag", "v1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s got err: %s: %s", args[0], err, out)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/overlay.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("kernel_arguments:\n  should_exist: [quiet]\n"))
+	}))
+	defer server.Close()
+
+	dir := writeFiles(t, map[string]string{
+		"local.yaml": "passwd:\n  users:\n    - name: core\n",
+	})
+	cache := t.TempDir()
+	options := &Options{
+		FilesDir:    dir,
+		ResolvePath: []string{".local"},
+		Resolver:    &RemoteResolver{CacheDir: cache},
+	}
+	base := "git::file://" + repo + "//fragments/base.yaml?ref=v1"
+	got, err := MergeFiles(options, base, server.URL+"/overlay.yaml", "local.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	local, err := options.Resolver.Resolve(context.Background(), base)
+	if err != nil {
+		t.Fatalf("Resolve() got err: %s", err)
+	}
+	clone := filepath.Dir(filepath.Dir(local))
+	want := "variant: fcos\n" +
+		"storage:\n  files:\n    - path: /etc/motd\n      contents:\n        local: " + filepath.Join(clone, "fragments/motd.txt") + "\n" +
+		"kernel_arguments:\n  should_exist: [quiet]\n" +
+		"passwd:\n  users:\n    - name: core\n"
+	if diff := cmp.Diff(mustUnmarshal(t, []byte(want)), mustUnmarshal(t, got)); diff != "" {
+		t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+	}
+
+	if _, err := MergeFiles(options, server.URL+"/missing.yaml"); err == nil {
+		t.Errorf("MergeFiles() got nil error, wanted 404")
+	}
+}
+
+func TestRemoteResolverFileName(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "cache")
+	r := &RemoteResolver{CacheDir: cache}
+	for source, wantErr := range map[string]string{
+		"http://example.com/fragments/%2e%2e": "has an invalid file name",
+		"http://example.com/":                 "has no file name",
+	} {
+		if _, err := r.Resolve(context.Background(), source); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("Resolve(%q) got err %v wanted %q", source, err, wantErr)
+		}
+	}
+	if _, err := os.Stat(cache); !os.IsNotExist(err) {
+		t.Errorf("Resolve() got cache written, wanted nothing fetched: %v", err)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.yaml": "variant: fcos\nversion: 1.5.0\n",
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A hung source, until the client gives up.
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	options := &Options{
+		FilesDir:    dir,
+		Resolver:    &RemoteResolver{CacheDir: t.TempDir()},
+		ReadTimeout: 50 * time.Millisecond,
+	}
+
+	got, err := MergeFiles(options, "base.yaml")
+	if err != nil {
+		t.Fatalf("MergeFiles() got err: %s", err)
+	}
+	if diff := cmp.Diff(mustUnmarshal(t, []byte("variant: fcos\nversion: 1.5.0\n")), mustUnmarshal(t, got)); diff != "" {
+		t.Errorf("MergeFiles() got diff: -want/+got: %s", diff)
+	}
+
+	slow := server.URL + "/slow.yaml"
+	start := time.Now()
+	_, err = MergeFiles(options, "base.yaml", slow)
+	wantErr := "file[" + slow + "]: error resolving source: read timed out after 50ms"
+	if err == nil || !strings.HasPrefix(err.Error(), wantErr) {
+		t.Errorf("MergeFiles() got err %v wanted %q", err, wantErr)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MergeFiles() got err %v wanted context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("MergeFiles() took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	options.ReadTimeout = time.Minute
+	_, err = MergeFilesContext(ctx, options, "base.yaml", slow)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("MergeFilesContext() got err %v wanted context.Canceled", err)
+	}
+}
@@ -0,0 +1,110 @@
+package butanex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParsePolicySpec parses a merge policy from a single string, suitable for a
+// command line flag or an environment variable, for example:
+//
+//	overwrite=$.storage.files;append=.ssh_authorized_keys;resolve=.local
+//
+// The spec is a list of clauses separated by `;`. Each clause names a policy
+// and one or more patterns separated by `,`. The policies are overwrite,
+// append, prepend, resolve, ignore and replace, which add to the pattern lists
+// Overwrite, Append, Prepend, ResolvePath, Ignore and ReplaceSubtree of
+// Options, and default, which takes the single value overwrite or
+// append and sets DefaultOverWrite.
+func ParsePolicySpec(spec string) (*Options, error) {
+	options := &Options{}
+	lists := map[string]*[]string{
+		"overwrite": &options.Overwrite,
+		"append":    &options.Append,
+		"prepend":   &options.Prepend,
+		"resolve":   &options.ResolvePath,
+		"ignore":    &options.Ignore,
+		"replace":   &options.ReplaceSubtree,
+	}
+	// modes maps each pattern of the overwrite, append and prepend lists to
+	// its list, as a pattern may appear in only one of them.
+	modes := map[string]string{}
+	for _, clause := range strings.Split(spec, ";") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(clause, "=")
+		if !ok {
+			return nil, fmt.Errorf("clause[%s]: missing '='", clause)
+		}
+		name = strings.TrimSpace(name)
+		if name == "default" {
+			switch strings.TrimSpace(value) {
+			case "overwrite":
+				options.DefaultOverWrite = true
+			case "append":
+				options.DefaultOverWrite = false
+			default:
+				return nil, fmt.Errorf("clause[%s]: unknown default policy %q", clause, value)
+			}
+			continue
+		}
+		list, ok := lists[name]
+		if !ok {
+			return nil, fmt.Errorf("clause[%s]: unknown policy %q", clause, name)
+		}
+		isMode := name == "overwrite" || name == "append" || name == "prepend"
+		for _, pattern := range strings.Split(value, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if err := validatePattern(pattern); err != nil {
+				return nil, fmt.Errorf("clause[%s]: %w", clause, err)
+			}
+			if isMode {
+				if other, ok := modes[pattern]; ok && other != name {
+					return nil, fmt.Errorf("clause[%s]: pattern %q is also in %s", clause, pattern, other)
+				}
+				modes[pattern] = name
+			}
+			*list = append(*list, pattern)
+		}
+	}
+	return options, nil
+}
+
+// MergeFilesFromArgs merges the files like MergeFiles using the policy parsed
+// from spec by ParsePolicySpec. Files are resolved relative to the working
+// directory.
+func MergeFilesFromArgs(spec string, path ...string) ([]byte, error) {
+	options, err := ParsePolicySpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return MergeFiles(options, path...)
+}
+
+// validatePattern returns an error if pattern is not a well formed context path
+// pattern.
+func validatePattern(pattern string) error {
+	if isQuery(pattern) {
+		_, err := compileQuery(pattern)
+		return err
+	}
+	if pattern == "" || pattern == "$" || pattern == "." {
+		return fmt.Errorf("pattern %q is empty", pattern)
+	}
+	if strings.ContainsAny(pattern, " \t\n") {
+		return fmt.Errorf("pattern %q contains whitespace", pattern)
+	}
+	segments := splitPath(pattern)
+	for i, segment := range segments {
+		// A single empty segment, from `..`, matches any number of keys.
+		if segment == "" && i > 0 && (i == len(segments)-1 || segments[i-1] == "") {
+			return fmt.Errorf("pattern %q has an empty segment", pattern)
+		}
+		if segment == "$" && i > 0 {
+			return fmt.Errorf("pattern %q has `$` after the start", pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package butanex
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"strings"
+	"testing"
+)
+
+func TestParsePolicySpec(t *testing.T) {
+	cases := []struct {
+		name    string
+		spec    string
+		want    *Options
+		wantErr string
+	}{
+		{
+			name: "all-policies",
+			spec: "overwrite=$.storage.files;append=.ssh_authorized_keys;resolve=.local",
+			want: &Options{
+				Overwrite:   []string{"$.storage.files"},
+				Append:      []string{".ssh_authorized_keys"},
+				ResolvePath: []string{".local"},
+			},
+		},
+		{
+			name: "multiple-patterns",
+			spec: " default=overwrite ; prepend=.should_exist, .dropins ; ignore=.x-owner; replace=.clevis",
+			want: &Options{
+				DefaultOverWrite: true,
+				Prepend:          []string{".should_exist", ".dropins"},
+				Ignore:           []string{".x-owner"},
+				ReplaceSubtree:   []string{".clevis"},
+			},
+		},
+		{
+			name:    "unknown-policy",
+			spec:    "patch=$.storage",
+			wantErr: `unknown policy "patch"`,
+		},
+		{
+			name:    "missing-equals",
+			spec:    "overwrite",
+			wantErr: "missing '='",
+		},
+		{
+			name:    "empty-pattern",
+			spec:    "overwrite=",
+			wantErr: `pattern "" is empty`,
+		},
+		{
+			name:    "empty-segment",
+			spec:    "append=$.storage...files",
+			wantErr: "has an empty segment",
+		},
+		{
+			name:    "conflicting-policies",
+			spec:    "overwrite=.files;append=.files",
+			wantErr: `pattern ".files" is also in overwrite`,
+		},
+		{
+			name:    "unknown-default",
+			spec:    "default=prepend",
+			wantErr: `unknown default policy "prepend"`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParsePolicySpec(tc.spec)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("ParsePolicySpec() got err %v wanted %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePolicySpec() got err: %s", err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreFields(Options{}, "GlobOrder")); diff != "" {
+				t.Errorf("ParsePolicySpec() got diff: -want/+got: %s", diff)
+			}
+		})
+	}
+}
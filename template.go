@@ -0,0 +1,62 @@
+package butanex
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// renderTemplates replaces the `template` key of every `contents` mapping in
+// config with the rendered template as `inline` contents. Template files are
+// relative to fileRoot.
+func (m *merge) renderTemplates(config map[string]any, fileRoot string) error {
+	w := &walker{visit: func(ctxpath string, v any) (any, bool, error) {
+		contents, ok := v.(map[string]any)
+		if !ok {
+			return nil, false, nil
+		}
+		segments := splitPath(ctxpath)
+		if segments[len(segments)-1] != "contents" {
+			return nil, false, nil
+		}
+		name, ok := contents["template"]
+		if !ok {
+			return nil, false, nil
+		}
+		cpath := joinPath(ctxpath, "template")
+		if _, ok := contents["inline"]; ok {
+			return nil, false, fmt.Errorf("key[%s] template and inline contents are exclusive", cpath)
+		}
+		file, ok := name.(string)
+		if !ok {
+			return nil, false, fmt.Errorf("key[%s] template is %T, want string", cpath, name)
+		}
+		rendered, err := m.renderTemplate(filepath.Join(fileRoot, file))
+		if err != nil {
+			return nil, false, fmt.Errorf("key[%s]: %w", cpath, err)
+		}
+		delete(contents, "template")
+		contents["inline"] = rendered
+		return nil, false, nil
+	}, maxDepth: m.maxDepth}
+	return w.mapping(config, "$")
+}
+
+func (m *merge) renderTemplate(path string) (string, error) {
+	m.addRead(m.localPath(path))
+	d, err := os.ReadFile(m.localPath(path))
+	if err != nil {
+		return "", fmt.Errorf("error reading template: %w", err)
+	}
+	tmpl, err := template.New(path).Option("missingkey=error").Parse(string(d))
+	if err != nil {
+		return "", fmt.Errorf("error parsing template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, m.templateData); err != nil {
+		return "", fmt.Errorf("error rendering template: %w", err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,29 @@
+package butanex
+
+import (
+	"context"
+)
+
+// ValidateFile checks the file named path on its own, before it is added to a
+// set of files to merge. The file is merged under options as the only input,
+// so the error, if any, is the one MergeFiles would return for it: the file
+// must parse, its top level must be a mapping and its merge tags and strategy
+// markers must be valid. With a schema selected by Variant and Version its
+// values must have the kinds of the spec, and with StrictKeys its keys must be
+// fields of it. A declaration of the files it comes after must be well formed,
+// but the files it names are not checked, as they are not inputs. Seed, Set
+// and SetFunc are ignored, as they are not part of the file, and nothing is
+// written.
+func ValidateFile(options *Options, path string) error {
+	o := Options{}
+	if options != nil {
+		o = *options
+	}
+	o.Seed, o.Set, o.SetFunc = nil, nil, nil
+	m, err := newMerge(&o, nil)
+	if err != nil {
+		return err
+	}
+	m.standalone = true
+	return m.mergeSpecs(context.Background(), []FileSpec{{Path: path}})
+}
@@ -0,0 +1,97 @@
+package butanex
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"valid.yaml":     "variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n    - path: /etc/motd\n",
+		"malformed.yaml": "storage:\n  files:\n    - path: /etc/motd\n   mode: 420\n",
+		"kind.yaml":      "storage:\n  files:\n    path: /etc/motd\n",
+		"typo.yaml":      "storage:\n  filez:\n    - path: /etc/motd\n",
+		"tag.yaml":       "storage: !merge\n  files: []\n",
+		"after.yaml":     "x-after: [base.yaml]\nstorage:\n  files: []\n",
+		"bad-after.yaml": "x-after: base.yaml\nstorage:\n  files: []\n",
+	})
+	fcos := Options{Variant: "fcos", Version: "1.5.0", StrictKeys: true}
+	cases := []struct {
+		name    string
+		options *Options
+		path    string
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			options: &fcos,
+			path:    "valid.yaml",
+		},
+		{
+			// The file is checked alone, so the seed does not conflict.
+			name:    "valid-seed",
+			options: &Options{Seed: map[string]any{"variant": "flatcar"}},
+			path:    "valid.yaml",
+		},
+		{
+			name:    "malformed",
+			path:    "malformed.yaml",
+			wantErr: "file[malformed.yaml]: error reading yaml: yaml: ",
+		},
+		{
+			name:    "wrong-kind",
+			options: &fcos,
+			path:    "kind.yaml",
+			wantErr: "key[$.storage.files] expects a sequence, got a mapping in kind.yaml",
+		},
+		{
+			name:    "unknown-key",
+			options: &fcos,
+			path:    "typo.yaml",
+			wantErr: `key[$.storage.filez] is not a known field in typo.yaml, did you mean "files"?`,
+		},
+		{
+			name:    "unknown-key-not-strict",
+			options: &Options{Variant: "fcos", Version: "1.5.0"},
+			path:    "typo.yaml",
+		},
+		{
+			name:    "merge-tag",
+			path:    "tag.yaml",
+			wantErr: "file[tag.yaml]: key[$.storage] unknown merge tag !merge",
+		},
+		{
+			// The files named are not inputs when the file is checked alone.
+			name:    "after",
+			options: &Options{AfterKey: "x-after"},
+			path:    "after.yaml",
+		},
+		{
+			name:    "after-malformed",
+			options: &Options{AfterKey: "x-after"},
+			path:    "bad-after.yaml",
+			wantErr: "file[bad-after.yaml]: key[$.x-after] is string, want a sequence of file names",
+		},
+		{
+			name:    "missing",
+			path:    "missing.yaml",
+			wantErr: "file[missing.yaml]: error reading file: ",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := Options{}
+			if tc.options != nil {
+				options = *tc.options
+			}
+			options.FilesDir = dir
+			err := ValidateFile(&options, tc.path)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("ValidateFile() got err: %s", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Errorf("ValidateFile() got err %v wanted %q", err, tc.wantErr)
+			}
+		})
+	}
+}
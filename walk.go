@@ -0,0 +1,99 @@
+package butanex
+
+import (
+	"fmt"
+)
+
+// Walk calls visit for every value within root along with its context path.
+// When visit returns true, the returned value replaces the visited value in
+// root. Walk returns the number of values replaced.
+//
+// Mappings and sequences are visited after the values they contain, so a
+// replacement is never walked itself. Elements of a sequence are visited with
+// the context path of the sequence, as when matching patterns. Walk can be used
+// to apply custom transforms to a merged config, such as normalizing file
+// modes.
+func Walk(root map[string]any, visit func(ctxpath string, value any) (any, bool)) int {
+	w := &walker{visit: func(ctxpath string, v any) (any, bool, error) {
+		vv, ok := visit(ctxpath, v)
+		return vv, ok, nil
+	}}
+	// visit never returns an error.
+	_ = w.mapping(root, "$")
+	return w.modified
+}
+
+// walker walks a config, replacing values as directed by visit.
+type walker struct {
+	visit func(ctxpath string, v any) (any, bool, error)
+	// maxDepth is the deepest nesting of mappings and sequences walked, or 0
+	// for no limit.
+	maxDepth int
+	depth    int
+	modified int
+	// scope, if non-nil, holds the sequence elements enclosing the value
+	// being visited.
+	scope *scope
+}
+
+// enter descends into the mapping or sequence at ctxpath.
+func (w *walker) enter(ctxpath string) error {
+	w.depth++
+	if w.maxDepth > 0 && w.depth > w.maxDepth {
+		return fmt.Errorf("key[%s] exceeds the maximum depth of %d", ctxpath, w.maxDepth)
+	}
+	return nil
+}
+
+// mapping walks the values of object, which is at ctxpath.
+func (w *walker) mapping(object map[string]any, ctxpath string) error {
+	if err := w.enter(ctxpath); err != nil {
+		return err
+	}
+	defer func() { w.depth-- }()
+	for k, v := range object {
+		vv, ok, err := w.value(v, joinPath(ctxpath, k))
+		if err != nil {
+			return err
+		}
+		if ok {
+			object[k] = vv
+		}
+	}
+	return nil
+}
+
+// value walks v, which is at ctxpath, and returns its replacement if visit
+// returned one.
+func (w *walker) value(v any, ctxpath string) (any, bool, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		if err := w.mapping(v, ctxpath); err != nil {
+			return nil, false, err
+		}
+	case []any:
+		if err := w.enter(ctxpath); err != nil {
+			return nil, false, err
+		}
+		defer func() { w.depth-- }()
+		for i, vi := range v {
+			w.scope.push(ctxpath, i, vi)
+			vv, ok, err := w.value(vi, ctxpath)
+			w.scope.pop()
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				v[i] = vv
+			}
+		}
+	}
+	vv, ok, err := w.visit(ctxpath, v)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		w.modified++
+	}
+	return vv, ok, nil
+}
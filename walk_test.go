@@ -0,0 +1,54 @@
+package butanex
+
+import (
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"strings"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	root := mustUnmarshal(t, []byte(`
+storage:
+  files:
+    - path: /etc/hostname
+      mode: 420
+      contents:
+        inline: HOST-A
+    - path: /etc/motd
+      mode: 0644
+`))
+	var visited []string
+	n := Walk(root, func(ctxpath string, v any) (any, bool) {
+		visited = append(visited, ctxpath)
+		switch ctxpath {
+		case "$.storage.files.mode":
+			if mode, ok := v.(int); ok {
+				return fmt.Sprintf("%04o", mode), true
+			}
+		case "$.storage.files.contents.inline":
+			return strings.ToLower(v.(string)), true
+		}
+		return nil, false
+	})
+	if n != 3 {
+		t.Errorf("Walk() got %d modified wanted 3", n)
+	}
+	want := mustUnmarshal(t, []byte(`
+storage:
+  files:
+    - path: /etc/hostname
+      mode: "0644"
+      contents:
+        inline: host-a
+    - path: /etc/motd
+      mode: "0644"
+`))
+	if diff := cmp.Diff(want, root); diff != "" {
+		t.Errorf("Walk() got diff: -want/+got: %s", diff)
+	}
+	// Containers are visited after their contents.
+	if got := visited[len(visited)-1]; got != "$.storage" {
+		t.Errorf("Walk() visited %s last wanted $.storage", got)
+	}
+}